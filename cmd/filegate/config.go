@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/filegate/filegate/internal/config"
+)
+
+// configResolver supplies flag values that weren't given on the command line,
+// preferring FILEGATE_* environment variables over config file settings
+type configResolver struct {
+	settings map[string]any
+	source   string
+}
+
+func (r *configResolver) Validate(app *kong.Application) error {
+	known := map[string]bool{"command": true}
+	kong.Visit(app, func(node kong.Visitable, next kong.Next) error {
+		if flag, ok := node.(*kong.Flag); ok {
+			known[flag.Name] = true
+		}
+		return next(nil)
+	})
+	for key := range r.settings {
+		if !known[key] {
+			return fmt.Errorf("%s: unknown setting %q", r.source, key)
+		}
+	}
+	return nil
+}
+
+func (r *configResolver) Resolve(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (any, error) {
+	if value, ok := os.LookupEnv(envName(flag.Name)); ok {
+		return value, nil
+	}
+
+	value, ok := r.settings[flag.Name]
+	if !ok || value == nil {
+		return nil, nil
+	}
+	switch value.(type) {
+	case map[string]any, []any:
+		// Maps and lists are decoded by kong as-is
+		return value, nil
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
+
+// envName returns the environment variable overriding a setting
+func envName(setting string) string {
+	return config.EnvPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// loadConfig reads the config file and profile selected by --config/--profile
+// (or FILEGATE_CONFIG/FILEGATE_PROFILE). They are picked out of the arguments
+// before kong parses them, since the profile decides the other flags' defaults.
+// If the profile names a command and none was given, it is inserted into args.
+func loadConfig(args []string, commands []string) (kong.Resolver, []string, error) {
+	path := os.Getenv(envName("config"))
+	profile := os.Getenv(envName("profile"))
+	hasCommand := false
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			i = len(args)
+		case arg == "--config" || arg == "--profile" || arg == "-P":
+			if i+1 < len(args) {
+				if arg == "--config" {
+					path = args[i+1]
+				} else {
+					profile = args[i+1]
+				}
+				i++
+			}
+		case strings.HasPrefix(arg, "--config="):
+			path = strings.TrimPrefix(arg, "--config=")
+		case strings.HasPrefix(arg, "--profile="):
+			profile = strings.TrimPrefix(arg, "--profile=")
+		case !strings.HasPrefix(arg, "-") && !hasCommand:
+			for _, cmd := range commands {
+				if arg == cmd {
+					hasCommand = true
+				}
+			}
+		}
+	}
+
+	if path != "" {
+		path = kong.ExpandPath(path)
+	}
+	file, err := config.Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	settings, err := file.Settings(profile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cmd, ok := settings["command"].(string); ok && cmd != "" && !hasCommand {
+		args = append([]string{cmd}, args...)
+	}
+
+	source := file.Path
+	if source == "" {
+		source = "config"
+	}
+	return &configResolver{settings: settings, source: source}, args, nil
+}
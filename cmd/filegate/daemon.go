@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/filegate/filegate/internal/daemon"
+)
+
+// SocketOptions locate the daemon's control socket
+type SocketOptions struct {
+	Socket string `help:"Daemon control socket" type:"path" default:"${daemon_socket}"`
+}
+
+// DaemonCmd handles the daemon subcommand, hosting shares in the background
+// and restoring them on restart
+type DaemonCmd struct {
+	Detach bool   `help:"Run in the background" short:"D"`
+	State  string `help:"File where shares are saved" type:"path" default:"${daemon_state}"`
+	Log    string `help:"Log file when detached" type:"path" default:"${daemon_log}"`
+
+	SocketOptions `embed:""`
+}
+
+func (cmd *DaemonCmd) Run() error {
+	if cmd.Detach {
+		return cmd.detach()
+	}
+
+	ln, err := daemon.Listen(cmd.Socket)
+	if err != nil {
+		return err
+	}
+
+	d := daemon.New(daemon.Config{
+		Start:     startShare,
+		StatePath: cmd.State,
+		Socket:    cmd.Socket,
+		Version:   version,
+	})
+	if err := d.Restore(); err != nil {
+		ln.Close()
+		return err
+	}
+
+	log.Printf("filegate daemon %s listening on %s", version, cmd.Socket)
+	for _, sh := range d.Shares() {
+		if sh.State == daemon.StateRunning {
+			log.Printf("Restored share %s: %s", sh.ID, sh.Path)
+		} else {
+			log.Printf("Failed to restore share %s: %s", sh.ID, sh.Error)
+		}
+	}
+
+	httpServer := &http.Server{Handler: d.Handler()}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- httpServer.Serve(ln)
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errChan:
+		d.Shutdown()
+		return fmt.Errorf("control API error: %w", err)
+	case <-sigChan:
+	}
+
+	log.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	httpServer.Shutdown(shutdownCtx)
+	d.Shutdown()
+	return nil
+}
+
+// detach re-runs the daemon in its own session with output going to the log
+// file, and waits until its control socket answers
+func (cmd *DaemonCmd) detach() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(cmd.Log), 0700); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	logFile, err := os.OpenFile(cmd.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %w", err)
+	}
+	defer logFile.Close()
+
+	child := exec.Command(exe, "daemon", "--socket", cmd.Socket, "--state", cmd.State)
+	child.Stdout = logFile
+	child.Stderr = logFile
+	setDetached(child)
+	if err := child.Start(); err != nil {
+		return fmt.Errorf("failed to start daemon: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- child.Wait()
+	}()
+
+	client := daemon.NewClient(cmd.Socket)
+	deadline := time.After(10 * time.Second)
+	for {
+		if status, err := client.Status(); err == nil && status.PID == child.Process.Pid {
+			fmt.Printf("Daemon started (pid %d)\n", status.PID)
+			fmt.Printf("  Socket: %s\n", cmd.Socket)
+			fmt.Printf("  Log: %s\n", cmd.Log)
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("daemon exited during startup, see %s", cmd.Log)
+		case <-deadline:
+			return fmt.Errorf("daemon did not start in time, see %s", cmd.Log)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// AddCmd handles the add subcommand, sharing a directory through the daemon
+type AddCmd struct {
+	Path string `arg:"" help:"Directory to share" type:"existingdir"`
+	ID   string `help:"Name for the share (defaults to the directory name)"`
+
+	ShareOptions  `embed:""`
+	SocketOptions `embed:""`
+}
+
+func (cmd *AddCmd) Run() error {
+	// Like the webdav command, default to a public URL
+	if !cmd.Local && !cmd.Public && !cmd.DLNA {
+		cmd.Public = true
+	}
+	if err := cmd.validate(); err != nil {
+		return err
+	}
+	if cmd.Approve {
+		return fmt.Errorf("--approve needs a terminal and can't be used with the daemon; use --allow instead")
+	}
+
+	path, err := filepath.Abs(cmd.Path)
+	if err != nil {
+		return err
+	}
+
+	// Generate the password here so it can be shown and persisted
+	if (cmd.Local || cmd.Public) && cmd.Pass == "" {
+		cmd.Pass, err = generatePassword(passwordLength)
+		if err != nil {
+			return fmt.Errorf("failed to generate password: %w", err)
+		}
+	}
+
+	sh, err := daemon.NewClient(cmd.Socket).Add(specFromOptions(cmd.ID, path, &cmd.ShareOptions))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added share %s\n", sh.ID)
+	fmt.Println()
+	printShare(sh, true)
+	if sh.Public {
+		fmt.Println()
+		fmt.Println("The public URL appears in 'filegate ls' once the relay connects.")
+	}
+	return nil
+}
+
+// LsCmd handles the ls subcommand, listing the daemon's shares
+type LsCmd struct {
+	JSON bool `help:"Print as JSON" name:"json"`
+
+	SocketOptions `embed:""`
+}
+
+func (cmd *LsCmd) Run() error {
+	shares, err := daemon.NewClient(cmd.Socket).List()
+	if err != nil {
+		return err
+	}
+	if cmd.JSON {
+		return printJSON(shares)
+	}
+
+	if len(shares) == 0 {
+		fmt.Println("No shares. Add one with 'filegate add <path>'.")
+		return nil
+	}
+	for i := range shares {
+		if i > 0 {
+			fmt.Println()
+		}
+		printShare(&shares[i], false)
+	}
+	return nil
+}
+
+// StopCmd handles the stop subcommand, removing a share from the daemon
+type StopCmd struct {
+	ID string `arg:"" help:"Share to stop (see 'filegate ls')"`
+
+	SocketOptions `embed:""`
+}
+
+func (cmd *StopCmd) Run() error {
+	if err := daemon.NewClient(cmd.Socket).Stop(cmd.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Stopped share %s\n", cmd.ID)
+	return nil
+}
+
+// StatusCmd handles the status subcommand, describing the running daemon
+type StatusCmd struct {
+	JSON bool `help:"Print as JSON" name:"json"`
+
+	SocketOptions `embed:""`
+}
+
+func (cmd *StatusCmd) Run() error {
+	status, err := daemon.NewClient(cmd.Socket).Status()
+	if err != nil {
+		return err
+	}
+	if cmd.JSON {
+		return printJSON(status)
+	}
+
+	running := 0
+	for _, sh := range status.Shares {
+		if sh.State == daemon.StateRunning {
+			running++
+		}
+	}
+	fmt.Printf("Daemon: running (pid %d, version %s)\n", status.PID, status.Version)
+	fmt.Printf("Uptime: %s\n", time.Since(status.StartedAt).Round(time.Second))
+	fmt.Printf("Socket: %s\n", status.Socket)
+	fmt.Printf("Shares: %d running, %d failed\n", running, len(status.Shares)-running)
+	return nil
+}
+
+// printShare prints one share for ls and add
+func printShare(sh *daemon.ShareStatus, showPassword bool) {
+	fmt.Printf("%s (%s)\n", sh.ID, sh.State)
+	fmt.Printf("  Path: %s\n", sh.Path)
+	fmt.Printf("  Protocols: %s\n", strings.Join(sh.Protocols(), ", "))
+	if sh.Local || sh.Public {
+		fmt.Printf("  Username: %s\n", sh.User)
+		if showPassword {
+			fmt.Printf("  Password: %s\n", sh.Password)
+		}
+		if sh.ReadOnly {
+			fmt.Println("  Access: read-only")
+		}
+	}
+	if sh.Error != "" {
+		fmt.Printf("  Error: %s\n", sh.Error)
+	}
+	for _, u := range sh.URLs {
+		fmt.Printf("  %s\n", u)
+	}
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// specFromOptions records share options for the daemon
+func specFromOptions(id, path string, o *ShareOptions) daemon.Spec {
+	return daemon.Spec{
+		ID:           id,
+		Path:         path,
+		Local:        o.Local,
+		Public:       o.Public,
+		DLNA:         o.DLNA,
+		Port:         o.Port,
+		DLNAPort:     o.DLNAPort,
+		User:         o.User,
+		Password:     o.Pass,
+		Users:        o.Users,
+		ReadOnly:     o.ReadOnly,
+		MaxUpload:    int64(o.MaxUploadSize),
+		Quota:        int64(o.Quota),
+		MinFree:      int64(o.MinFreeSpace),
+		Trash:        o.Trash,
+		TrashDays:    o.TrashDays,
+		ShowHidden:   o.ShowHidden,
+		Exclude:      o.Exclude,
+		NoGitignore:  !o.Gitignore,
+		Symlinks:     o.Symlinks,
+		Versions:     o.Versions,
+		VersionsKeep: o.VersionsKeep,
+		VersionsDays: o.VersionsDays,
+		TLS:          o.TLS,
+		TLSCert:      o.TLSCert,
+		TLSKey:       o.TLSKey,
+		MDNS:         o.MDNS,
+		MDNSName:     o.MDNSName,
+		Relay:        o.Relay,
+		Token:        o.Token,
+		Subdomain:    o.Subdomain,
+		E2E:          o.E2E,
+		Proxy:        o.Proxy,
+		RelayCA:      o.RelayCA,
+		RelayCert:    o.RelayCert,
+		RelayKey:     o.RelayKey,
+		RelayPin:     o.RelayPin,
+		Name:         o.Name,
+		Views:        o.Views,
+		Allow:        o.Allow,
+		Interface:    o.Interface,
+	}
+}
+
+// optionsFromSpec is the inverse of specFromOptions
+func optionsFromSpec(spec daemon.Spec) *ShareOptions {
+	return &ShareOptions{
+		Local:    spec.Local,
+		Public:   spec.Public,
+		DLNA:     spec.DLNA,
+		Port:     spec.Port,
+		DLNAPort: spec.DLNAPort,
+		WebDAVOptions: WebDAVOptions{
+			User:          spec.User,
+			Pass:          spec.Password,
+			Users:         spec.Users,
+			ReadOnly:      spec.ReadOnly,
+			MaxUploadSize: byteSize(spec.MaxUpload),
+			Quota:         byteSize(spec.Quota),
+			MinFreeSpace:  byteSize(spec.MinFree),
+			Trash:         spec.Trash,
+			TrashDays:     spec.TrashDays,
+			ShowHidden:    spec.ShowHidden,
+			Exclude:       spec.Exclude,
+			Gitignore:     !spec.NoGitignore,
+			Symlinks:      spec.Symlinks,
+			Versions:      spec.Versions,
+			VersionsKeep:  spec.VersionsKeep,
+			VersionsDays:  spec.VersionsDays,
+			TLS:           spec.TLS,
+			TLSCert:       spec.TLSCert,
+			TLSKey:        spec.TLSKey,
+			MDNS:          spec.MDNS,
+			MDNSName:      spec.MDNSName,
+			RelayOptions: RelayOptions{
+				Relay:     spec.Relay,
+				Token:     spec.Token,
+				Subdomain: spec.Subdomain,
+				Proxy:     spec.Proxy,
+				RelayCA:   spec.RelayCA,
+				RelayCert: spec.RelayCert,
+				RelayKey:  spec.RelayKey,
+				RelayPin:  spec.RelayPin,
+			},
+			E2E: spec.E2E,
+		},
+		DLNAOptions: DLNAOptions{
+			Name:      spec.Name,
+			Views:     spec.Views,
+			Allow:     spec.Allow,
+			Interface: spec.Interface,
+		},
+	}
+}
+
+// shareInstance is a daemon share's running services
+type shareInstance struct {
+	services []service
+	done     chan struct{}
+	err      error
+}
+
+// startShare brings up a share's services for the daemon
+func startShare(ctx context.Context, spec daemon.Spec) (daemon.Instance, error) {
+	services, _, err := optionsFromSpec(spec).services(spec.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	inst := &shareInstance{services: services, done: make(chan struct{})}
+	go func() {
+		defer close(inst.done)
+		err := serveAll(ctx, services)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Share %s stopped: %v", spec.ID, err)
+		}
+		inst.err = err
+	}()
+	return inst, nil
+}
+
+func (i *shareInstance) URLs() []string {
+	var urls []string
+	for _, svc := range i.services {
+		urls = append(urls, svc.urls()...)
+	}
+	return urls
+}
+
+func (i *shareInstance) Done() <-chan struct{} { return i.done }
+
+func (i *shareInstance) Err() error { return i.err }
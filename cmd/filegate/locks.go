@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/filegate/filegate/internal/webdav"
+)
+
+// LocksCmd handles the locks subcommands
+type LocksCmd struct {
+	Ls     LocksLsCmd     `cmd:"" help:"List locks held by WebDAV clients"`
+	Unlock LocksUnlockCmd `cmd:"" help:"Remove a lock, e.g. one left behind by a crashed client"`
+}
+
+// LocksLsCmd lists a share's locks
+type LocksLsCmd struct {
+	Path string `help:"Shared directory (defaults to the current directory)" type:"existingdir" short:"d"`
+	JSON bool   `help:"Print as JSON" name:"json"`
+}
+
+func (cmd *LocksLsCmd) Run() error {
+	store, err := webdav.OpenLockStore(webdav.DefaultLockPath(shareRoot(cmd.Path)))
+	if err != nil {
+		return err
+	}
+	locks, err := store.List()
+	if err != nil {
+		return err
+	}
+	if cmd.JSON {
+		if locks == nil {
+			locks = []webdav.LockInfo{}
+		}
+		return printJSON(locks)
+	}
+	if len(locks) == 0 {
+		fmt.Println("No locks")
+		return nil
+	}
+
+	for _, l := range locks {
+		depth := "infinite depth"
+		if l.ZeroDepth {
+			depth = "depth 0"
+		}
+		fmt.Printf("%s (%s)\n", l.Path, depth)
+		if owner := l.Owner(); owner != "" {
+			fmt.Printf("  Owner: %s\n", owner)
+		}
+		fmt.Printf("  Locked: %s\n", l.CreatedAt.Local().Format(time.DateTime))
+		if l.Expires.IsZero() {
+			fmt.Println("  Expires: never")
+		} else {
+			fmt.Printf("  Expires: %s\n", l.Expires.Local().Format(time.DateTime))
+		}
+		fmt.Printf("  Token: %s\n", l.Token)
+	}
+	return nil
+}
+
+// LocksUnlockCmd force-unlocks a lock by token, or every lock on a path
+type LocksUnlockCmd struct {
+	Target string `arg:"" help:"Lock token, or a path in the share to unlock"`
+	Path   string `help:"Shared directory (defaults to the current directory)" type:"existingdir" short:"d"`
+}
+
+func (cmd *LocksUnlockCmd) Run() error {
+	store, err := webdav.OpenLockStore(webdav.DefaultLockPath(shareRoot(cmd.Path)))
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(cmd.Target, "urn:uuid:") {
+		if err := store.ForceUnlock(cmd.Target); err != nil {
+			return fmt.Errorf("no lock with token %s", cmd.Target)
+		}
+		fmt.Println("Unlocked")
+		return nil
+	}
+
+	locks, err := store.List()
+	if err != nil {
+		return err
+	}
+	name := path.Clean("/" + filepath.ToSlash(cmd.Target))
+	unlocked := 0
+	for _, l := range locks {
+		if l.Path != name {
+			continue
+		}
+		if err := store.ForceUnlock(l.Token); err != nil {
+			return err
+		}
+		unlocked++
+	}
+	if unlocked == 0 {
+		return fmt.Errorf("%s is not locked", name)
+	}
+	fmt.Printf("Unlocked %s\n", name)
+	return nil
+}
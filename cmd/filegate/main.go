@@ -7,19 +7,20 @@ import (
 	"log"
 	"math/big"
 	"net"
-	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/anacrolix/dms/dlna/dms"
-	"github.com/anacrolix/ffprobe"
-	alog "github.com/anacrolix/log"
+	"github.com/filegate/filegate/internal/certs"
+	"github.com/filegate/filegate/internal/daemon"
+	"github.com/filegate/filegate/internal/dlna"
 	"github.com/filegate/filegate/internal/tunnel"
 	"github.com/filegate/filegate/internal/webdav"
+	"github.com/filegate/filegate/internal/webproxy"
 )
 
 const (
@@ -27,261 +28,476 @@ const (
 	passwordChars  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 )
 
-// WebDAVCmd handles the webdav subcommand
-type WebDAVCmd struct {
-	Local bool   `help:"Run in local mode (LAN only, no relay)" short:"l"`
-	Port  int    `help:"Port to listen on (local mode only)" default:"8080" short:"p"`
-	User  string `help:"Username for Basic Auth" default:"admin" short:"u"`
-	Pass  string `help:"Password for Basic Auth (auto-generated if not provided)"`
-	Relay string `help:"Relay server WebSocket URL" default:"wss://filegate.app/tunnel" hidden:""`
+// WebDAVOptions are the WebDAV settings shared by the webdav and serve commands
+type WebDAVOptions struct {
+	User     string            `help:"Username for Basic Auth" default:"admin" short:"u"`
+	Pass     string            `help:"Password for Basic Auth (auto-generated if not provided)"`
+	Users    map[string]string `help:"Additional users as name=password pairs"`
+	ReadOnly bool              `help:"Reject uploads, deletes and other changes"`
+
+	MaxUploadSize byteSize `name:"max-upload-size" help:"Largest file a single upload may be (e.g. 500MB; 0 for no limit)"`
+	Quota         byteSize `help:"Total size the share may grow to (e.g. 10GB; 0 for no limit)"`
+	MinFreeSpace  byteSize `name:"min-free-space" help:"Reject uploads that would leave less free disk space than this" default:"100MB"`
+
+	Trash     bool `help:"Move deleted files to a hidden trash folder instead of deleting them"`
+	TrashDays int  `name:"trash-days" help:"Days to keep trashed files (0 keeps them forever)" default:"30"`
+
+	ShowHidden bool     `name:"show-hidden" help:"Show files and folders whose names start with a dot"`
+	Exclude    []string `help:"Gitignore-style patterns for paths clients can't see or change (e.g. '*.key,build/')"`
+	Gitignore  bool     `help:"Also exclude what the share's .gitignore files list" default:"true" negatable:""`
+	Symlinks   string   `help:"Symlinks to follow: deny, within-root or follow-all" enum:"deny,within-root,follow-all" default:"within-root"`
+
+	Versions     bool `help:"Keep the previous content of files that get overwritten, browsable under /.versions"`
+	VersionsKeep int  `name:"versions-keep" help:"Versions to keep per file (0 for no limit)" default:"10"`
+	VersionsDays int  `name:"versions-days" help:"Days to keep versions (0 keeps them forever)" default:"30"`
+
+	RelayOptions `embed:""`
+	E2E          bool `name:"e2e" help:"End-to-end encrypt the public URL: the relay forwards TLS unopened and filegate terminates it (uses --tls-cert if given, else a certificate from the local CA)"`
+
+	TLS     bool   `name:"tls" help:"Serve local WebDAV over HTTPS with a certificate from an automatically created local CA"`
+	TLSCert string `name:"tls-cert" help:"Certificate file for local HTTPS" type:"existingfile"`
+	TLSKey  string `name:"tls-key" help:"Private key file for local HTTPS" type:"existingfile"`
+
+	MDNS     bool   `name:"mdns" help:"Advertise local WebDAV via mDNS/Bonjour so file managers discover it" default:"true" negatable:""`
+	MDNSName string `name:"mdns-name" help:"Name to advertise via mDNS (defaults to '<directory> on <hostname>')"`
+
+	QR            bool `name:"qr" help:"Show a QR code of the public URL once connected" default:"true" negatable:""`
+	QRCredentials bool `name:"qr-credentials" help:"Embed the username and password in the QR code"`
+	PrintJSON     bool `name:"print-json" help:"Print connection details as JSON lines on stdout (the status display moves to stderr)"`
 }
 
-func (cmd *WebDAVCmd) Run() error {
-	cwd, err := os.Getwd()
+// RelayOptions are the relay connection settings shared by the commands that
+// tunnel through it
+type RelayOptions struct {
+	Relay     string `help:"Relay server tunnel URL (wss:// for a WebSocket, https:// for HTTP/2)" default:"wss://filegate.app/tunnel" hidden:""`
+	Token     string `help:"Authentication token for the relay"`
+	Subdomain string `help:"Request a specific subdomain from the relay"`
+
+	Proxy     string   `help:"Proxy for the relay connection: http:// or socks5://, with user:password@ for authentication (defaults to HTTPS_PROXY)"`
+	RelayCA   string   `name:"relay-ca" help:"PEM bundle of extra root certificates to trust for the relay" type:"existingfile"`
+	RelayCert string   `name:"relay-cert" help:"Client certificate for mutual TLS with the relay" type:"existingfile"`
+	RelayKey  string   `name:"relay-key" help:"Private key for --relay-cert" type:"existingfile"`
+	RelayPin  []string `name:"relay-pin" help:"Base64 SHA-256 of a public key the relay's certificate chain must contain (may repeat)"`
+}
+
+// network sets up proxies and TLS for the relay connection, checking that
+// the relay URL has a transport
+func (o *RelayOptions) network() (*tunnel.Network, error) {
+	network, err := tunnel.NewNetwork(tunnel.NetworkConfig{
+		Proxy:    o.Proxy,
+		CAFile:   o.RelayCA,
+		CertFile: o.RelayCert,
+		KeyFile:  o.RelayKey,
+		Pins:     o.RelayPin,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get current directory: %w", err)
+		return nil, err
 	}
+	if _, err := tunnel.TransportFor(o.Relay, network); err != nil {
+		return nil, err
+	}
+	return network, nil
+}
 
+// handler creates the WebDAV server for root, generating a password if needed
+func (o *WebDAVOptions) handler(root string) (*webdav.Server, *credentials, error) {
 	// Generate password if not provided
-	password := cmd.Pass
+	password := o.Pass
 	if password == "" {
+		var err error
 		password, err = generatePassword(passwordLength)
 		if err != nil {
-			return fmt.Errorf("failed to generate password: %w", err)
+			return nil, nil, fmt.Errorf("failed to generate password: %w", err)
 		}
 	}
 
 	// Create WebDAV server
 	srv, err := webdav.New(webdav.Config{
-		Root:     cwd,
-		Username: cmd.User,
+		Root:     root,
+		Username: o.User,
 		Password: password,
+		Users:    o.Users,
+		ReadOnly: o.ReadOnly,
+
+		MaxUploadSize: int64(o.MaxUploadSize),
+		Quota:         int64(o.Quota),
+		MinFreeSpace:  int64(o.MinFreeSpace),
+
+		Trash:          o.Trash,
+		TrashRetention: time.Duration(o.TrashDays) * 24 * time.Hour,
+
+		ShowHidden: o.ShowHidden,
+		Exclude:    o.Exclude,
+		Gitignore:  o.Gitignore,
+		Symlinks:   webdav.SymlinkPolicy(o.Symlinks),
+
+		LockFile: webdav.DefaultLockPath(root),
+
+		Versions:          o.Versions,
+		VersionsKeep:      o.VersionsKeep,
+		VersionsRetention: time.Duration(o.VersionsDays) * 24 * time.Hour,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to create WebDAV server: %w", err)
+		return nil, nil, fmt.Errorf("failed to create WebDAV server: %w", err)
 	}
+	return srv, &credentials{
+		username:   o.User,
+		password:   password,
+		extraUsers: len(o.Users),
+		readOnly:   o.ReadOnly,
+		maxUpload:  int64(o.MaxUploadSize),
+		quota:      int64(o.Quota),
+		trashDays:  o.TrashDays,
+		trash:      o.Trash,
+		versions:   o.Versions,
+	}, nil
+}
 
-	if cmd.Local {
-		runLocalMode(srv, cwd, cmd.Port, cmd.User, password)
-	} else {
-		runRemoteMode(srv, cwd, cmd.Relay, cmd.User, password)
+// localTLS creates the HTTPS settings for local WebDAV, or returns nil for
+// plain HTTP
+func (o *WebDAVOptions) localTLS() (*localTLS, error) {
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key must be given together")
 	}
-	return nil
+
+	if o.TLSCert != "" {
+		cert, err := certs.LoadKeyPair(o.TLSCert, o.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		return newLocalTLS(cert, nil), nil
+	}
+
+	if !o.TLS {
+		return nil, nil
+	}
+	ca, err := certs.LoadOrCreateCA(certs.DefaultDir())
+	if err != nil {
+		return nil, err
+	}
+	hosts := append(getLocalIPs(), "localhost", "127.0.0.1", "::1")
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname, hostname+".local")
+	}
+	cert, err := ca.Issue(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalTLS(cert, ca), nil
+}
+
+// DLNAOptions are the DLNA settings shared by the dlna and serve commands
+type DLNAOptions struct {
+	Name      string   `help:"Server name (defaults to hostname)" short:"n"`
+	Views     bool     `help:"Add virtual views (recently added, videos, music by artist/album, photos by year, playlists)" default:"true" negatable:""`
+	Allow     []string `help:"Client IPs or CIDR ranges allowed to connect (defaults to the local subnets)"`
+	Interface []string `help:"Network interfaces to serve and announce on (defaults to all)" short:"i"`
+	Approve   bool     `help:"Ask in the terminal before serving each new device"`
+}
+
+// resolve validates the DLNA flags and fills in defaults
+func (o *DLNAOptions) resolve(port int) (dlnaOptions, error) {
+	ifaces, err := dlna.ResolveInterfaces(o.Interface)
+	if err != nil {
+		return dlnaOptions{}, err
+	}
+
+	allowed, err := dlna.ParseNetworks(o.Allow)
+	if err != nil {
+		return dlnaOptions{}, err
+	}
+	if len(allowed) == 0 {
+		allowed = dlna.InterfaceNets(ifaces)
+	}
+
+	return dlnaOptions{
+		port:    port,
+		name:    o.Name,
+		views:   o.Views,
+		ifaces:  ifaces,
+		allowed: allowed,
+		approve: o.Approve,
+	}, nil
+}
+
+// WebDAVCmd handles the webdav subcommand
+type WebDAVCmd struct {
+	Path  string `help:"Directory to share (defaults to the current directory)" type:"existingdir" short:"d"`
+	Local bool   `help:"Run in local mode (LAN only, no relay)" short:"l"`
+	Port  int    `help:"Port to listen on (local mode only)" default:"8080" short:"p"`
+
+	WebDAVOptions `embed:""`
+}
+
+func (cmd *WebDAVCmd) Run() error {
+	return (&ServeCmd{
+		Path: cmd.Path,
+		ShareOptions: ShareOptions{
+			Local:         cmd.Local,
+			Public:        !cmd.Local,
+			Port:          cmd.Port,
+			WebDAVOptions: cmd.WebDAVOptions,
+		},
+	}).Run()
 }
 
 // DLNACmd handles the dlna subcommand
 type DLNACmd struct {
+	Path string `help:"Directory to share (defaults to the current directory)" type:"existingdir" short:"d"`
 	Port int    `help:"Port to listen on" default:"8080" short:"p"`
-	Name string `help:"Server name (defaults to hostname)" short:"n"`
+
+	DLNAOptions `embed:""`
 }
 
 func (cmd *DLNACmd) Run() error {
-	cwd, err := os.Getwd()
-	if err != nil {
-		return fmt.Errorf("failed to get current directory: %w", err)
-	}
+	return (&ServeCmd{
+		Path: cmd.Path,
+		ShareOptions: ShareOptions{
+			DLNA:        true,
+			DLNAPort:    cmd.Port,
+			DLNAOptions: cmd.DLNAOptions,
+		},
+	}).Run()
+}
 
-	runDLNAMode(cwd, cmd.Port, cmd.Name)
+// ShareOptions select the protocols and their settings for one shared
+// directory. They are shared by the serve and add commands.
+type ShareOptions struct {
+	Local    bool `help:"Serve WebDAV on the local network" short:"l"`
+	Public   bool `help:"Serve WebDAV on a public URL via the relay"`
+	DLNA     bool `name:"dlna" help:"Serve media to smart TVs via DLNA"`
+	Port     int  `help:"Port for local WebDAV" default:"8080" short:"p"`
+	DLNAPort int  `name:"dlna-port" help:"Port for DLNA" default:"8200"`
+
+	WebDAVOptions `embed:""`
+	DLNAOptions   `embed:""`
+}
+
+// validate checks that the options make sense together
+func (o *ShareOptions) validate() error {
+	if !o.Local && !o.Public && !o.DLNA {
+		return fmt.Errorf("nothing to serve: pass --local, --public and/or --dlna")
+	}
+	if o.Local && o.DLNA && o.Port == o.DLNAPort {
+		return fmt.Errorf("local WebDAV and DLNA cannot share port %d", o.Port)
+	}
 	return nil
 }
 
-var CLI struct {
-	Webdav  WebDAVCmd `cmd:"" default:"withargs" help:"Expose directory via WebDAV (default: public URL via relay)"`
-	Dlna    DLNACmd   `cmd:"" help:"Expose directory via DLNA for smart TVs"`
-	Version kong.VersionFlag `help:"Show version" short:"v"`
+// services creates the selected services over root. Each one is listening
+// when this returns; if any fails, those already created are stopped.
+func (o *ShareOptions) services(root string) ([]service, *credentials, error) {
+	var services []service
+	var err error
+	var creds *credentials
+
+	// Stop anything already listening if a later service fails to start
+	fail := func(err error) ([]service, *credentials, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		for _, svc := range services {
+			svc.run(ctx)
+		}
+		return nil, nil, err
+	}
+
+	if o.Local || o.Public {
+		var srv *webdav.Server
+		srv, creds, err = o.WebDAVOptions.handler(root)
+		if err != nil {
+			return nil, nil, err
+		}
+		if o.Local {
+			tlsOpts, err := o.WebDAVOptions.localTLS()
+			if err != nil {
+				return nil, nil, err
+			}
+			svc, err := newLocalWebDAVService(srv, o.Port, tlsOpts)
+			if err != nil {
+				return fail(err)
+			}
+			services = append(services, svc)
+
+			if o.MDNS {
+				// Discovery is a convenience, so a failure only warns
+				adv, err := newMDNSService(root, o.MDNSName, o.Port, tlsOpts != nil, creds.username)
+				if err != nil {
+					fmt.Fprintf(out, "Warning: mDNS advertisement disabled: %v\n", err)
+				} else {
+					services = append(services, adv)
+				}
+			}
+		}
+		if o.Public {
+			relay, err := newRelayWebDAVService(srv, &o.WebDAVOptions, creds)
+			if err != nil {
+				return fail(err)
+			}
+			services = append(services, relay)
+		}
+	}
+
+	if o.DLNA {
+		opts, err := o.DLNAOptions.resolve(o.DLNAPort)
+		if err != nil {
+			return fail(err)
+		}
+		svc, err := newDLNAService(root, opts)
+		if err != nil {
+			return fail(err)
+		}
+		services = append(services, svc)
+	}
+
+	return services, creds, nil
 }
 
-var version = "dev"
+// ServeCmd handles the serve subcommand, running any combination of
+// protocols over the current directory from one process
+type ServeCmd struct {
+	Path string `help:"Directory to share (defaults to the current directory)" type:"existingdir" short:"d"`
 
-func main() {
-	ctx := kong.Parse(&CLI,
-		kong.Name("filegate"),
-		kong.Description("Expose the current directory via WebDAV or DLNA"),
-		kong.UsageOnError(),
-		kong.Vars{"version": version},
-	)
+	ShareOptions `embed:""`
+}
+
+func (cmd *ServeCmd) Run() error {
+	if err := cmd.validate(); err != nil {
+		return err
+	}
+	if cmd.PrintJSON {
+		out = os.Stderr
+	}
 
-	err := ctx.Run()
+	cwd := cmd.Path
+	if cwd == "" {
+		var err error
+		cwd, err = os.Getwd()
+		if err != nil {
+			return fmt.Errorf("failed to get current directory: %w", err)
+		}
+	}
+
+	services, creds, err := cmd.services(cwd)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return runServices(cwd, creds, services)
 }
 
-func runDLNAMode(cwd string, port int, name string) {
-	// Get hostname for friendly name
-	hostname := name
-	if hostname == "" {
-		hostname, _ = os.Hostname()
-		if hostname == "" {
-			hostname = "filegate"
-		}
+// TCPCmd handles the tcp subcommand
+type TCPCmd struct {
+	Target     string `arg:"" help:"Local port, or host:port, to forward connections to"`
+	RemotePort int    `name:"remote-port" help:"Request a specific port on the relay"`
+
+	RelayOptions `embed:""`
+}
+
+func (cmd *TCPCmd) Run() error {
+	target := cmd.Target
+	if _, err := strconv.Atoi(target); err == nil {
+		target = net.JoinHostPort("localhost", target)
+	}
+	if _, port, err := net.SplitHostPort(target); err != nil || port == "" {
+		return fmt.Errorf("invalid target %q: expected a port or host:port", cmd.Target)
 	}
 
-	// Create listener first to verify port is available
-	addr := fmt.Sprintf(":%d", port)
-	ln, err := net.Listen("tcp", addr)
+	svc, err := newTCPService(target, cmd.RemotePort, &cmd.RelayOptions)
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", addr, err)
-	}
-
-	// Create a logger for the DLNA server
-	logger := alog.NewLogger("dms")
-	logger.SetHandlers(alog.DiscardHandler)
-
-	// Allow all clients (0.0.0.0/0)
-	_, allowAll, _ := net.ParseCIDR("0.0.0.0/0")
-
-	// Configure DLNA server
-	server := &dms.Server{
-		HTTPConn:       ln,
-		FriendlyName:   hostname,
-		RootObjectPath: cwd,
-		NoTranscode:    true,  // Don't transcode - serve files directly
-		NoProbe:        true,  // Disable probing to avoid dms library bugs
-		NotifyInterval: 30 * time.Second,
-		IgnoreHidden:   true,
-		AllowedIpNets:  []*net.IPNet{allowAll},
-		Logger:         logger,
-		Icons:          defaultIcons(),
-	}
-
-	// Initialize the server
-	if err := server.Init(); err != nil {
-		ln.Close()
-		log.Fatalf("Failed to initialize DLNA server: %v", err)
-	}
-
-	// Now print startup message after successful init
-	ips := getLocalIPs()
-
-	fmt.Println("Starting filegate in DLNA mode...")
-	if ffprobe.Available() {
-		fmt.Println("Media probing: \033[36mffprobe\033[0m")
-	} else {
-		fmt.Println("Media probing: \033[33minternal (ffprobe not found)\033[0m")
-	}
-	if isCommandAvailable("ffmpegthumbnailer") {
-		fmt.Println("Thumbnails: \033[36menabled\033[0m")
-	} else {
-		fmt.Println("Thumbnails: \033[33mdisabled (ffmpegthumbnailer not found)\033[0m")
-	}
-	fmt.Println()
-	fmt.Printf("Serving: %s\n", cwd)
-	fmt.Println()
-	fmt.Printf("Server name: %s\n", hostname)
-	fmt.Println()
-	fmt.Println("Your smart TV should discover this server automatically.")
-	fmt.Println("Look for it in your TV's media/DLNA sources.")
-	fmt.Println()
-	fmt.Println("Access URLs:")
-	for _, ip := range ips {
-		fmt.Printf("  http://%s:%d\n", ip, port)
-	}
-	fmt.Println()
-	fmt.Println("Press Ctrl+C to stop")
-
-	// Graceful shutdown
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
-
-		fmt.Println("\nShutting down...")
-		server.Close()
-		ln.Close()
-	}()
-
-	if err := server.Run(); err != nil {
-		log.Fatalf("DLNA server error: %v", err)
+		return err
 	}
+	fmt.Fprintln(out, "Starting filegate...")
+	fmt.Fprintln(out)
+	svc.describe()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Press Ctrl+C to stop")
+	return serveUntilInterrupted([]service{svc})
 }
 
-func runLocalMode(srv *webdav.Server, cwd string, port int, username, password string) {
-	addr := fmt.Sprintf(":%d", port)
-
-	httpServer := &http.Server{
-		Addr:         addr,
-		Handler:      srv,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 60 * time.Second,
-	}
-
-	// Get local IPs
-	ips := getLocalIPs()
-
-	fmt.Println("Starting filegate in local mode...")
-	fmt.Println()
-	fmt.Printf("Serving: %s\n", cwd)
-	fmt.Println()
-	fmt.Printf("Username: %s\n", username)
-	fmt.Printf("Password: %s\n", password)
-	fmt.Println()
-	fmt.Println("Access URLs:")
-	for _, ip := range ips {
-		fmt.Printf("  http://%s:%d\n", ip, port)
-	}
-	fmt.Printf("  http://localhost:%d\n", port)
-	fmt.Println()
-	fmt.Println("Press Ctrl+C to stop")
-
-	// Graceful shutdown
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
-
-		fmt.Println("\nShutting down...")
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		httpServer.Shutdown(ctx)
-	}()
-
-	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("Server error: %v", err)
+// HTTPCmd handles the http subcommand
+type HTTPCmd struct {
+	Target     string `arg:"" help:"Local web app to forward requests to: a port, host:port or URL"`
+	HostHeader string `name:"host-header" help:"Host header sent to the app: the target's by default, 'preserve' for the public host, or any host name"`
+	User       string `help:"Username for Basic Auth (with --pass)" default:"admin" short:"u"`
+	Pass       string `help:"Require Basic Auth with this password in front of the app"`
+	QR         bool   `name:"qr" help:"Show a QR code of the public URL once connected" default:"true" negatable:""`
+
+	RelayOptions `embed:""`
+}
+
+func (cmd *HTTPCmd) Run() error {
+	proxy, err := webproxy.New(webproxy.Config{
+		Target:     cmd.Target,
+		HostHeader: cmd.HostHeader,
+		Username:   cmd.User,
+		Password:   cmd.Pass,
+	})
+	if err != nil {
+		return err
+	}
+
+	svc, err := newRelayHTTPService(proxy, cmd.QR, &cmd.RelayOptions)
+	if err != nil {
+		return err
 	}
+	fmt.Fprintln(out, "Starting filegate...")
+	fmt.Fprintln(out)
+	if cmd.Pass != "" {
+		fmt.Fprintf(out, "Username: %s\n", cmd.User)
+		fmt.Fprintf(out, "Password: %s\n", cmd.Pass)
+		fmt.Fprintln(out)
+	}
+	svc.describe()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Press Ctrl+C to stop")
+	return serveUntilInterrupted([]service{svc})
 }
 
-func runRemoteMode(srv *webdav.Server, cwd, relayURL, username, password string) {
-	fmt.Println("Starting filegate...")
-	fmt.Println()
-	fmt.Printf("Serving: %s\n", cwd)
-	fmt.Println()
-	fmt.Printf("Username: %s\n", username)
-	fmt.Printf("Password: %s\n", password)
-	fmt.Println()
-	fmt.Println("Connecting to relay server...")
-
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// Handle shutdown
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
-		fmt.Println("\nShutting down...")
-		cancel()
-	}()
-
-	client := tunnel.New(tunnel.Config{
-		RelayURL: relayURL,
-		Handler:  srv,
-		OnConnected: func(subdomain, fullURL string) {
-			fmt.Println()
-			fmt.Printf("Connected! Your WebDAV is available at:\n")
-			fmt.Printf("  %s\n", fullURL)
-			fmt.Println()
-			fmt.Println("Press Ctrl+C to stop")
-		},
-		OnDisconnected: func(err error) {
-			fmt.Printf("\nDisconnected: %v\n", err)
-		},
-		OnReconnecting: func(attempt int) {
-			fmt.Printf("Reconnecting (attempt %d)...\n", attempt)
+var CLI struct {
+	Webdav   WebDAVCmd        `cmd:"" default:"withargs" help:"Expose directory via WebDAV (default: public URL via relay)"`
+	Dlna     DLNACmd          `cmd:"" help:"Expose directory via DLNA for smart TVs"`
+	Serve    ServeCmd         `cmd:"" help:"Serve several protocols at once (e.g. --local --dlna)"`
+	Daemon   DaemonCmd        `cmd:"" help:"Run the background daemon that hosts shares"`
+	Add      AddCmd           `cmd:"" help:"Share a directory through the daemon"`
+	Ls       LsCmd            `cmd:"" help:"List the daemon's shares"`
+	Stop     StopCmd          `cmd:"" help:"Stop one of the daemon's shares"`
+	Status   StatusCmd        `cmd:"" help:"Show whether the daemon is running"`
+	Trash    TrashCmd         `cmd:"" help:"List and restore files deleted in trash mode"`
+	Locks    LocksCmd         `cmd:"" help:"List and remove WebDAV locks"`
+	Versions VersionsCmd      `cmd:"" help:"List and restore earlier versions of files"`
+	Http     HTTPCmd          `cmd:"" help:"Share a local web app on a public URL via the relay"`
+	Tcp      TCPCmd           `cmd:"" help:"Expose a local TCP port through the relay"`
+	Version  kong.VersionFlag `help:"Show version" short:"v"`
+	Config   string           `help:"Config file (defaults to filegate/config.yaml in the user config directory)" type:"path"`
+	Profile  string           `help:"Named profile from the config file" short:"P"`
+}
+
+var version = "dev"
+
+func main() {
+	resolver, args, err := loadConfig(os.Args[1:], []string{"webdav", "dlna", "serve", "daemon", "add", "ls", "stop", "status", "trash", "locks", "versions", "http", "tcp"})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parser := kong.Must(&CLI,
+		kong.Name("filegate"),
+		kong.Description("Expose the current directory via WebDAV or DLNA"),
+		kong.UsageOnError(),
+		kong.Vars{
+			"version":       version,
+			"daemon_socket": daemon.DefaultSocketPath(),
+			"daemon_state":  daemon.DefaultStatePath(),
+			"daemon_log":    daemon.DefaultLogPath(),
 		},
-	})
+		kong.Resolvers(resolver),
+	)
+
+	ctx, err := parser.Parse(args)
+	parser.FatalIfErrorf(err)
 
-	if err := client.Connect(ctx); err != nil && err != context.Canceled {
-		log.Fatalf("Connection error: %v", err)
+	err = ctx.Run()
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -343,6 +559,18 @@ func getLocalIPs() []string {
 	return ips
 }
 
+// formatNetworks renders a list of networks for display
+func formatNetworks(nets []*net.IPNet) string {
+	if len(nets) == 0 {
+		return "everyone"
+	}
+	var parts []string
+	for _, n := range nets {
+		parts = append(parts, n.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
 // defaultIcons returns a simple embedded icon for DLNA clients
 func defaultIcons() []dms.Icon {
 	// Simple 48x48 PNG icon (folder icon)
@@ -0,0 +1,835 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anacrolix/dms/dlna/dms"
+	"github.com/anacrolix/ffprobe"
+	alog "github.com/anacrolix/log"
+	"github.com/filegate/filegate/internal/certs"
+	"github.com/filegate/filegate/internal/dlna"
+	"github.com/filegate/filegate/internal/mdns"
+	"github.com/filegate/filegate/internal/tunnel"
+	"github.com/filegate/filegate/internal/webproxy"
+)
+
+// out receives the human-readable status display. It is stdout unless
+// --print-json reserves stdout for machine-readable output.
+var out io.Writer = os.Stdout
+
+// shutdownTimeout bounds how long services get to finish in-flight requests
+const shutdownTimeout = 5 * time.Second
+
+// service is one protocol frontend over the shared root. Constructors do any
+// setup that can fail (listening, initialising) so that problems are reported
+// before anything starts serving.
+type service interface {
+	// describe prints how to reach the service for the status display
+	describe()
+	// urls returns the addresses the service is currently reachable at
+	urls() []string
+	// run serves until ctx is cancelled, then shuts down
+	run(ctx context.Context) error
+}
+
+// credentials are the Basic Auth details and limits shared by all WebDAV
+// services
+type credentials struct {
+	username   string
+	password   string
+	extraUsers int
+	readOnly   bool
+	maxUpload  int64
+	quota      int64
+	trash      bool
+	trashDays  int
+	versions   bool
+}
+
+// runServices prints a combined status display, runs every service and blocks
+// until Ctrl+C or until one of them fails, which stops the others
+func runServices(cwd string, creds *credentials, services []service) error {
+	fmt.Fprintln(out, "Starting filegate...")
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Serving: %s\n", cwd)
+	fmt.Fprintln(out)
+	if creds != nil {
+		fmt.Fprintf(out, "Username: %s\n", creds.username)
+		fmt.Fprintf(out, "Password: %s\n", creds.password)
+		if creds.extraUsers > 0 {
+			fmt.Fprintf(out, "Additional users: %d\n", creds.extraUsers)
+		}
+		if creds.readOnly {
+			fmt.Fprintln(out, "Access: read-only")
+		}
+		if creds.maxUpload > 0 {
+			fmt.Fprintf(out, "Upload limit: %s\n", formatBytes(creds.maxUpload))
+		}
+		if creds.quota > 0 {
+			fmt.Fprintf(out, "Quota: %s\n", formatBytes(creds.quota))
+		}
+		if creds.trash {
+			if creds.trashDays > 0 {
+				fmt.Fprintf(out, "Trash: deleted files are kept for %d days\n", creds.trashDays)
+			} else {
+				fmt.Fprintln(out, "Trash: deleted files are kept until restored")
+			}
+		}
+		if creds.versions {
+			fmt.Fprintln(out, "Versions: overwritten files are kept under /.versions")
+		}
+		fmt.Fprintln(out)
+	}
+	for _, svc := range services {
+		svc.describe()
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintln(out, "Press Ctrl+C to stop")
+
+	return serveUntilInterrupted(services)
+}
+
+// serveUntilInterrupted runs every service until Ctrl+C or until one of them
+// fails
+func serveUntilInterrupted(services []service) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Graceful shutdown
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		select {
+		case <-sigChan:
+			fmt.Fprintln(out, "\nShutting down...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return serveAll(ctx, services)
+}
+
+// serveAll runs every service until ctx is cancelled or one of them fails,
+// which stops the others
+func serveAll(ctx context.Context, services []service) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for _, svc := range services {
+		wg.Add(1)
+		go func(svc service) {
+			defer wg.Done()
+			if err := svc.run(ctx); err != nil {
+				errOnce.Do(func() { firstErr = err })
+				cancel()
+			}
+		}(svc)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// localTLS holds the certificate for local HTTPS
+type localTLS struct {
+	config *tls.Config
+	cert   *x509.Certificate
+	// ca issued cert, nil for user-provided certificates
+	ca *certs.CA
+}
+
+func newLocalTLS(cert tls.Certificate, ca *certs.CA) *localTLS {
+	return &localTLS{
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+		cert: cert.Leaf,
+		ca:   ca,
+	}
+}
+
+// localWebDAVService serves WebDAV directly on the LAN
+type localWebDAVService struct {
+	ln         net.Listener
+	port       int
+	tls        *localTLS
+	httpServer *http.Server
+}
+
+func newLocalWebDAVService(handler http.Handler, port int, tlsOpts *localTLS) (*localWebDAVService, error) {
+	addr := fmt.Sprintf(":%d", port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if tlsOpts != nil {
+		ln = tls.NewListener(ln, tlsOpts.config)
+	}
+
+	return &localWebDAVService{
+		ln:   ln,
+		port: port,
+		tls:  tlsOpts,
+		httpServer: &http.Server{
+			Handler:      handler,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 60 * time.Second,
+		},
+	}, nil
+}
+
+func (s *localWebDAVService) describe() {
+	fmt.Fprintln(out, "WebDAV (local network):")
+	for _, u := range s.urls() {
+		fmt.Fprintf(out, "  %s\n", u)
+	}
+	if s.tls == nil {
+		return
+	}
+	fmt.Fprintf(out, "  Certificate fingerprint (SHA-256):\n    %s\n", certs.Fingerprint(s.tls.cert))
+	if s.tls.ca != nil {
+		fmt.Fprintf(out, "  Self-signed: trust the local CA at %s to avoid warnings\n", s.tls.ca.CertPath)
+		fmt.Fprintf(out, "  CA fingerprint (SHA-256):\n    %s\n", certs.Fingerprint(s.tls.ca.Cert))
+	}
+}
+
+func (s *localWebDAVService) urls() []string {
+	scheme := "http"
+	if s.tls != nil {
+		scheme = "https"
+	}
+	var urls []string
+	for _, ip := range getLocalIPs() {
+		urls = append(urls, fmt.Sprintf("%s://%s:%d", scheme, ip, s.port))
+	}
+	return append(urls, fmt.Sprintf("%s://localhost:%d", scheme, s.port))
+}
+
+func (s *localWebDAVService) run(ctx context.Context) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.httpServer.Serve(s.ln)
+	}()
+
+	select {
+	case err := <-errChan:
+		return fmt.Errorf("WebDAV server error: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	s.httpServer.Shutdown(shutdownCtx)
+	return nil
+}
+
+// mdnsService advertises local WebDAV via DNS-SD so it shows up in Finder's
+// Network sidebar and Linux file managers
+type mdnsService struct {
+	responder *mdns.Responder
+	service   string
+}
+
+func newMDNSService(root, name string, port int, secure bool, username string) (*mdnsService, error) {
+	if name == "" {
+		hostname, _ := os.Hostname()
+		hostname, _, _ = strings.Cut(hostname, ".")
+		name = fmt.Sprintf("%s on %s", filepath.Base(root), hostname)
+	}
+	service := "_webdav._tcp"
+	if secure {
+		service = "_webdavs._tcp"
+	}
+
+	responder, err := mdns.New(mdns.Config{
+		Instance: name,
+		Service:  service,
+		Port:     port,
+		TXT:      []string{"path=/", "u=" + username},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mdnsService{responder: responder, service: service}, nil
+}
+
+func (s *mdnsService) describe() {
+	fmt.Fprintln(out, "mDNS:")
+	fmt.Fprintf(out, "  Advertising \"%s\" as %s\n", s.responder.Instance(), s.service)
+}
+
+func (s *mdnsService) urls() []string {
+	return nil
+}
+
+// run advertises until ctx is done. Advertising is a convenience, so losing
+// it only warns instead of stopping the share.
+func (s *mdnsService) run(ctx context.Context) error {
+	if err := s.responder.Run(ctx); err != nil {
+		fmt.Fprintf(out, "Warning: mDNS advertisement stopped: %v\n", err)
+	}
+	return nil
+}
+
+// relayWebDAVService exposes WebDAV on a public URL through the relay
+type relayWebDAVService struct {
+	client *tunnel.Client
+	opts   *WebDAVOptions
+	creds  *credentials
+	// e2e terminates TLS for end-to-end encrypted tunnels, nil otherwise
+	e2e *e2eTLS
+
+	mu      sync.Mutex
+	fullURL string
+	shown   string
+}
+
+func newRelayWebDAVService(handler http.Handler, opts *WebDAVOptions, creds *credentials) (*relayWebDAVService, error) {
+	network, err := opts.network()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &relayWebDAVService{opts: opts, creds: creds}
+	if opts.E2E {
+		if s.e2e, err = newE2ETLS(opts, handler); err != nil {
+			return nil, err
+		}
+	}
+	s.client = tunnel.New(tunnel.Config{
+		RelayURL:    opts.Relay,
+		Network:     network,
+		Token:       opts.Token,
+		Subdomain:   opts.Subdomain,
+		MaxBodySize: int64(opts.MaxUploadSize),
+		Handler:     handler,
+		E2E:         opts.E2E,
+		OnConnected: func(subdomain, fullURL string) {
+			s.setURL(fullURL)
+			if s.e2e != nil {
+				s.e2e.setHost(fullURL)
+			}
+			if opts.PrintJSON {
+				printEvent(connectionEvent{
+					Event:     "connected",
+					Subdomain: subdomain,
+					URL:       fullURL,
+					Username:  creds.username,
+					Password:  creds.password,
+					ReadOnly:  creds.readOnly,
+				})
+			}
+			fmt.Fprintln(out)
+			fmt.Fprintf(out, "Connected! Your WebDAV is available at:\n")
+			fmt.Fprintf(out, "  %s\n", fullURL)
+			fmt.Fprintln(out)
+			if s.e2e != nil {
+				s.e2e.describe()
+			}
+			s.showQR(fullURL)
+		},
+		OnDisconnected: func(err error) {
+			s.setURL("")
+			if opts.PrintJSON {
+				printEvent(connectionEvent{Event: "disconnected", Error: err.Error()})
+			}
+			fmt.Fprintf(out, "\nDisconnected: %v\n", err)
+		},
+		OnReconnecting: func(attempt int) {
+			fmt.Fprintf(out, "Reconnecting (attempt %d)...\n", attempt)
+		},
+	})
+	return s, nil
+}
+
+// showQR prints a QR code for the URL, unless it was already shown before a
+// reconnect
+func (s *relayWebDAVService) showQR(fullURL string) {
+	if !s.opts.QR {
+		return
+	}
+	s.mu.Lock()
+	shown := s.shown == fullURL
+	s.shown = fullURL
+	s.mu.Unlock()
+	if shown {
+		return
+	}
+
+	text := fullURL
+	if s.opts.QRCredentials {
+		text = withCredentials(fullURL, s.creds.username, s.creds.password)
+		fmt.Fprintln(out, "Scan to connect (includes the password):")
+	} else {
+		fmt.Fprintln(out, "Scan to open on a phone:")
+	}
+	printQR(text)
+	fmt.Fprintln(out)
+}
+
+func (s *relayWebDAVService) setURL(fullURL string) {
+	s.mu.Lock()
+	s.fullURL = fullURL
+	s.mu.Unlock()
+}
+
+func (s *relayWebDAVService) urls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fullURL == "" {
+		return nil
+	}
+	return []string{s.fullURL}
+}
+
+func (s *relayWebDAVService) describe() {
+	fmt.Fprintln(out, "WebDAV (public URL):")
+	fmt.Fprintln(out, "  Connecting to relay server...")
+}
+
+func (s *relayWebDAVService) run(ctx context.Context) error {
+	if s.e2e != nil {
+		ln := tls.NewListener(s.client.Listener(), s.e2e.config)
+		go s.e2e.httpServer.Serve(ln)
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			s.e2e.httpServer.Shutdown(shutdownCtx)
+		}()
+	}
+
+	if err := s.client.Connect(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("connection error: %w", err)
+	}
+	return nil
+}
+
+// relayHTTPService shares a local web app on a public URL through the relay
+type relayHTTPService struct {
+	client *tunnel.Client
+	proxy  *webproxy.Proxy
+
+	mu      sync.Mutex
+	fullURL string
+	shown   bool
+}
+
+func newRelayHTTPService(proxy *webproxy.Proxy, qr bool, opts *RelayOptions) (*relayHTTPService, error) {
+	network, err := opts.network()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &relayHTTPService{proxy: proxy}
+	s.client = tunnel.New(tunnel.Config{
+		RelayURL:  opts.Relay,
+		Network:   network,
+		Token:     opts.Token,
+		Subdomain: opts.Subdomain,
+		Handler:   proxy,
+		OnConnected: func(subdomain, fullURL string) {
+			s.mu.Lock()
+			s.fullURL = fullURL
+			shown := s.shown
+			s.shown = true
+			s.mu.Unlock()
+			fmt.Fprintln(out)
+			fmt.Fprintf(out, "Connected! %s is available at:\n", proxy.Target())
+			fmt.Fprintf(out, "  %s\n", fullURL)
+			fmt.Fprintln(out)
+			if qr && !shown {
+				fmt.Fprintln(out, "Scan to open on a phone:")
+				printQR(fullURL)
+				fmt.Fprintln(out)
+			}
+		},
+		OnDisconnected: func(err error) {
+			s.mu.Lock()
+			s.fullURL = ""
+			s.mu.Unlock()
+			fmt.Fprintf(out, "\nDisconnected: %v\n", err)
+		},
+		OnReconnecting: func(attempt int) {
+			fmt.Fprintf(out, "Reconnecting (attempt %d)...\n", attempt)
+		},
+	})
+	return s, nil
+}
+
+func (s *relayHTTPService) describe() {
+	fmt.Fprintf(out, "HTTP (%s):\n", s.proxy.Target())
+	fmt.Fprintln(out, "  Connecting to relay server...")
+}
+
+func (s *relayHTTPService) urls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fullURL == "" {
+		return nil
+	}
+	return []string{s.fullURL}
+}
+
+func (s *relayHTTPService) run(ctx context.Context) error {
+	if err := s.client.Connect(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("connection error: %w", err)
+	}
+	return nil
+}
+
+// tcpService exposes a local TCP port through the relay
+type tcpService struct {
+	client *tunnel.Client
+	target string
+
+	mu      sync.Mutex
+	fullURL string
+}
+
+func newTCPService(target string, remotePort int, opts *RelayOptions) (*tcpService, error) {
+	network, err := opts.network()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &tcpService{target: target}
+	s.client = tunnel.New(tunnel.Config{
+		RelayURL:  opts.Relay,
+		Network:   network,
+		Token:     opts.Token,
+		Subdomain: opts.Subdomain,
+		TCP:       true,
+		Port:      remotePort,
+		OnConnected: func(subdomain, fullURL string) {
+			s.mu.Lock()
+			s.fullURL = fullURL
+			s.mu.Unlock()
+			fmt.Fprintln(out)
+			fmt.Fprintf(out, "Connected! Forwarding %s to %s\n", fullURL, target)
+			if strings.HasPrefix(fullURL, "tls://") {
+				fmt.Fprintln(out, "  Clients must connect with TLS, naming the host above (SNI)")
+			}
+			fmt.Fprintln(out)
+		},
+		OnDisconnected: func(err error) {
+			s.mu.Lock()
+			s.fullURL = ""
+			s.mu.Unlock()
+			fmt.Fprintf(out, "\nDisconnected: %v\n", err)
+		},
+		OnReconnecting: func(attempt int) {
+			fmt.Fprintf(out, "Reconnecting (attempt %d)...\n", attempt)
+		},
+	})
+	return s, nil
+}
+
+func (s *tcpService) describe() {
+	fmt.Fprintf(out, "TCP (%s):\n", s.target)
+	fmt.Fprintln(out, "  Connecting to relay server...")
+}
+
+func (s *tcpService) urls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fullURL == "" {
+		return nil
+	}
+	return []string{s.fullURL}
+}
+
+func (s *tcpService) run(ctx context.Context) error {
+	ln := s.client.Listener()
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.forward(conn)
+		}
+	}()
+
+	if err := s.client.Connect(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("connection error: %w", err)
+	}
+	return nil
+}
+
+// forward copies between a tunnel connection and the target until either
+// side closes
+func (s *tcpService) forward(conn net.Conn) {
+	defer conn.Close()
+	local, err := net.DialTimeout("tcp", s.target, 10*time.Second)
+	if err != nil {
+		fmt.Fprintf(out, "Connection from %s refused: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	defer local.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(local, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, local)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// e2eTLS serves the connections of an end-to-end encrypted tunnel, which the
+// relay forwards without decrypting
+type e2eTLS struct {
+	config     *tls.Config
+	httpServer *http.Server
+	// cert is the user-provided certificate, nil when the local CA issues
+	// one for the tunnel's host name
+	cert *x509.Certificate
+	ca   *certs.CA
+
+	mu sync.Mutex
+	// host is the name the relay assigned the tunnel, the only one the
+	// local CA issues a certificate for
+	host   string
+	issued map[string]*tls.Certificate
+}
+
+func newE2ETLS(opts *WebDAVOptions, handler http.Handler) (*e2eTLS, error) {
+	if (opts.TLSCert == "") != (opts.TLSKey == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+
+	t := &e2eTLS{
+		config: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+		httpServer: &http.Server{
+			Handler:     handler,
+			ReadTimeout: 30 * time.Second,
+		},
+	}
+	if opts.TLSCert != "" {
+		cert, err := certs.LoadKeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		t.config.Certificates = []tls.Certificate{cert}
+		t.cert = cert.Leaf
+		return t, nil
+	}
+
+	ca, err := certs.LoadOrCreateCA(certs.DefaultDir())
+	if err != nil {
+		return nil, err
+	}
+	t.ca = ca
+	t.issued = make(map[string]*tls.Certificate)
+	t.config.GetCertificate = t.certificate
+	return t, nil
+}
+
+// setHost records the public URL the relay assigned the tunnel
+func (t *e2eTLS) setHost(fullURL string) {
+	u, err := url.Parse(fullURL)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	t.host = strings.ToLower(u.Hostname())
+	t.mu.Unlock()
+}
+
+// certificate issues a certificate for the tunnel's host name. Other names
+// are refused, so nobody who can reach the listener gets the local CA to
+// sign for a name of their choosing.
+func (t *e2eTLS) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if name == "" || name != t.host {
+		return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+	}
+	if cert, ok := t.issued[name]; ok {
+		return cert, nil
+	}
+	cert, err := t.ca.Issue([]string{name})
+	if err != nil {
+		return nil, err
+	}
+	t.issued[name] = &cert
+	return &cert, nil
+}
+
+func (t *e2eTLS) describe() {
+	fmt.Fprintln(out, "End-to-end encrypted: the relay cannot read what is shared")
+	if t.ca == nil {
+		fmt.Fprintf(out, "  Certificate fingerprint (SHA-256):\n    %s\n", certs.Fingerprint(t.cert))
+	} else {
+		fmt.Fprintf(out, "  Self-signed: trust the local CA at %s to avoid warnings\n", t.ca.CertPath)
+		fmt.Fprintf(out, "  CA fingerprint (SHA-256):\n    %s\n", certs.Fingerprint(t.ca.Cert))
+	}
+	fmt.Fprintln(out)
+}
+
+// dlnaOptions holds the resolved DLNA settings
+type dlnaOptions struct {
+	port    int
+	name    string
+	views   bool
+	ifaces  []net.Interface
+	allowed []*net.IPNet
+	approve bool
+}
+
+// dlnaService streams media to smart TVs and renderers
+type dlnaService struct {
+	server *dms.Server
+	opts   dlnaOptions
+}
+
+func newDLNAService(cwd string, opts dlnaOptions) (*dlnaService, error) {
+	// Get hostname for friendly name
+	if opts.name == "" {
+		opts.name, _ = os.Hostname()
+		if opts.name == "" {
+			opts.name = "filegate"
+		}
+	}
+
+	// Create listener first to verify port is available
+	ln, err := dlna.Listen(opts.ifaces, opts.port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", opts.port, err)
+	}
+
+	// Drop connections from outside the allowed networks before dms sees them
+	access := dlna.NewAccessControl(dlna.AccessConfig{
+		Allowed: opts.allowed,
+		Approve: opts.approve,
+		In:      os.Stdin,
+		Out:     out,
+	})
+	ln = access.Listener(ln)
+
+	// Create a logger for the DLNA server
+	logger := alog.NewLogger("dms")
+	logger.SetHandlers(alog.DiscardHandler)
+
+	// Configure DLNA server
+	server := &dms.Server{
+		HTTPConn:       ln,
+		FriendlyName:   opts.name,
+		Interfaces:     opts.ifaces,
+		RootObjectPath: cwd,
+		NoTranscode:    true, // Don't transcode - serve files directly
+		NoProbe:        true, // Disable probing to avoid dms library bugs
+		NotifyInterval: 30 * time.Second,
+		IgnoreHidden:   true,
+		AllowedIpNets:  opts.allowed,
+		Logger:         logger,
+		Icons:          defaultIcons(),
+	}
+
+	// Layer virtual views over the folder tree
+	if opts.views {
+		dlna.NewLibrary(dlna.Config{Server: server})
+	}
+
+	// Initialize the server
+	if err := server.Init(); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to initialize DLNA server: %w", err)
+	}
+
+	return &dlnaService{server: server, opts: opts}, nil
+}
+
+func (s *dlnaService) describe() {
+	fmt.Fprintln(out, "DLNA:")
+	if ffprobe.Available() {
+		fmt.Fprintln(out, "  Media probing: \033[36mffprobe\033[0m")
+	} else {
+		fmt.Fprintln(out, "  Media probing: \033[33minternal (ffprobe not found)\033[0m")
+	}
+	if isCommandAvailable("ffmpegthumbnailer") {
+		fmt.Fprintln(out, "  Thumbnails: \033[36menabled\033[0m")
+	} else {
+		fmt.Fprintln(out, "  Thumbnails: \033[33mdisabled (ffmpegthumbnailer not found)\033[0m")
+	}
+	if s.opts.views {
+		fmt.Fprintln(out, "  Virtual views: \033[36menabled\033[0m (Recently Added, All Videos, Music, Photos, Playlists)")
+	}
+	fmt.Fprintf(out, "  Server name: %s\n", s.opts.name)
+	fmt.Fprintf(out, "  Allowed clients: %s\n", formatNetworks(s.opts.allowed))
+	if s.opts.approve {
+		fmt.Fprintln(out, "  New devices must be approved in this terminal")
+	}
+	fmt.Fprintln(out, "  Your smart TV should discover this server automatically.")
+	fmt.Fprintln(out, "  Look for it in your TV's media/DLNA sources.")
+
+	fmt.Fprintln(out, "  Access URLs:")
+	for _, u := range s.urls() {
+		fmt.Fprintf(out, "    %s\n", u)
+	}
+}
+
+func (s *dlnaService) urls() []string {
+	ips := getLocalIPs()
+	if len(s.opts.ifaces) > 0 {
+		ips = nil
+		for _, ip := range dlna.InterfaceIPs(s.opts.ifaces) {
+			ips = append(ips, ip.String())
+		}
+	}
+	var urls []string
+	for _, ip := range ips {
+		urls = append(urls, "http://"+net.JoinHostPort(ip, strconv.Itoa(s.opts.port)))
+	}
+	return urls
+}
+
+func (s *dlnaService) run(ctx context.Context) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.server.Run()
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			return fmt.Errorf("DLNA server error: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.server.Close()
+	<-errChan
+	return nil
+}
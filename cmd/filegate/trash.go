@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/filegate/filegate/internal/webdav"
+)
+
+// TrashCmd handles the trash subcommands
+type TrashCmd struct {
+	Ls      TrashLsCmd      `cmd:"" help:"List deleted files"`
+	Restore TrashRestoreCmd `cmd:"" help:"Restore a deleted file"`
+}
+
+// TrashLsCmd lists a share's trash
+type TrashLsCmd struct {
+	Path string `help:"Shared directory (defaults to the current directory)" type:"existingdir" short:"d"`
+}
+
+func (cmd *TrashLsCmd) Run() error {
+	items, err := webdav.OpenTrash(shareRoot(cmd.Path)).List()
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Println("Trash is empty")
+		return nil
+	}
+
+	for _, item := range items {
+		kind := formatBytes(item.Size)
+		if item.IsDir {
+			kind = "folder, " + kind
+		}
+		fmt.Printf("%s  %s (%s)\n", item.ID, item.Path, kind)
+		by := ""
+		if item.DeletedBy != "" {
+			by = " by " + item.DeletedBy
+		}
+		fmt.Printf("  deleted %s%s\n", item.DeletedAt.Local().Format(time.DateTime), by)
+	}
+	return nil
+}
+
+// TrashRestoreCmd restores an item from a share's trash
+type TrashRestoreCmd struct {
+	ID   string `arg:"" help:"Item to restore (see 'filegate trash ls')"`
+	To   string `help:"Restore to this path in the share instead of the original one"`
+	Path string `help:"Shared directory (defaults to the current directory)" type:"existingdir" short:"d"`
+}
+
+func (cmd *TrashRestoreCmd) Run() error {
+	dest, err := webdav.OpenTrash(shareRoot(cmd.Path)).Restore(cmd.ID, cmd.To)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s\n", dest)
+	return nil
+}
+
+// shareRoot returns the given directory, or the current one if empty
+func shareRoot(path string) string {
+	if path != "" {
+		return path
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	return cwd
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/filegate/filegate/internal/webdav"
+)
+
+// VersionsCmd handles the versions subcommands
+type VersionsCmd struct {
+	Ls      VersionsLsCmd      `cmd:"" help:"List the saved versions of a file"`
+	Restore VersionsRestoreCmd `cmd:"" help:"Replace a file with one of its versions"`
+}
+
+// VersionsLsCmd lists a file's versions
+type VersionsLsCmd struct {
+	File string `arg:"" help:"File, relative to the shared directory"`
+	Path string `help:"Shared directory (defaults to the current directory)" type:"existingdir" short:"d"`
+	JSON bool   `help:"Print as JSON" name:"json"`
+}
+
+func (cmd *VersionsLsCmd) Run() error {
+	versions, err := webdav.OpenVersions(shareRoot(cmd.Path)).List(filepath.ToSlash(cmd.File))
+	if err != nil {
+		return err
+	}
+	if cmd.JSON {
+		if versions == nil {
+			versions = []webdav.Version{}
+		}
+		return printJSON(versions)
+	}
+	if len(versions) == 0 {
+		fmt.Println("No versions")
+		return nil
+	}
+
+	for _, v := range versions {
+		fmt.Printf("%s  %s, modified %s\n", v.ID, formatBytes(v.Size), v.ModTime.Local().Format(time.DateTime))
+	}
+	return nil
+}
+
+// VersionsRestoreCmd restores a file's version
+type VersionsRestoreCmd struct {
+	File string `arg:"" help:"File, relative to the shared directory"`
+	ID   string `arg:"" help:"Version to restore (see 'filegate versions ls'); a unique prefix is enough"`
+	Path string `help:"Shared directory (defaults to the current directory)" type:"existingdir" short:"d"`
+}
+
+func (cmd *VersionsRestoreCmd) Run() error {
+	v, err := webdav.OpenVersions(shareRoot(cmd.Path)).Restore(filepath.ToSlash(cmd.File), cmd.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s to the version from %s\n", v.Path, v.ModTime.Local().Format(time.DateTime))
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filegate/filegate/internal/relay"
+)
+
+// defaultAdminURL is where `relay admin` looks for the admin API
+const defaultAdminURL = "http://127.0.0.1:8081"
+
+const adminUsage = `Usage: relay admin [-url URL] [-token TOKEN] <command>
+
+Commands:
+  ls                              List connected tunnels
+  kick <subdomain>                Disconnect a tunnel
+  bans                            List bans
+  ban ip|subdomain <value>        Ban an IP or subdomain, disconnecting its tunnels
+  unban ip|subdomain <value>      Lift a ban
+  reservations                    List reserved subdomains
+  reserve <subdomain> [token]     Reserve a subdomain, for clients with token if given
+  release <subdomain>             Release a reserved subdomain
+  drain [relay-url]               Stop accepting tunnels and move clients, to relay-url if given
+  resume                          Accept tunnels again
+
+Flags:
+`
+
+// runAdmin drives a relay's admin API, for `relay admin`
+func runAdmin(args []string) error {
+	flags := flag.NewFlagSet("relay admin", flag.ExitOnError)
+	// The environment provides defaults, so tokens stay out of shell history
+	baseURL := os.Getenv("RELAY_ADMIN_URL")
+	if baseURL == "" {
+		baseURL = defaultAdminURL
+	}
+	adminURL := flags.String("url", baseURL, "URL of the relay's admin API, served on its -admin-addr (env RELAY_ADMIN_URL)")
+	token := flags.String("token", os.Getenv("RELAY_ADMIN_TOKEN"), "The relay's -admin-token (env RELAY_ADMIN_TOKEN)")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), adminUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	admin := &adminClient{base: strings.TrimSuffix(*adminURL, "/"), token: *token}
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	command, args := args[0], args[1:]
+	want := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%s takes %d argument(s); see relay admin -h", command, n)
+		}
+		return nil
+	}
+
+	switch command {
+	case "ls":
+		var tunnels []relay.TunnelInfo
+		if err := admin.do("GET", "/tunnels", nil, &tunnels); err != nil {
+			return err
+		}
+		printTunnels(tunnels)
+		return nil
+	case "kick":
+		if err := want(1); err != nil {
+			return err
+		}
+		return admin.do("DELETE", "/tunnels/"+url.PathEscape(args[0]), nil, nil)
+	case "bans":
+		var bans relay.Bans
+		if err := admin.do("GET", "/bans", nil, &bans); err != nil {
+			return err
+		}
+		for _, ip := range bans.IPs {
+			fmt.Printf("ip\t%s\n", ip)
+		}
+		for _, subdomain := range bans.Subdomains {
+			fmt.Printf("subdomain\t%s\n", subdomain)
+		}
+		return nil
+	case "ban", "unban":
+		if err := want(2); err != nil {
+			return err
+		}
+		var path string
+		switch args[0] {
+		case "ip":
+			path = "/bans/ips/"
+		case "subdomain":
+			path = "/bans/subdomains/"
+		default:
+			return fmt.Errorf("can only %s an ip or a subdomain", command)
+		}
+		method := "PUT"
+		if command == "unban" {
+			method = "DELETE"
+		}
+		return admin.do(method, path+url.PathEscape(args[1]), nil, nil)
+	case "reservations":
+		var reservations []relay.Reservation
+		if err := admin.do("GET", "/reservations", nil, &reservations); err != nil {
+			return err
+		}
+		for _, reservation := range reservations {
+			holder := "nobody"
+			if reservation.HasToken {
+				holder = "token"
+			}
+			fmt.Printf("%s\t%s\n", reservation.Subdomain, holder)
+		}
+		return nil
+	case "reserve":
+		if len(args) != 1 && len(args) != 2 {
+			return errors.New("reserve takes a subdomain and an optional token")
+		}
+		var reservation relay.Reservation
+		if len(args) == 2 {
+			reservation.Token = args[1]
+		}
+		return admin.do("PUT", "/reservations/"+url.PathEscape(args[0]), reservation, nil)
+	case "release":
+		if err := want(1); err != nil {
+			return err
+		}
+		return admin.do("DELETE", "/reservations/"+url.PathEscape(args[0]), nil, nil)
+	case "drain":
+		if len(args) > 1 {
+			return errors.New("drain takes an optional tunnel URL of the relay to move clients to")
+		}
+		var drain struct {
+			Reconnect string `json:"reconnect,omitempty"`
+		}
+		if len(args) == 1 {
+			drain.Reconnect = args[0]
+		}
+		return admin.do("POST", "/drain", drain, nil)
+	case "resume":
+		return admin.do("DELETE", "/drain", nil, nil)
+	}
+	return fmt.Errorf("unknown command %q; see relay admin -h", command)
+}
+
+func printTunnels(tunnels []relay.TunnelInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBDOMAIN\tURL\tREMOTE IP\tVERSION\tUPTIME\tIN\tOUT")
+	for _, t := range tunnels {
+		uptime := (time.Duration(t.UptimeSeconds) * time.Second).String()
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.Subdomain, t.URL, t.RemoteIP, t.Version, uptime, formatBytes(t.BytesIn), formatBytes(t.BytesOut))
+	}
+	w.Flush()
+}
+
+// formatBytes formats a byte count for people
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// adminClient calls a relay's admin API
+type adminClient struct {
+	base  string
+	token string
+}
+
+// do sends body, if any, as JSON and decodes the reply into out, if given
+func (c *adminClient) do(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("malformed reply: %w", err)
+		}
+	}
+	return nil
+}
@@ -5,9 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,8 +17,27 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := runAdmin(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "relay admin:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	port := flag.Int("port", 8080, "Port to listen on")
 	domain := flag.String("domain", "filegate.app", "Base domain for subdomains")
+	tokens := flag.String("tokens", "", "Comma-separated tokens clients must register with (empty allows anyone)")
+	tcpPorts := flag.String("tcp-ports", "", "Port range to allocate to TCP tunnels, e.g. 20000-20099 (empty leaves them to SNI on -e2e-port)")
+	e2ePort := flag.Int("e2e-port", 0, "Port to accept TLS for end-to-end encrypted tunnels on, forwarded by SNI without decrypting (0 disables)")
+	registryURL := flag.String("registry", "", "redis:// URL of the registry shared with other relays serving the domain (empty for a single relay)")
+	nodeURL := flag.String("node-url", "", "URL other relays reach this one at, e.g. http://10.0.0.5:8080 (required with -registry)")
+	clusterSecret := flag.String("cluster-secret", "", "Secret shared by the relays using -registry, to sign the client addresses of requests they pass on to each other (env RELAY_CLUSTER_SECRET)")
+	standIn := flag.String("registry-standin", "", "Serve an in-memory stand-in for Redis on this address, to try -registry without Redis")
+	adminAddr := flag.String("admin-addr", "", "Address to serve the admin API on, e.g. 127.0.0.1:8081 (empty disables it; see relay admin -h)")
+	adminToken := flag.String("admin-token", "", "Bearer token the admin API requires")
+	drainTo := flag.String("drain-to", "", "Tunnel URL of another relay clients are told to move to on shutdown (empty to reconnect to the same URL)")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "How long shutdown waits for clients to finish their requests and move")
 	flag.Parse()
 
 	// Allow environment variable override (PORT for Railway, RELAY_PORT as fallback)
@@ -28,12 +49,113 @@ func main() {
 	if envDomain := os.Getenv("RELAY_DOMAIN"); envDomain != "" {
 		*domain = envDomain
 	}
+	if envTokens := os.Getenv("RELAY_TOKENS"); envTokens != "" {
+		*tokens = envTokens
+	}
+	if envPort := os.Getenv("RELAY_E2E_PORT"); envPort != "" {
+		fmt.Sscanf(envPort, "%d", e2ePort)
+	}
+	if envPorts := os.Getenv("RELAY_TCP_PORTS"); envPorts != "" {
+		*tcpPorts = envPorts
+	}
+	if envRegistry := os.Getenv("RELAY_REGISTRY"); envRegistry != "" {
+		*registryURL = envRegistry
+	}
+	if envNode := os.Getenv("RELAY_NODE_URL"); envNode != "" {
+		*nodeURL = envNode
+	}
+	if envSecret := os.Getenv("RELAY_CLUSTER_SECRET"); envSecret != "" {
+		*clusterSecret = envSecret
+	}
+	if envAddr := os.Getenv("RELAY_ADMIN_ADDR"); envAddr != "" {
+		*adminAddr = envAddr
+	}
+	if envToken := os.Getenv("RELAY_ADMIN_TOKEN"); envToken != "" {
+		*adminToken = envToken
+	}
+	if envDrain := os.Getenv("RELAY_DRAIN_TO"); envDrain != "" {
+		*drainTo = envDrain
+	}
+	if *adminAddr != "" && *adminToken == "" {
+		log.Fatal("-admin-addr needs -admin-token to authenticate operators")
+	}
+
+	if *standIn != "" {
+		ln, err := net.Listen("tcp", *standIn)
+		if err != nil {
+			log.Fatalf("Failed to listen for the registry stand-in: %v", err)
+		}
+		log.Printf("Registry stand-in: redis://%s", ln.Addr())
+		go relay.ServeRedisStandIn(ln)
+	}
+
+	var registry relay.Registry
+	if *registryURL != "" {
+		if *nodeURL == "" {
+			log.Fatal("-registry needs -node-url so other relays can reach this one")
+		}
+		if *clusterSecret == "" {
+			log.Fatal("-registry needs -cluster-secret so relays can trust the requests they pass on to each other")
+		}
+		redis, err := relay.NewRedisRegistry(*registryURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		registry = redis
+	}
+
+	var tcpMin, tcpMax int
+	if *tcpPorts != "" {
+		if _, err := fmt.Sscanf(*tcpPorts, "%d-%d", &tcpMin, &tcpMax); err != nil || tcpMin <= 0 || tcpMax < tcpMin {
+			log.Fatalf("Invalid TCP port range %q", *tcpPorts)
+		}
+	}
+
+	var tokenList []string
+	for _, token := range strings.Split(*tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokenList = append(tokenList, token)
+		}
+	}
 
 	server := relay.NewServer(relay.Config{
-		Domain: *domain,
-		Port:   *port,
+		Domain:  *domain,
+		Port:    *port,
+		Tokens:  tokenList,
+		E2EPort: *e2ePort,
+
+		TCPPortMin: tcpMin,
+		TCPPortMax: tcpMax,
+
+		Registry:      registry,
+		NodeURL:       *nodeURL,
+		ClusterSecret: *clusterSecret,
 	})
 
+	var passthrough net.Listener
+	if *e2ePort > 0 {
+		var err error
+		passthrough, err = net.Listen("tcp", fmt.Sprintf(":%d", *e2ePort))
+		if err != nil {
+			log.Fatalf("Failed to listen for end-to-end encrypted tunnels: %v", err)
+		}
+		go server.ServePassthrough(passthrough)
+	}
+
+	var adminServer *http.Server
+	if *adminAddr != "" {
+		ln, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen for the admin API: %v", err)
+		}
+		adminServer = &http.Server{
+			Handler:      server.AdminHandler(*adminToken),
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		go adminServer.Serve(ln)
+	}
+
 	httpServer := &http.Server{
 		Addr:         fmt.Sprintf(":%d", *port),
 		Handler:      server,
@@ -41,25 +163,66 @@ func main() {
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
+	// Accept HTTP/2 without TLS for the HTTP/2 tunnel transport, as TLS is
+	// usually terminated in front of the relay
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	httpServer.Protocols = &protocols
 
 	// Graceful shutdown
+	shutDown := make(chan struct{})
 	go func() {
+		defer close(shutDown)
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
 
+		// Hijacked tunnel connections outlive httpServer.Shutdown, so clients
+		// are asked to move first
+		log.Println("Draining...")
+		drainCtx, cancelDrain := context.WithTimeout(context.Background(), *drainTimeout)
+		if err := server.Shutdown(drainCtx, *drainTo); err != nil {
+			log.Printf("Clients still connected after %s were disconnected", *drainTimeout)
+		}
+		cancelDrain()
+
 		log.Println("Shutting down...")
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
+		if passthrough != nil {
+			passthrough.Close()
+		}
+		if adminServer != nil {
+			adminServer.Close()
+		}
 		httpServer.Shutdown(ctx)
 	}()
 
 	log.Printf("Relay server starting on :%d", *port)
 	log.Printf("Domain: %s", *domain)
-	log.Printf("Tunnel endpoint: ws://localhost:%d/tunnel", *port)
+	if len(tokenList) > 0 {
+		log.Printf("Token authentication: %d token(s)", len(tokenList))
+	}
+	log.Printf("Tunnel endpoint: ws://localhost:%d/tunnel (or http:// for HTTP/2)", *port)
+	if *e2ePort > 0 {
+		log.Printf("End-to-end encrypted tunnels: TLS passthrough on :%d", *e2ePort)
+	}
+	if tcpMin > 0 {
+		log.Printf("TCP tunnels: ports %d-%d", tcpMin, tcpMax)
+	}
+	if registry != nil {
+		log.Printf("Shared registry: reachable by other relays at %s", *nodeURL)
+	}
+	if adminServer != nil {
+		log.Printf("Admin API: http://%s", *adminAddr)
+	}
 	log.Printf("Health check: http://localhost:%d/health", *port)
 
 	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	// Let in-flight requests finish
+	<-shutDown
 }
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to setting names to form environment variable overrides
+// (e.g. FILEGATE_READ_ONLY for read-only)
+const EnvPrefix = "FILEGATE_"
+
+// File is a parsed config file. Settings are keyed by CLI flag name, so any
+// flag can be given a default or set per profile.
+//
+//	defaults:
+//	  relay: wss://relay.example.com/tunnel
+//	profiles:
+//	  client-deliveries:
+//	    command: serve
+//	    path: ~/Deliveries
+//	    read-only: true
+//	    public: true
+type File struct {
+	// Path is where the file was loaded from ("" if it didn't exist)
+	Path string `yaml:"-"`
+	// Defaults apply to every invocation
+	Defaults map[string]any `yaml:"defaults"`
+	// Profiles are named groups of settings layered over the defaults
+	Profiles map[string]map[string]any `yaml:"profiles"`
+}
+
+// DefaultPath returns the config file location in the user's config directory
+// ($XDG_CONFIG_HOME/filegate/config.yaml on Linux)
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "filegate", "config.yaml")
+}
+
+// Load reads a config file. A missing file at the default location is not an
+// error and yields an empty config; a missing explicit path is.
+func Load(path string) (*File, error) {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultPath()
+		if path == "" {
+			return &File{}, nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			return &File{}, nil
+		}
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var f File
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	f.Path = path
+	return &f, nil
+}
+
+// Settings returns the defaults merged with the named profile ("" for none)
+func (f *File) Settings(profile string) (map[string]any, error) {
+	settings := make(map[string]any)
+	for k, v := range f.Defaults {
+		settings[k] = v
+	}
+
+	if profile == "" {
+		return settings, nil
+	}
+	p, ok := f.Profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q (available: %v)", profile, f.ProfileNames())
+	}
+	for k, v := range p {
+		settings[k] = v
+	}
+	return settings, nil
+}
+
+// ProfileNames returns the profile names in sorted order
+func (f *File) ProfileNames() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
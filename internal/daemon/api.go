@@ -0,0 +1,187 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Control API (JSON over HTTP on the Unix socket):
+//
+//	GET    /status       daemon status and shares
+//	GET    /shares       list shares
+//	POST   /shares       add a share (body: Spec)
+//	DELETE /shares/{id}  stop and forget a share
+
+// errorResponse is the body of failed API calls
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler returns the control API handler
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.Status())
+	})
+	mux.HandleFunc("GET /shares", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.Shares())
+	})
+	mux.HandleFunc("POST /shares", func(w http.ResponseWriter, r *http.Request) {
+		var spec Spec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request: " + err.Error()})
+			return
+		}
+		status, err := d.Add(spec)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, status)
+	})
+	mux.HandleFunc("DELETE /shares/{id}", func(w http.ResponseWriter, r *http.Request) {
+		err := d.Stop(r.PathValue("id"))
+		switch {
+		case errors.Is(err, ErrNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Listen creates the control socket. A stale socket left by a crashed daemon
+// is removed; a live one means another daemon is already running.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("daemon already running (socket %s)", path)
+		}
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	// Only the owner may control the daemon
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to secure socket: %w", err)
+	}
+	return ln, nil
+}
+
+// Client talks to a running daemon over its control socket
+type Client struct {
+	socket string
+	http   *http.Client
+}
+
+// NewClient creates a client for the daemon listening on socket
+func NewClient(socket string) *Client {
+	return &Client{
+		socket: socket,
+		http: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Status returns the daemon status
+func (c *Client) Status() (*Status, error) {
+	var status Status
+	if err := c.do(http.MethodGet, "/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// List returns every share
+func (c *Client) List() ([]ShareStatus, error) {
+	var shares []ShareStatus
+	if err := c.do(http.MethodGet, "/shares", nil, &shares); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// Add starts a new share
+func (c *Client) Add(spec Spec) (*ShareStatus, error) {
+	var status ShareStatus
+	if err := c.do(http.MethodPost, "/shares", spec, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Stop stops and forgets a share
+func (c *Client) Stop(id string) error {
+	return c.do(http.MethodDelete, "/shares/"+id, nil, nil)
+}
+
+func (c *Client) do(method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://filegate"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("daemon not reachable at %s (start it with 'filegate daemon'): %w", c.socket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e errorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("daemon returned %s", resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StateRunning means the share's services are up
+	StateRunning = "running"
+	// StateFailed means the share could not start or stopped with an error
+	StateFailed = "failed"
+)
+
+// ErrNotFound is returned when a share ID doesn't exist
+var ErrNotFound = errors.New("share not found")
+
+// Spec describes a share hosted by the daemon. It is what gets persisted, so
+// everything needed to bring the share back after a restart lives here.
+type Spec struct {
+	// ID is a short name used to refer to the share (e.g. "photos")
+	ID string `json:"id"`
+	// Path is the absolute directory being shared
+	Path string `json:"path"`
+
+	Local    bool `json:"local,omitempty"`
+	Public   bool `json:"public,omitempty"`
+	DLNA     bool `json:"dlna,omitempty"`
+	Port     int  `json:"port,omitempty"`
+	DLNAPort int  `json:"dlna_port,omitempty"`
+
+	User      string            `json:"user,omitempty"`
+	Password  string            `json:"password,omitempty"`
+	Users     map[string]string `json:"users,omitempty"`
+	ReadOnly  bool              `json:"read_only,omitempty"`
+	MaxUpload int64             `json:"max_upload,omitempty"`
+	Quota     int64             `json:"quota,omitempty"`
+	MinFree   int64             `json:"min_free,omitempty"`
+	Trash     bool              `json:"trash,omitempty"`
+	TrashDays int               `json:"trash_days,omitempty"`
+
+	ShowHidden  bool     `json:"show_hidden,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+	NoGitignore bool     `json:"no_gitignore,omitempty"`
+	Symlinks    string   `json:"symlinks,omitempty"`
+
+	Versions     bool `json:"versions,omitempty"`
+	VersionsKeep int  `json:"versions_keep,omitempty"`
+	VersionsDays int  `json:"versions_days,omitempty"`
+
+	TLS       bool   `json:"tls,omitempty"`
+	TLSCert   string `json:"tls_cert,omitempty"`
+	TLSKey    string `json:"tls_key,omitempty"`
+	MDNS      bool   `json:"mdns,omitempty"`
+	MDNSName  string `json:"mdns_name,omitempty"`
+	Relay     string `json:"relay,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Subdomain string `json:"subdomain,omitempty"`
+	E2E       bool   `json:"e2e,omitempty"`
+
+	Proxy     string   `json:"proxy,omitempty"`
+	RelayCA   string   `json:"relay_ca,omitempty"`
+	RelayCert string   `json:"relay_cert,omitempty"`
+	RelayKey  string   `json:"relay_key,omitempty"`
+	RelayPin  []string `json:"relay_pin,omitempty"`
+
+	Name      string   `json:"name,omitempty"`
+	Views     bool     `json:"views,omitempty"`
+	Allow     []string `json:"allow,omitempty"`
+	Interface []string `json:"interface,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Protocols returns a short description of the enabled protocols
+func (s *Spec) Protocols() []string {
+	var protocols []string
+	if s.Local {
+		protocols = append(protocols, "webdav-local")
+	}
+	if s.Public {
+		protocols = append(protocols, "webdav-public")
+	}
+	if s.DLNA {
+		protocols = append(protocols, "dlna")
+	}
+	return protocols
+}
+
+// Instance is a running share
+type Instance interface {
+	// URLs returns the addresses the share is currently reachable at
+	URLs() []string
+	// Done is closed once the share has stopped
+	Done() <-chan struct{}
+	// Err returns why the share stopped, or nil if it was cancelled
+	Err() error
+}
+
+// StartFunc starts the services for a share. It returns once they are
+// listening; they keep running until ctx is cancelled.
+type StartFunc func(ctx context.Context, spec Spec) (Instance, error)
+
+// ShareStatus is a share's spec plus its runtime state
+type ShareStatus struct {
+	Spec
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	URLs      []string  `json:"urls,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+}
+
+// Status describes the daemon itself
+type Status struct {
+	PID       int           `json:"pid"`
+	Version   string        `json:"version"`
+	Socket    string        `json:"socket"`
+	StartedAt time.Time     `json:"started_at"`
+	Shares    []ShareStatus `json:"shares"`
+}
+
+// share is the daemon's bookkeeping for one hosted share
+type share struct {
+	spec      Spec
+	instance  Instance
+	cancel    context.CancelFunc
+	startedAt time.Time
+	err       error
+}
+
+// Daemon hosts shares and persists them across restarts
+type Daemon struct {
+	start     StartFunc
+	statePath string
+	socket    string
+	version   string
+	startedAt time.Time
+
+	mu     sync.Mutex
+	shares map[string]*share
+}
+
+// Config holds configuration for the daemon
+type Config struct {
+	// Start brings up a share's services
+	Start StartFunc
+	// StatePath is where share specs are persisted (defaults to DefaultStatePath)
+	StatePath string
+	// Socket is the control socket path, reported in Status
+	Socket string
+	// Version is reported in Status
+	Version string
+}
+
+// New creates a new daemon
+func New(cfg Config) *Daemon {
+	statePath := cfg.StatePath
+	if statePath == "" {
+		statePath = DefaultStatePath()
+	}
+	return &Daemon{
+		start:     cfg.Start,
+		statePath: statePath,
+		socket:    cfg.Socket,
+		version:   cfg.Version,
+		startedAt: time.Now(),
+		shares:    make(map[string]*share),
+	}
+}
+
+// Restore starts every share saved in the state file. Shares that fail to
+// start are kept, marked as failed, so they show up in listings.
+func (d *Daemon) Restore() error {
+	data, err := os.ReadFile(d.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state: %w", err)
+	}
+
+	var specs []Spec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return fmt.Errorf("failed to parse state %s: %w", d.statePath, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, spec := range specs {
+		sh := &share{spec: spec}
+		if err := d.startLocked(sh); err != nil {
+			sh.err = err
+		}
+		d.shares[spec.ID] = sh
+	}
+	return nil
+}
+
+// Add starts a new share and persists it. An empty ID is derived from the
+// directory name.
+func (d *Daemon) Add(spec Spec) (ShareStatus, error) {
+	if spec.Path == "" {
+		return ShareStatus{}, fmt.Errorf("path is required")
+	}
+	if fi, err := os.Stat(spec.Path); err != nil || !fi.IsDir() {
+		return ShareStatus{}, fmt.Errorf("not a directory: %s", spec.Path)
+	}
+	if !spec.Local && !spec.Public && !spec.DLNA {
+		return ShareStatus{}, fmt.Errorf("nothing to serve: enable local, public and/or dlna")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if spec.ID == "" {
+		spec.ID = d.uniqueIDLocked(filepath.Base(spec.Path))
+	} else if !validID.MatchString(spec.ID) {
+		return ShareStatus{}, fmt.Errorf("invalid share ID %q: use letters, digits, '-' and '_'", spec.ID)
+	} else if _, exists := d.shares[spec.ID]; exists {
+		return ShareStatus{}, fmt.Errorf("share %q already exists", spec.ID)
+	}
+	spec.CreatedAt = time.Now()
+
+	sh := &share{spec: spec}
+	if err := d.startLocked(sh); err != nil {
+		return ShareStatus{}, err
+	}
+	d.shares[spec.ID] = sh
+
+	if err := d.saveLocked(); err != nil {
+		// Don't keep serving a share that wouldn't come back after a restart
+		delete(d.shares, spec.ID)
+		stopShare(sh)
+		return ShareStatus{}, err
+	}
+	return d.statusLocked(sh), nil
+}
+
+// Stop stops a share and removes it from the persisted state
+func (d *Daemon) Stop(id string) error {
+	d.mu.Lock()
+	sh, ok := d.shares[id]
+	if !ok {
+		d.mu.Unlock()
+		return ErrNotFound
+	}
+	delete(d.shares, id)
+	err := d.saveLocked()
+	d.mu.Unlock()
+
+	// Stopping waits for the share's services to finish, which mustn't hold
+	// up other calls
+	stopShare(sh)
+	return err
+}
+
+// Shares returns the status of every share, sorted by ID
+func (d *Daemon) Shares() []ShareStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	statuses := make([]ShareStatus, 0, len(d.shares))
+	for _, sh := range d.shares {
+		statuses = append(statuses, d.statusLocked(sh))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// Status describes the daemon and its shares
+func (d *Daemon) Status() Status {
+	return Status{
+		PID:       os.Getpid(),
+		Version:   d.version,
+		Socket:    d.socket,
+		StartedAt: d.startedAt,
+		Shares:    d.Shares(),
+	}
+}
+
+// Shutdown stops every share without removing it from the persisted state
+func (d *Daemon) Shutdown() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, sh := range d.shares {
+		stopShare(sh)
+	}
+}
+
+func (d *Daemon) startLocked(sh *share) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	instance, err := d.start(ctx, sh.spec)
+	if err != nil {
+		cancel()
+		return err
+	}
+	sh.instance = instance
+	sh.cancel = cancel
+	sh.startedAt = time.Now()
+	sh.err = nil
+	return nil
+}
+
+func stopShare(sh *share) {
+	if sh.cancel == nil {
+		return
+	}
+	sh.cancel()
+	<-sh.instance.Done()
+	sh.cancel = nil
+}
+
+func (d *Daemon) statusLocked(sh *share) ShareStatus {
+	status := ShareStatus{
+		Spec:      sh.spec,
+		State:     StateRunning,
+		StartedAt: sh.startedAt,
+	}
+
+	err := sh.err
+	if sh.instance != nil {
+		select {
+		case <-sh.instance.Done():
+			err = sh.instance.Err()
+			if err == nil {
+				err = errors.New("stopped")
+			}
+		default:
+			status.URLs = sh.instance.URLs()
+		}
+	}
+	if err != nil {
+		status.State = StateFailed
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// saveLocked writes every spec to the state file. It may contain passwords,
+// so it is only readable by the owner.
+func (d *Daemon) saveLocked() error {
+	specs := make([]Spec, 0, len(d.shares))
+	for _, sh := range d.shares {
+		specs = append(specs, sh.spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].ID < specs[j].ID })
+
+	data, err := json.MarshalIndent(specs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.statePath), 0700); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	tmp := d.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	if err := os.Rename(tmp, d.statePath); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return nil
+}
+
+var (
+	validID   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	invalidID = regexp.MustCompile(`[^a-z0-9_-]+`)
+)
+
+// uniqueIDLocked turns a directory name into an unused share ID
+func (d *Daemon) uniqueIDLocked(name string) string {
+	base := strings.Trim(invalidID.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if base == "" {
+		base = "share"
+	}
+	id := base
+	for i := 2; ; i++ {
+		if _, exists := d.shares[id]; !exists {
+			return id
+		}
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+}
@@ -0,0 +1,34 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// stateDir returns the directory holding the daemon's state and log files
+func stateDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "filegate", "daemon")
+}
+
+// DefaultStatePath returns where share specs are persisted
+func DefaultStatePath() string {
+	return filepath.Join(stateDir(), "shares.json")
+}
+
+// DefaultLogPath returns where a detached daemon writes its output
+func DefaultLogPath() string {
+	return filepath.Join(stateDir(), "daemon.log")
+}
+
+// DefaultSocketPath returns the control socket location, preferring
+// $XDG_RUNTIME_DIR when set
+func DefaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "filegate.sock")
+	}
+	return filepath.Join(stateDir(), "filegate.sock")
+}
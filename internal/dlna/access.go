@@ -0,0 +1,206 @@
+package dlna
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// AccessControl filters incoming connections by client IP. Clients outside
+// the allowed networks are dropped; with Approve set, each new client IP must
+// also be accepted interactively the first time it connects.
+type AccessControl struct {
+	allowed []*net.IPNet
+	approve bool
+
+	in  *bufio.Reader
+	out io.Writer
+
+	// promptMu serialises terminal prompts
+	promptMu  sync.Mutex
+	mu        sync.Mutex
+	decisions map[string]bool
+}
+
+// AccessConfig holds configuration for access control
+type AccessConfig struct {
+	// Allowed lists the networks clients may connect from. Empty allows everyone.
+	Allowed []*net.IPNet
+	// Approve asks on the terminal before serving a client IP for the first time
+	Approve bool
+	// In and Out are the terminal used for approval prompts
+	In  io.Reader
+	Out io.Writer
+}
+
+// NewAccessControl creates a new access control filter
+func NewAccessControl(cfg AccessConfig) *AccessControl {
+	a := &AccessControl{
+		allowed:   cfg.Allowed,
+		approve:   cfg.Approve,
+		out:       cfg.Out,
+		decisions: make(map[string]bool),
+	}
+	if cfg.In != nil {
+		a.in = bufio.NewReader(cfg.In)
+	}
+	return a
+}
+
+// Listener wraps ln so that Accept only returns connections from permitted clients
+func (a *AccessControl) Listener(ln net.Listener) net.Listener {
+	al := &accessListener{
+		Listener: ln,
+		access:   a,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go al.acceptLoop()
+	return al
+}
+
+// Allowed reports whether ip falls inside the allowed networks
+func (a *AccessControl) Allowed(ip net.IP) bool {
+	if len(a.allowed) == 0 {
+		return true
+	}
+	for _, n := range a.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permit decides whether a connection from ip may be served, prompting if needed
+func (a *AccessControl) permit(ip net.IP) bool {
+	if !a.Allowed(ip) {
+		return false
+	}
+	if !a.approve || ip.IsLoopback() || a.in == nil {
+		return true
+	}
+
+	key := ip.String()
+	a.mu.Lock()
+	decision, decided := a.decisions[key]
+	a.mu.Unlock()
+	if decided {
+		return decision
+	}
+
+	// Only one prompt at a time; a device usually opens several connections
+	// at once, so re-check after waiting in case it was decided meanwhile
+	a.promptMu.Lock()
+	defer a.promptMu.Unlock()
+
+	a.mu.Lock()
+	decision, decided = a.decisions[key]
+	a.mu.Unlock()
+	if decided {
+		return decision
+	}
+
+	name := key
+	if names, err := net.LookupAddr(key); err == nil && len(names) > 0 {
+		name = fmt.Sprintf("%s (%s)", strings.TrimSuffix(names[0], "."), key)
+	}
+	fmt.Fprintf(a.out, "\nNew device connecting: %s\nAllow it to browse and stream? [y/N] ", name)
+
+	line, err := a.in.ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	decision = err == nil && (answer == "y" || answer == "yes")
+	if decision {
+		fmt.Fprintf(a.out, "Allowed %s\n", key)
+	} else {
+		fmt.Fprintf(a.out, "Denied %s\n", key)
+	}
+
+	a.mu.Lock()
+	a.decisions[key] = decision
+	a.mu.Unlock()
+	return decision
+}
+
+// accessListener checks each connection in its own goroutine so a pending
+// approval prompt doesn't hold up clients that are already approved
+type accessListener struct {
+	net.Listener
+	access *AccessControl
+
+	conns chan net.Conn
+	err   error
+	done  chan struct{}
+}
+
+func (l *accessListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.check(conn)
+	}
+}
+
+func (l *accessListener) check(conn net.Conn) {
+	var ip net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	if ip == nil || !l.access.permit(ip) {
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next permitted connection
+func (l *accessListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// ParseNetworks parses a list of CIDR ranges or bare IP addresses
+func ParseNetworks(specs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR range: %q", spec)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR range: %q", spec)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,183 @@
+package dlna
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ResolveInterfaces looks up network interfaces by name. An empty list returns
+// nil, which tells dms.Server to use every interface that is up.
+func ResolveInterfaces(names []string) ([]net.Interface, error) {
+	var ifaces []net.Interface
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown network interface %q", name)
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			return nil, fmt.Errorf("network interface %q is down", name)
+		}
+		ifaces = append(ifaces, *iface)
+	}
+	return ifaces, nil
+}
+
+// InterfaceNets returns the subnets attached to the given interfaces, or to
+// every up interface if ifaces is empty. Loopback is always included.
+// IPv6 link-local subnets are left out: the same fe80::/64 exists on every
+// link, so allowing it would let in clients on interfaces that weren't
+// selected.
+func InterfaceNets(ifaces []net.Interface) []*net.IPNet {
+	if len(ifaces) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil
+		}
+		for _, iface := range all {
+			if iface.Flags&net.FlagUp != 0 {
+				ifaces = append(ifaces, iface)
+			}
+		}
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, loopback6, _ := net.ParseCIDR("::1/128")
+	nets := []*net.IPNet{loopback, loopback6}
+	for _, iface := range ifaces {
+		for _, ipnet := range interfaceNets(iface) {
+			if !ipnet.IP.IsLoopback() {
+				nets = append(nets, &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask})
+			}
+		}
+	}
+	return nets
+}
+
+// InterfaceIPs returns the addresses assigned to the given interfaces,
+// leaving out IPv6 link-local ones, which need a zone to be used
+func InterfaceIPs(ifaces []net.Interface) []net.IP {
+	var ips []net.IP
+	for _, iface := range ifaces {
+		for _, ipnet := range interfaceNets(iface) {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
+
+// interfaceNets returns the IPv4 and IPv6 networks of an interface, without
+// link-local IPv6 ones
+func interfaceNets(iface net.Interface) []*net.IPNet {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+// Listen opens a TCP listener on port. With no interfaces it listens on all
+// addresses; otherwise it binds only the addresses of those interfaces.
+func Listen(ifaces []net.Interface, port int) (net.Listener, error) {
+	if len(ifaces) == 0 {
+		return net.Listen("tcp", fmt.Sprintf(":%d", port))
+	}
+
+	ips := InterfaceIPs(ifaces)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IP addresses on the selected interfaces")
+	}
+
+	var listeners []net.Listener
+	for _, ip := range ips {
+		ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		// Keep every address on the same port, even if the first picked one
+		if port == 0 {
+			port = ln.Addr().(*net.TCPAddr).Port
+		}
+		listeners = append(listeners, ln)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+// multiListener merges several listeners into one. Addr reports the first
+// listener's address, which dms uses only for its port.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	// done is closed by Close, releasing accept goroutines waiting to hand
+	// over a connection
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+		done:      make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					m.errs <- err
+					return
+				}
+				select {
+				case m.conns <- conn:
+				case <-m.done:
+					conn.Close()
+					return
+				}
+			}
+		}(ln)
+	}
+	return m
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	var firstErr error
+	for _, ln := range m.listeners {
+		if err := ln.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,434 @@
+package dlna
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dmsdlna "github.com/anacrolix/dms/dlna"
+	"github.com/anacrolix/dms/dlna/dms"
+	"github.com/anacrolix/dms/upnpav"
+	"github.com/filegate/filegate/internal/probe"
+)
+
+const (
+	// DefaultRecentLimit is the number of items shown in the Recently Added view
+	DefaultRecentLimit = 50
+	// DefaultRescanInterval is the minimum time between library scans
+	DefaultRescanInterval = 30 * time.Second
+
+	// These match the HTTP paths served by dms.Server
+	resPath      = "/res"
+	iconPath     = "/icon"
+	subtitlePath = "/subtitle"
+)
+
+// Library answers ContentDirectory browse requests for a dms.Server, layering
+// virtual views over the plain folder tree
+type Library struct {
+	server         *dms.Server
+	root           string
+	recentLimit    int
+	rescanInterval time.Duration
+
+	mu        sync.Mutex
+	entries   []*entry
+	playlists []string
+	cache     map[string]*entry
+	scannedAt time.Time
+}
+
+// Config holds configuration for the library
+type Config struct {
+	// Server is the DLNA server whose browse requests are answered
+	Server *dms.Server
+	// RecentLimit caps the Recently Added view (defaults to DefaultRecentLimit)
+	RecentLimit int
+	// RescanInterval is the minimum time between scans (defaults to DefaultRescanInterval)
+	RescanInterval time.Duration
+}
+
+// entry is an indexed media file
+type entry struct {
+	// path is the slash-separated path relative to the root, e.g. "/Music/song.mp3"
+	path     string
+	mimeType string
+	kind     string // "video", "audio" or "image"
+	size     int64
+	modTime  time.Time
+
+	// tags is only set for audio files with readable tags
+	tags *probe.Tags
+	// taken is the EXIF capture time for images, or the modification time
+	taken time.Time
+}
+
+// NewLibrary creates a library and installs its browse handlers on the server
+func NewLibrary(cfg Config) *Library {
+	l := &Library{
+		server:         cfg.Server,
+		root:           cfg.Server.RootObjectPath,
+		recentLimit:    cfg.RecentLimit,
+		rescanInterval: cfg.RescanInterval,
+		cache:          make(map[string]*entry),
+	}
+	if l.recentLimit <= 0 {
+		l.recentLimit = DefaultRecentLimit
+	}
+	if l.rescanInterval <= 0 {
+		l.rescanInterval = DefaultRescanInterval
+	}
+
+	cfg.Server.OnBrowseDirectChildren = l.browseDirectChildren
+	cfg.Server.OnBrowseMetadata = l.browseMetadata
+	return l
+}
+
+func (l *Library) browseDirectChildren(p, rootObjectPath, host, userAgent string) ([]interface{}, error) {
+	if p == viewsRoot || strings.HasPrefix(p, viewsRoot+"/") {
+		return l.browseView(viewSegments(p), host)
+	}
+
+	filePath := l.filePath(p)
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if ignored, err := l.ignored(filePath); err != nil || ignored {
+		return nil, fmt.Errorf("no such object: %s", p)
+	}
+
+	if !fi.IsDir() {
+		if isPlaylist(p) {
+			return l.playlistChildren(p, host)
+		}
+		return nil, fmt.Errorf("not a container: %s", p)
+	}
+
+	var objs []interface{}
+	if p == "/" {
+		objs = append(objs, l.viewContainers()...)
+	}
+	children, err := l.folderChildren(p, host)
+	if err != nil {
+		return nil, err
+	}
+	return append(objs, children...), nil
+}
+
+func (l *Library) browseMetadata(p, rootObjectPath, host, userAgent string) (interface{}, error) {
+	if p == viewsRoot || strings.HasPrefix(p, viewsRoot+"/") {
+		return l.viewMetadata(p, host)
+	}
+
+	filePath := l.filePath(p)
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if p == "/" {
+		children, _ := l.browseDirectChildren(p, rootObjectPath, host, userAgent)
+		obj := upnpav.Object{
+			ID:         "0",
+			ParentID:   "-1",
+			Restricted: 1,
+			Title:      l.server.FriendlyName,
+			Class:      "object.container.storageFolder",
+		}
+		return upnpav.Container{Object: obj, ChildCount: len(children)}, nil
+	}
+
+	parent := objectID(path.Dir(p))
+	if fi.IsDir() {
+		return container(p, parent, fi.Name(), "object.container.storageFolder", l.folderChildCount(p)), nil
+	}
+	if isPlaylist(p) {
+		entries, _ := l.readPlaylist(p)
+		return container(p, parent, playlistTitle(p), "object.container.playlistContainer", len(entries)), nil
+	}
+
+	e, err := l.fileEntry(p, fi)
+	if err != nil {
+		return nil, err
+	}
+	return l.item(e, parent, fi.Name(), host), nil
+}
+
+// folderChildren lists a real directory: subfolders first, then playlists and media files
+func (l *Library) folderChildren(p, host string) ([]interface{}, error) {
+	dirEntries, err := os.ReadDir(l.filePath(p))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(dirEntries, func(i, j int) bool {
+		if dirEntries[i].IsDir() != dirEntries[j].IsDir() {
+			return dirEntries[i].IsDir()
+		}
+		return strings.ToLower(dirEntries[i].Name()) < strings.ToLower(dirEntries[j].Name())
+	})
+
+	parent := objectID(p)
+	var objs []interface{}
+	for _, de := range dirEntries {
+		child := path.Join(p, de.Name())
+		if ignored, err := l.ignored(l.filePath(child)); err != nil || ignored {
+			continue
+		}
+		fi, err := os.Stat(l.filePath(child))
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case fi.IsDir():
+			if count := l.folderChildCount(child); count > 0 {
+				objs = append(objs, container(child, parent, fi.Name(), "object.container.storageFolder", count))
+			}
+		case isPlaylist(child):
+			if entries, err := l.readPlaylist(child); err == nil && len(entries) > 0 {
+				objs = append(objs, container(child, parent, playlistTitle(child), "object.container.playlistContainer", len(entries)))
+			}
+		case fi.Mode().IsRegular():
+			e, err := l.fileEntry(child, fi)
+			if err != nil {
+				continue
+			}
+			objs = append(objs, l.item(e, parent, fi.Name(), host))
+		}
+	}
+	return objs, nil
+}
+
+// folderChildCount counts the browsable direct children of a real directory
+func (l *Library) folderChildCount(p string) int {
+	dirEntries, err := os.ReadDir(l.filePath(p))
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+	for _, de := range dirEntries {
+		child := path.Join(p, de.Name())
+		if ignored, err := l.ignored(l.filePath(child)); err != nil || ignored {
+			continue
+		}
+		if de.IsDir() || isPlaylist(child) {
+			count++
+			continue
+		}
+		if mt, err := dms.MimeTypeByPath(l.filePath(child)); err == nil && mt.IsMedia() {
+			count++
+		}
+	}
+	return count
+}
+
+// fileEntry returns the cached index entry for a media file, probing it if needed
+func (l *Library) fileEntry(p string, fi os.FileInfo) (*entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.entryLocked(p, fi)
+}
+
+func (l *Library) entryLocked(p string, fi os.FileInfo) (*entry, error) {
+	if e, ok := l.cache[p]; ok && e.modTime.Equal(fi.ModTime()) && e.size == fi.Size() {
+		return e, nil
+	}
+
+	filePath := l.filePath(p)
+	mt, err := dms.MimeTypeByPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !mt.IsMedia() {
+		return nil, fmt.Errorf("not a media file: %s", p)
+	}
+
+	e := &entry{
+		path:     p,
+		mimeType: mt.String(),
+		kind:     mt.Type(),
+		size:     fi.Size(),
+		modTime:  fi.ModTime(),
+		taken:    fi.ModTime(),
+	}
+	switch {
+	case mt.IsAudio():
+		if tags, err := probe.ProbeTags(filePath); err == nil {
+			e.tags = tags
+		}
+	case mt.IsImage():
+		if taken, err := probe.ProbeTakenTime(filePath); err == nil {
+			e.taken = taken
+		}
+	}
+
+	l.cache[p] = e
+	return e, nil
+}
+
+// index returns all media entries and playlists, rescanning the tree when stale
+func (l *Library) index() ([]*entry, []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.scannedAt.IsZero() && time.Since(l.scannedAt) < l.rescanInterval {
+		return l.entries, l.playlists
+	}
+
+	var entries []*entry
+	var playlists []string
+	seen := make(map[string]bool)
+
+	filepath.WalkDir(l.root, func(filePath string, d os.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filePath == l.root {
+			return nil
+		}
+		if ignored, err := l.ignored(filePath); err != nil || ignored {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, filePath)
+		if err != nil {
+			return nil
+		}
+		p := "/" + filepath.ToSlash(rel)
+		if isPlaylist(p) {
+			playlists = append(playlists, p)
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if e, err := l.entryLocked(p, fi); err == nil {
+			entries = append(entries, e)
+			seen[p] = true
+		}
+		return nil
+	})
+
+	// Drop cached entries for files that no longer exist
+	for p := range l.cache {
+		if !seen[p] {
+			delete(l.cache, p)
+		}
+	}
+
+	l.entries = entries
+	l.playlists = playlists
+	l.scannedAt = time.Now()
+	return entries, playlists
+}
+
+// ignored reports whether a path is hidden from DLNA clients. Hidden names
+// are checked here first so dms doesn't log every dotfile during a scan.
+func (l *Library) ignored(filePath string) (bool, error) {
+	if l.server.IgnoreHidden && strings.HasPrefix(filepath.Base(filePath), ".") && filePath != l.root {
+		return true, nil
+	}
+	return l.server.IgnorePath(filePath)
+}
+
+// filePath returns the local filesystem path for an object path
+func (l *Library) filePath(p string) string {
+	return filepath.Join(l.root, filepath.FromSlash(path.Clean("/" + p))[1:])
+}
+
+// item builds a DIDL-Lite item for an indexed media file
+func (l *Library) item(e *entry, parentID, title, host string) upnpav.Item {
+	iconURI := mediaURL(host, iconPath, url.Values{"path": {e.path}})
+
+	obj := upnpav.Object{
+		ID:          objectID(e.path),
+		ParentID:    parentID,
+		Restricted:  1,
+		Title:       title,
+		Class:       "object.item." + e.kind + "Item",
+		Icon:        iconURI,
+		AlbumArtURI: iconURI,
+		Date:        upnpav.Timestamp{Time: e.taken},
+	}
+	if e.tags != nil {
+		obj.Artist = e.tags.Artist
+		obj.Album = e.tags.Album
+		obj.Genre = e.tags.Genre
+	}
+
+	item := upnpav.Item{
+		Object: obj,
+		Res: []upnpav.Resource{{
+			URL: mediaURL(host, resPath, url.Values{"path": {e.path}}),
+			ProtocolInfo: fmt.Sprintf("http-get:*:%s:%s", e.mimeType, dmsdlna.ContentFeatures{
+				SupportRange: true,
+			}.String()),
+			Size: uint64(e.size),
+		}},
+	}
+	// filegate always runs with NoTranscode, so only subtitles and thumbnails
+	// are offered alongside the original file
+	if e.kind == "video" {
+		item.Res = append(item.Res, upnpav.Resource{
+			URL:          mediaURL(host, subtitlePath, url.Values{"path": {e.path}}),
+			ProtocolInfo: "http-get:*:text/plain",
+		})
+	}
+	if e.kind == "video" || e.kind == "image" {
+		item.Res = append(item.Res, upnpav.Resource{
+			URL:          mediaURL(host, iconPath, url.Values{"path": {e.path}, "c": {"jpeg"}}),
+			ProtocolInfo: "http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_TN",
+		})
+	}
+	return item
+}
+
+// container builds a DIDL-Lite container
+func container(p, parentID, title, class string, childCount int) upnpav.Container {
+	return upnpav.Container{
+		Object: upnpav.Object{
+			ID:         objectID(p),
+			ParentID:   parentID,
+			Restricted: 1,
+			Title:      title,
+			Class:      class,
+		},
+		ChildCount: childCount,
+	}
+}
+
+// objectID converts an object path to a ContentDirectory ObjectID, matching dms
+func objectID(p string) string {
+	if p == "/" {
+		return "0"
+	}
+	return url.QueryEscape(p)
+}
+
+func mediaURL(host, p string, query url.Values) string {
+	return (&url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     p,
+		RawQuery: query.Encode(),
+	}).String()
+}
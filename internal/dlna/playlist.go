@@ -0,0 +1,112 @@
+package dlna
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isPlaylist reports whether a path names an M3U or PLS playlist
+func isPlaylist(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".m3u", ".m3u8", ".pls":
+		return true
+	}
+	return false
+}
+
+// playlistTitle returns the display name of a playlist (its file name without extension)
+func playlistTitle(p string) string {
+	base := path.Base(p)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// playlistChildren lists the media items referenced by a playlist, in playlist order
+func (l *Library) playlistChildren(p, host string) ([]interface{}, error) {
+	entries, err := l.readPlaylist(p)
+	if err != nil {
+		return nil, err
+	}
+	return l.items(entries, objectID(p), host, true), nil
+}
+
+// readPlaylist returns the media entries referenced by a playlist. Remote
+// URLs and files outside the shared root are skipped.
+func (l *Library) readPlaylist(p string) ([]*entry, error) {
+	f, err := os.Open(l.filePath(p))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	isPLS := strings.ToLower(path.Ext(p)) == ".pls"
+
+	var entries []*entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		line = strings.TrimPrefix(line, "\ufeff")
+		if line == "" {
+			continue
+		}
+
+		var ref string
+		if isPLS {
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || !strings.HasPrefix(strings.ToLower(key), "file") {
+				continue
+			}
+			ref = strings.TrimSpace(value)
+		} else {
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			ref = line
+		}
+
+		target, ok := l.resolvePlaylistRef(p, ref)
+		if !ok {
+			continue
+		}
+		fi, err := os.Stat(l.filePath(target))
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if ignored, err := l.ignored(l.filePath(target)); err != nil || ignored {
+			continue
+		}
+		if e, err := l.fileEntry(target, fi); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// resolvePlaylistRef converts a playlist line into an object path relative to the root
+func (l *Library) resolvePlaylistRef(playlist, ref string) (string, bool) {
+	if u, err := url.Parse(ref); err == nil && len(u.Scheme) > 1 {
+		if u.Scheme != "file" {
+			return "", false
+		}
+		ref = u.Path
+	}
+
+	// Playlists written on Windows use backslash separators
+	ref = strings.ReplaceAll(ref, `\`, "/")
+
+	var filePath string
+	if filepath.IsAbs(filepath.FromSlash(ref)) || filepath.VolumeName(filepath.FromSlash(ref)) != "" {
+		filePath = filepath.FromSlash(ref)
+	} else {
+		filePath = filepath.Join(filepath.Dir(l.filePath(playlist)), filepath.FromSlash(ref))
+	}
+
+	rel, err := filepath.Rel(l.root, filePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return "/" + filepath.ToSlash(rel), true
+}
@@ -0,0 +1,295 @@
+package dlna
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// viewsRoot is the object path under which virtual views live. Dot-prefixed
+// folders are hidden from DLNA clients, so it can't collide with a real folder.
+const viewsRoot = "/.views"
+
+const (
+	viewRecent    = "recent"
+	viewVideos    = "videos"
+	viewArtists   = "artists"
+	viewAlbums    = "albums"
+	viewPhotos    = "photos"
+	viewPlaylists = "playlists"
+
+	unknownArtist = "Unknown Artist"
+	unknownAlbum  = "Unknown Album"
+)
+
+// views lists the virtual containers shown at the root, in display order
+var views = []struct {
+	name  string
+	title string
+}{
+	{viewRecent, "Recently Added"},
+	{viewVideos, "All Videos"},
+	{viewArtists, "Music by Artist"},
+	{viewAlbums, "Music by Album"},
+	{viewPhotos, "Photos by Year"},
+	{viewPlaylists, "Playlists"},
+}
+
+// viewContainers returns the non-empty virtual views for the root listing
+func (l *Library) viewContainers() []interface{} {
+	var objs []interface{}
+	for _, v := range views {
+		p := viewsRoot + "/" + v.name
+		children, err := l.browseView([]string{v.name}, "")
+		if err != nil || len(children) == 0 {
+			continue
+		}
+		objs = append(objs, container(p, "0", v.title, "object.container", len(children)))
+	}
+	return objs
+}
+
+// browseView lists the children of a virtual view. segs are the decoded path
+// segments below viewsRoot, e.g. ["artists", "Queen", "Innuendo"].
+func (l *Library) browseView(segs []string, host string) ([]interface{}, error) {
+	if len(segs) == 0 {
+		return l.viewContainers(), nil
+	}
+
+	entries, playlists := l.index()
+	parent := objectID(viewPath(segs...))
+
+	switch segs[0] {
+	case viewRecent:
+		if len(segs) != 1 {
+			break
+		}
+		recent := append([]*entry(nil), entries...)
+		sort.SliceStable(recent, func(i, j int) bool { return recent[i].modTime.After(recent[j].modTime) })
+		if len(recent) > l.recentLimit {
+			recent = recent[:l.recentLimit]
+		}
+		return l.items(recent, parent, host, false), nil
+
+	case viewVideos:
+		if len(segs) != 1 {
+			break
+		}
+		videos := filterEntries(entries, func(e *entry) bool { return e.kind == "video" })
+		sortByName(videos)
+		return l.items(videos, parent, host, false), nil
+
+	case viewArtists:
+		switch len(segs) {
+		case 1:
+			return groupContainers(entries, segs, artistOf, "object.container.person.musicArtist"), nil
+		case 2:
+			tracks := filterEntries(entries, func(e *entry) bool { return artistOf(e) == segs[1] })
+			return groupContainers(tracks, segs, albumOf, "object.container.album.musicAlbum"), nil
+		case 3:
+			tracks := filterEntries(entries, func(e *entry) bool {
+				return artistOf(e) == segs[1] && albumOf(e) == segs[2]
+			})
+			sortTracks(tracks)
+			return l.items(tracks, parent, host, true), nil
+		}
+
+	case viewAlbums:
+		switch len(segs) {
+		case 1:
+			return groupContainers(entries, segs, albumOf, "object.container.album.musicAlbum"), nil
+		case 2:
+			tracks := filterEntries(entries, func(e *entry) bool { return albumOf(e) == segs[1] })
+			sortTracks(tracks)
+			return l.items(tracks, parent, host, true), nil
+		}
+
+	case viewPhotos:
+		switch len(segs) {
+		case 1:
+			objs := groupContainers(entries, segs, yearOf, "object.container.album.photoAlbum")
+			// Newest year first
+			for i, j := 0, len(objs)-1; i < j; i, j = i+1, j-1 {
+				objs[i], objs[j] = objs[j], objs[i]
+			}
+			return objs, nil
+		case 2:
+			photos := filterEntries(entries, func(e *entry) bool { return yearOf(e) == segs[1] })
+			sort.SliceStable(photos, func(i, j int) bool { return photos[i].taken.Before(photos[j].taken) })
+			return l.items(photos, parent, host, false), nil
+		}
+
+	case viewPlaylists:
+		if len(segs) != 1 {
+			break
+		}
+		var objs []interface{}
+		for _, p := range playlists {
+			if entries, err := l.readPlaylist(p); err == nil && len(entries) > 0 {
+				objs = append(objs, container(p, parent, playlistTitle(p), "object.container.playlistContainer", len(entries)))
+			}
+		}
+		return objs, nil
+	}
+
+	return nil, fmt.Errorf("no such view: %s", viewPath(segs...))
+}
+
+// viewMetadata describes a virtual view container
+func (l *Library) viewMetadata(p, host string) (interface{}, error) {
+	segs := viewSegments(p)
+	children, err := l.browseView(segs, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segs) == 0 {
+		return container(viewsRoot, "0", "Views", "object.container", len(children)), nil
+	}
+
+	title := segs[len(segs)-1]
+	parent := objectID(viewPath(segs[:len(segs)-1]...))
+	if len(segs) == 1 {
+		parent = "0"
+		for _, v := range views {
+			if v.name == segs[0] {
+				title = v.title
+			}
+		}
+	}
+	return container(p, parent, title, "object.container", len(children)), nil
+}
+
+// items builds DIDL-Lite items for entries inside a virtual container. Music
+// views prefer the tagged track title over the file name.
+func (l *Library) items(entries []*entry, parentID, host string, useTags bool) []interface{} {
+	objs := make([]interface{}, 0, len(entries))
+	for _, e := range entries {
+		title := path.Base(e.path)
+		if useTags && e.tags != nil && e.tags.Title != "" {
+			title = e.tags.Title
+		}
+		objs = append(objs, l.item(e, parentID, title, host))
+	}
+	return objs
+}
+
+// groupContainers returns one container per distinct key, sorted by key.
+// Entries for which key returns "" are skipped.
+func groupContainers(entries []*entry, segs []string, key func(*entry) string, class string) []interface{} {
+	counts := make(map[string]int)
+	for _, e := range entries {
+		if k := key(e); k != "" {
+			counts[k]++
+		}
+	}
+
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return strings.ToLower(keys[i]) < strings.ToLower(keys[j]) })
+
+	parent := objectID(viewPath(segs...))
+	objs := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		child := append(append([]string(nil), segs...), k)
+		objs = append(objs, container(viewPath(child...), parent, k, class, counts[k]))
+	}
+	return objs
+}
+
+func artistOf(e *entry) string {
+	if e.kind != "audio" {
+		return ""
+	}
+	if e.tags != nil {
+		if e.tags.AlbumArtist != "" {
+			return e.tags.AlbumArtist
+		}
+		if e.tags.Artist != "" {
+			return e.tags.Artist
+		}
+	}
+	return unknownArtist
+}
+
+func albumOf(e *entry) string {
+	if e.kind != "audio" {
+		return ""
+	}
+	if e.tags != nil && e.tags.Album != "" {
+		return e.tags.Album
+	}
+	return unknownAlbum
+}
+
+func yearOf(e *entry) string {
+	if e.kind != "image" {
+		return ""
+	}
+	return strconv.Itoa(e.taken.Year())
+}
+
+func filterEntries(entries []*entry, keep func(*entry) bool) []*entry {
+	var out []*entry
+	for _, e := range entries {
+		if keep(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func sortByName(entries []*entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return strings.ToLower(path.Base(entries[i].path)) < strings.ToLower(path.Base(entries[j].path))
+	})
+}
+
+// sortTracks orders tracks by track number, falling back to file name
+func sortTracks(entries []*entry) {
+	sortByName(entries)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return trackOf(entries[i]) < trackOf(entries[j])
+	})
+}
+
+func trackOf(e *entry) int {
+	if e.tags == nil {
+		return 0
+	}
+	return e.tags.Track
+}
+
+// viewPath joins view segments into an object path. Segments are escaped so
+// artist or album names containing "/" or ".." survive path cleaning.
+func viewPath(segs ...string) string {
+	p := viewsRoot
+	for _, s := range segs {
+		escaped := url.PathEscape(s)
+		if strings.HasPrefix(escaped, ".") {
+			escaped = "%2E" + escaped[1:]
+		}
+		p += "/" + escaped
+	}
+	return p
+}
+
+// viewSegments splits an object path below viewsRoot into decoded segments
+func viewSegments(p string) []string {
+	rest := strings.Trim(strings.TrimPrefix(p, viewsRoot), "/")
+	if rest == "" {
+		return nil
+	}
+	parts := strings.Split(rest, "/")
+	for i, part := range parts {
+		if s, err := url.PathUnescape(part); err == nil {
+			parts[i] = s
+		}
+	}
+	return parts
+}
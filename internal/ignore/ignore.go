@@ -0,0 +1,292 @@
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileName is the ignore file filegate always reads
+const FileName = ".filegateignore"
+
+// recheckInterval is how often a directory's ignore files are looked at again
+const recheckInterval = 2 * time.Second
+
+// Config holds configuration for a Matcher
+type Config struct {
+	// Root of the tree
+	Root string
+	// Patterns apply to the whole tree, before any ignore file
+	Patterns []string
+	// Files are the ignore files read in every directory, in order of
+	// increasing precedence
+	Files []string
+}
+
+// Matcher applies gitignore-style rules to the paths of a directory tree.
+// Like git, rules in deeper directories take precedence and nothing inside
+// an excluded directory can be included again.
+type Matcher struct {
+	root     string
+	patterns []rule
+	files    []string
+
+	mu   sync.Mutex
+	dirs map[string]*dirRules
+}
+
+// dirRules are the rules from one directory's ignore files
+type dirRules struct {
+	rules     []rule
+	checkedAt time.Time
+	modTimes  []time.Time
+}
+
+type rule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// New creates a Matcher, failing on invalid patterns
+func New(cfg Config) (*Matcher, error) {
+	m := &Matcher{
+		root:  cfg.Root,
+		files: cfg.Files,
+		dirs:  make(map[string]*dirRules),
+	}
+	for _, p := range cfg.Patterns {
+		r, ok, err := parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		if ok {
+			m.patterns = append(m.patterns, r)
+		}
+	}
+	return m, nil
+}
+
+// Match reports whether a slash path relative to the root ("/docs/a.txt") is
+// excluded, either itself or through one of its parent directories
+func (m *Matcher) Match(name string, isDir bool) bool {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return false
+	}
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		last := i == len(parts)-1
+		if m.excluded(parts[:i+1], !last || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded applies the rules to one path, ignoring its parents' status
+func (m *Matcher) excluded(parts []string, isDir bool) bool {
+	result := false
+	apply := func(rules []rule, rel string) {
+		for _, r := range rules {
+			if r.match(rel, isDir) {
+				result = !r.negate
+			}
+		}
+	}
+
+	apply(m.patterns, strings.Join(parts, "/"))
+	if len(m.files) == 0 {
+		return result
+	}
+	for i := range parts {
+		dir := "/" + strings.Join(parts[:i], "/")
+		apply(m.rulesFor(dir), strings.Join(parts[i:], "/"))
+	}
+	return result
+}
+
+// rulesFor returns the rules of the ignore files in dir, rereading them when
+// they change
+func (m *Matcher) rulesFor(dir string) []rule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.dirs[dir]
+	if ok && time.Since(d.checkedAt) < recheckInterval {
+		return d.rules
+	}
+
+	modTimes := make([]time.Time, len(m.files))
+	for i, f := range m.files {
+		if fi, err := os.Stat(m.localPath(dir, f)); err == nil {
+			modTimes[i] = fi.ModTime()
+		}
+	}
+	if ok && equalTimes(d.modTimes, modTimes) {
+		d.checkedAt = time.Now()
+		return d.rules
+	}
+
+	d = &dirRules{checkedAt: time.Now(), modTimes: modTimes}
+	for i, f := range m.files {
+		if !modTimes[i].IsZero() {
+			d.rules = append(d.rules, readFile(m.localPath(dir, f))...)
+		}
+	}
+	m.dirs[dir] = d
+	return d.rules
+}
+
+func (m *Matcher) localPath(dir, file string) string {
+	return filepath.Join(m.root, filepath.FromSlash(dir), file)
+}
+
+func equalTimes(a, b []time.Time) bool {
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+// readFile parses an ignore file, skipping invalid lines like git does
+func readFile(name string) []rule {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var rules []rule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if r, ok, err := parse(scanner.Text()); err == nil && ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// parse turns one gitignore line into a rule. It returns false for blank
+// lines and comments.
+func parse(line string) (rule, bool, error) {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule{}, false, nil
+	}
+
+	var r rule
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but the end anchors the pattern to its directory
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return rule{}, false, nil
+	}
+
+	expr := globToRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return rule{}, false, err
+	}
+	r.re = re
+	return r, true, nil
+}
+
+func (r *rule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return r.re.MatchString(rel)
+}
+
+// globToRegexp translates a gitignore glob, where * and ? don't match
+// slashes and ** matches any number of directories
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			atStart := i == 0 || glob[i-1] == '/'
+			if strings.HasPrefix(glob[i:], "**") && atStart {
+				switch {
+				case strings.HasPrefix(glob[i:], "**/"):
+					b.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				case i+2 == len(glob):
+					b.WriteString(".*")
+					i++
+					continue
+				}
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := classEnd(glob, i)
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// classEnd returns the index of the ] closing the class opened at i, or -1
+func classEnd(glob string, i int) int {
+	j := i + 1
+	if j < len(glob) && (glob[j] == '!' || glob[j] == '^') {
+		j++
+	}
+	// A ] right after the opening bracket is part of the class
+	if j < len(glob) && glob[j] == ']' {
+		j++
+	}
+	if end := strings.IndexByte(glob[j:], ']'); end >= 0 {
+		return j + end
+	}
+	return -1
+}
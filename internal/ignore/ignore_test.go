@@ -0,0 +1,109 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	m, err := New(Config{Patterns: []string{
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/top.txt",
+		"docs/**/draft-*",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		isDir bool
+		want  bool
+	}{
+		{"/a.log", false, true},
+		{"/sub/a.log", false, true},
+		// Negation brings a file back
+		{"/keep.log", false, false},
+		{"/sub/keep.log", false, false},
+		// Dir-only rules don't match files of that name
+		{"/build", true, true},
+		{"/build", false, false},
+		{"/src/build", true, true},
+		// ... and exclude everything inside
+		{"/build/out.bin", false, true},
+		// Anchored patterns only match in their directory
+		{"/top.txt", false, true},
+		{"/sub/top.txt", false, false},
+		{"/docs/draft-1", false, true},
+		{"/docs/a/b/draft-2", false, true},
+		{"/other/draft-3", false, false},
+		{"/", true, false},
+	} {
+		if got := m.Match(tc.name, tc.isDir); got != tc.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", tc.name, tc.isDir, got, tc.want)
+		}
+	}
+}
+
+func TestNegationInsideExcludedDir(t *testing.T) {
+	// Like git, a file in an excluded directory can't be included again
+	m, err := New(Config{Patterns: []string{"cache/", "!cache/keep.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Match("/cache/keep.txt", false) {
+		t.Error("file inside an excluded directory was included again")
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		local := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(local, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(".gitignore", "*.tmp\n# comment\n\nsecret/\n")
+	write(FileName, "!important.tmp\n")
+	write("sub/"+FileName, "*.txt\n!readme.txt\n")
+
+	m, err := New(Config{Root: root, Patterns: []string{"*.bak"}, Files: []string{".gitignore", FileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		isDir bool
+		want  bool
+	}{
+		{"/a.tmp", false, true},
+		// Later files take precedence over earlier ones
+		{"/important.tmp", false, false},
+		{"/secret", true, true},
+		{"/secret/a.md", false, true},
+		{"/a.bak", false, true},
+		{"/a.txt", false, false},
+		// Rules in deeper directories only apply below them
+		{"/sub/a.txt", false, true},
+		{"/sub/readme.txt", false, false},
+		{"/sub/deeper/b.txt", false, true},
+	} {
+		if got := m.Match(tc.name, tc.isDir); got != tc.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", tc.name, tc.isDir, got, tc.want)
+		}
+	}
+}
+
+func TestInvalidPattern(t *testing.T) {
+	if _, err := New(Config{Patterns: []string{"[z-a]"}}); err == nil {
+		t.Error("New accepted an invalid pattern")
+	}
+}
@@ -0,0 +1,434 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// hostTTL is used for records tied to the host (SRV, A), per RFC 6762
+	hostTTL = 120
+	// serviceTTL is used for the other records
+	serviceTTL = 4500
+
+	// cacheFlush marks records this responder owns exclusively
+	cacheFlush = 1 << 15
+	// unicastResponse is the QU bit in question classes
+	unicastResponse = 1 << 15
+)
+
+var (
+	groupAddr    = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	servicesName = dnsmessage.MustNewName("_services._dns-sd._udp.local.")
+)
+
+// Config describes the service to advertise
+type Config struct {
+	// Instance is the human-readable name shown in file managers
+	Instance string
+	// Service is the DNS-SD service type (e.g. "_webdav._tcp")
+	Service string
+	// Port is the port the service listens on
+	Port int
+	// TXT holds key=value pairs for the TXT record (e.g. "path=/")
+	TXT []string
+	// Interfaces to advertise on (defaults to all multicast-capable ones)
+	Interfaces []net.Interface
+}
+
+// Responder answers mDNS queries for one DNS-SD service over IPv4
+type Responder struct {
+	conn   *ipv4.PacketConn
+	ifaces []net.Interface
+
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	txt      []string
+
+	mu sync.Mutex // serializes SetMulticastInterface + WriteTo
+}
+
+// New joins the mDNS group on the configured interfaces
+func New(cfg Config) (*Responder, error) {
+	ifaces := cfg.Interfaces
+	if len(ifaces) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interfaces: %w", err)
+		}
+		for _, iface := range all {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 && iface.Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, iface)
+			}
+		}
+	}
+
+	service, err := dnsmessage.NewName(cfg.Service + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("invalid service type %q: %w", cfg.Service, err)
+	}
+	instance, err := dnsmessage.NewName(label(cfg.Instance) + "." + service.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid instance name %q: %w", cfg.Instance, err)
+	}
+	host, err := dnsmessage.NewName(hostLabel() + ".local.")
+	if err != nil {
+		return nil, err
+	}
+
+	// Listening on the group address makes Go set SO_REUSEADDR (and
+	// SO_REUSEPORT where needed) before binding the wildcard address, so this
+	// coexists with Avahi or mDNSResponder
+	c, err := net.ListenPacket("udp4", groupAddr.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for mDNS: %w", err)
+	}
+	conn := ipv4.NewPacketConn(c)
+
+	var joined []net.Interface
+	for _, iface := range ifaces {
+		if len(interfaceIPs(&iface)) == 0 {
+			continue
+		}
+		if err := conn.JoinGroup(&iface, groupAddr); err == nil {
+			joined = append(joined, iface)
+		}
+	}
+	if len(joined) == 0 {
+		conn.Close()
+		return nil, errors.New("no interface could join the mDNS group")
+	}
+
+	conn.SetMulticastTTL(255)
+	conn.SetMulticastLoopback(true)
+	// Not supported everywhere (e.g. Windows); without it replies go out on
+	// every interface
+	conn.SetControlMessage(ipv4.FlagInterface, true)
+
+	return &Responder{
+		conn:     conn,
+		ifaces:   joined,
+		service:  service,
+		instance: instance,
+		host:     host,
+		port:     uint16(cfg.Port),
+		txt:      cfg.TXT,
+	}, nil
+}
+
+// Instance returns the advertised instance name
+func (r *Responder) Instance() string {
+	return strings.TrimSuffix(r.instance.String(), "."+r.service.String())
+}
+
+// Run answers queries until ctx is cancelled, then tells the network the
+// service is gone
+func (r *Responder) Run(ctx context.Context) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- r.serve()
+	}()
+
+	// Announce on startup (RFC 6762 section 8.3: at least twice, a second apart)
+	r.announce(false)
+	announce := time.NewTimer(time.Second)
+	defer announce.Stop()
+
+	for {
+		select {
+		case <-announce.C:
+			r.announce(false)
+		case err := <-errChan:
+			r.conn.Close()
+			return fmt.Errorf("mDNS error: %w", err)
+		case <-ctx.Done():
+			r.announce(true)
+			r.conn.Close()
+			<-errChan
+			return nil
+		}
+	}
+}
+
+func (r *Responder) serve() error {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		var iface *net.Interface
+		if cm != nil {
+			if iface = r.lookupInterface(cm.IfIndex); iface == nil {
+				continue
+			}
+		}
+		r.handleQuery(buf[:n], iface, src)
+	}
+}
+
+// handleQuery answers a query received on iface (nil if unknown)
+func (r *Responder) handleQuery(packet []byte, iface *net.Interface, src net.Addr) {
+	var p dnsmessage.Parser
+	header, err := p.Start(packet)
+	if err != nil || header.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	var answers []wantRecord
+	for _, q := range questions {
+		if q.Class&^unicastResponse != dnsmessage.ClassINET && q.Class&^unicastResponse != dnsmessage.ClassANY {
+			continue
+		}
+		answers = append(answers, r.match(q)...)
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	// Queries from a port other than 5353 are legacy unicast queries (e.g.
+	// dig), which expect a direct reply echoing the ID and questions
+	if addr, ok := src.(*net.UDPAddr); ok && addr.Port != groupAddr.Port {
+		msg, err := r.buildMessage(header.ID, questions, answers, r.targets(iface)[0], false)
+		if err == nil {
+			r.conn.WriteTo(msg, nil, src)
+		}
+		return
+	}
+
+	for _, target := range r.targets(iface) {
+		msg, err := r.buildMessage(0, nil, answers, target, false)
+		if err == nil {
+			r.send(msg, target)
+		}
+	}
+}
+
+// wantRecord names a record to include in a response
+type wantRecord int
+
+const (
+	recordServices wantRecord = iota
+	recordPTR
+	recordSRV
+	recordTXT
+	recordA
+)
+
+func (r *Responder) match(q dnsmessage.Question) []wantRecord {
+	is := func(t dnsmessage.Type) bool { return q.Type == t || q.Type == dnsmessage.TypeALL }
+
+	switch {
+	case sameName(q.Name, servicesName) && is(dnsmessage.TypePTR):
+		return []wantRecord{recordServices}
+	case sameName(q.Name, r.service) && is(dnsmessage.TypePTR):
+		return []wantRecord{recordPTR}
+	case sameName(q.Name, r.instance):
+		var want []wantRecord
+		if is(dnsmessage.TypeSRV) {
+			want = append(want, recordSRV)
+		}
+		if is(dnsmessage.TypeTXT) {
+			want = append(want, recordTXT)
+		}
+		return want
+	case sameName(q.Name, r.host) && is(dnsmessage.TypeA):
+		return []wantRecord{recordA}
+	}
+	return nil
+}
+
+// announce sends every record unsolicited, or withdraws them on goodbye
+func (r *Responder) announce(goodbye bool) {
+	for _, target := range r.targets(nil) {
+		msg, err := r.buildMessage(0, nil, []wantRecord{recordPTR, recordSRV, recordTXT, recordA}, target, goodbye)
+		if err == nil {
+			r.send(msg, target)
+		}
+	}
+}
+
+// targets returns the interfaces to respond on
+func (r *Responder) targets(iface *net.Interface) []*net.Interface {
+	if iface != nil {
+		return []*net.Interface{iface}
+	}
+	targets := make([]*net.Interface, len(r.ifaces))
+	for i := range r.ifaces {
+		targets[i] = &r.ifaces[i]
+	}
+	return targets
+}
+
+func (r *Responder) lookupInterface(index int) *net.Interface {
+	for i := range r.ifaces {
+		if r.ifaces[i].Index == index {
+			return &r.ifaces[i]
+		}
+	}
+	return nil
+}
+
+func (r *Responder) send(msg []byte, iface *net.Interface) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.conn.SetMulticastInterface(iface); err != nil {
+		return
+	}
+	r.conn.WriteTo(msg, nil, groupAddr)
+}
+
+// buildMessage builds a response with the wanted records as answers and the
+// records a client would ask for next (SRV, TXT, A) as additionals. A
+// records use iface's addresses so clients get one they can reach. Goodbye
+// messages carry a TTL of 0 so caches drop the records.
+func (r *Responder) buildMessage(id uint16, questions []dnsmessage.Question, want []wantRecord, iface *net.Interface, goodbye bool) ([]byte, error) {
+	hostRecTTL, serviceRecTTL := uint32(hostTTL), uint32(serviceTTL)
+	if goodbye {
+		hostRecTTL, serviceRecTTL = 0, 0
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+
+	if len(questions) > 0 {
+		if err := b.StartQuestions(); err != nil {
+			return nil, err
+		}
+		for _, q := range questions {
+			q.Class &^= unicastResponse
+			if err := b.Question(q); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	included := make(map[wantRecord]bool)
+	add := func(rec wantRecord) error {
+		if included[rec] {
+			return nil
+		}
+		included[rec] = true
+		return r.addRecord(&b, rec, iface, hostRecTTL, serviceRecTTL)
+	}
+
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, rec := range want {
+		if err := add(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	if included[recordPTR] || included[recordSRV] {
+		for _, rec := range []wantRecord{recordSRV, recordTXT, recordA} {
+			if err := add(rec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Finish()
+}
+
+func (r *Responder) addRecord(b *dnsmessage.Builder, rec wantRecord, iface *net.Interface, hostRecTTL, serviceRecTTL uint32) error {
+	shared := dnsmessage.ClassINET
+	unique := dnsmessage.ClassINET | cacheFlush
+
+	switch rec {
+	case recordServices:
+		return b.PTRResource(
+			dnsmessage.ResourceHeader{Name: servicesName, Class: shared, TTL: serviceRecTTL},
+			dnsmessage.PTRResource{PTR: r.service})
+	case recordPTR:
+		return b.PTRResource(
+			dnsmessage.ResourceHeader{Name: r.service, Class: shared, TTL: serviceRecTTL},
+			dnsmessage.PTRResource{PTR: r.instance})
+	case recordSRV:
+		return b.SRVResource(
+			dnsmessage.ResourceHeader{Name: r.instance, Class: unique, TTL: hostRecTTL},
+			dnsmessage.SRVResource{Target: r.host, Port: r.port})
+	case recordTXT:
+		txt := r.txt
+		if len(txt) == 0 {
+			// A TXT record must have at least one string
+			txt = []string{""}
+		}
+		return b.TXTResource(
+			dnsmessage.ResourceHeader{Name: r.instance, Class: unique, TTL: serviceRecTTL},
+			dnsmessage.TXTResource{TXT: txt})
+	case recordA:
+		for _, ip := range interfaceIPs(iface) {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip)
+			err := b.AResource(dnsmessage.ResourceHeader{Name: r.host, Class: unique, TTL: hostRecTTL}, a)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// interfaceIPs returns an interface's IPv4 addresses
+func interfaceIPs(iface *net.Interface) []net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				ips = append(ips, ip4)
+			}
+		}
+	}
+	return ips
+}
+
+func sameName(a, b dnsmessage.Name) bool {
+	return strings.EqualFold(a.String(), b.String())
+}
+
+// label makes s usable as a single DNS label: dots would split it and
+// labels are limited to 63 bytes
+func label(s string) string {
+	s = strings.ReplaceAll(s, ".", "-")
+	if len(s) > 63 {
+		s = strings.ToValidUTF8(s[:63], "")
+	}
+	return s
+}
+
+// hostLabel returns the short host name for the .local A record
+func hostLabel() string {
+	hostname, _ := os.Hostname()
+	hostname, _, _ = strings.Cut(hostname, ".")
+	if hostname == "" {
+		return "filegate"
+	}
+	return label(hostname)
+}
@@ -0,0 +1,163 @@
+package probe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	exifTagDateTime         = 0x0132
+	exifTagExifIFDPointer   = 0x8769
+	exifTagDateTimeOriginal = 0x9003
+
+	exifTypeASCII = 2
+	exifTypeLong  = 4
+
+	exifTimeLayout = "2006:01:02 15:04:05"
+)
+
+// ProbeTakenTime returns the capture time recorded in a JPEG's EXIF data.
+// DateTimeOriginal is preferred, falling back to the IFD0 DateTime tag.
+func ProbeTakenTime(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	tiff, err := readJPEGExif(bufio.NewReader(f))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseExifTime(tiff)
+}
+
+// readJPEGExif walks the JPEG markers and returns the TIFF block of the Exif APP1 segment
+func readJPEGExif(r io.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xFF || soi[1] != 0xD8 {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if hdr[0] != 0xFF {
+			return nil, fmt.Errorf("invalid JPEG marker")
+		}
+		marker := hdr[1]
+		// Start of scan: no metadata segments follow
+		if marker == 0xDA || marker == 0xD9 {
+			return nil, fmt.Errorf("no EXIF data")
+		}
+
+		length := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("invalid JPEG segment length")
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// parseExifTime extracts the capture time from a TIFF-structured EXIF block
+func parseExifTime(tiff []byte) (time.Time, error) {
+	if len(tiff) < 8 {
+		return time.Time{}, fmt.Errorf("EXIF data too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return time.Time{}, fmt.Errorf("invalid EXIF byte order")
+	}
+
+	ifd0 := order.Uint32(tiff[4:])
+	var fallback string
+	var exifIFD uint32
+
+	walkIFD(tiff, order, ifd0, func(tag, typ uint16, count, value uint32, entry []byte) {
+		switch tag {
+		case exifTagDateTime:
+			fallback = exifString(tiff, order, typ, count, entry)
+		case exifTagExifIFDPointer:
+			if typ == exifTypeLong {
+				exifIFD = value
+			}
+		}
+	})
+
+	var original string
+	if exifIFD != 0 {
+		walkIFD(tiff, order, exifIFD, func(tag, typ uint16, count, value uint32, entry []byte) {
+			if tag == exifTagDateTimeOriginal {
+				original = exifString(tiff, order, typ, count, entry)
+			}
+		})
+	}
+
+	for _, s := range []string{original, fallback} {
+		if s == "" {
+			continue
+		}
+		if t, err := time.ParseInLocation(exifTimeLayout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no EXIF date")
+}
+
+// walkIFD calls fn for each 12-byte entry of the IFD at offset
+func walkIFD(tiff []byte, order binary.ByteOrder, offset uint32, fn func(tag, typ uint16, count, value uint32, entry []byte)) {
+	if int(offset)+2 > len(tiff) {
+		return
+	}
+	n := int(order.Uint16(tiff[offset:]))
+	start := int(offset) + 2
+	for i := 0; i < n; i++ {
+		pos := start + i*12
+		if pos+12 > len(tiff) {
+			return
+		}
+		entry := tiff[pos : pos+12]
+		fn(order.Uint16(entry[0:]), order.Uint16(entry[2:]), order.Uint32(entry[4:]), order.Uint32(entry[8:]), entry)
+	}
+}
+
+// exifString decodes an ASCII entry, which is stored inline when it fits in four bytes
+func exifString(tiff []byte, order binary.ByteOrder, typ uint16, count uint32, entry []byte) string {
+	if typ != exifTypeASCII || count == 0 {
+		return ""
+	}
+	var data []byte
+	if count <= 4 {
+		data = entry[8 : 8+count]
+	} else {
+		off := order.Uint32(entry[8:])
+		if uint64(off)+uint64(count) > uint64(len(tiff)) {
+			return ""
+		}
+		data = tiff[off : off+count]
+	}
+	return string(bytes.TrimRight(data, "\x00 "))
+}
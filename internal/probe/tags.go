@@ -0,0 +1,43 @@
+package probe
+
+import (
+	"os"
+
+	"github.com/dhowden/tag"
+)
+
+// Tags contains descriptive metadata read from an audio file
+type Tags struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+	Track       int
+	Year        int
+}
+
+// ProbeTags reads ID3/MP4/FLAC/Vorbis tags from an audio file
+func ProbeTags(path string) (*Tags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, err
+	}
+
+	track, _ := m.Track()
+	return &Tags{
+		Title:       m.Title(),
+		Artist:      m.Artist(),
+		Album:       m.Album(),
+		AlbumArtist: m.AlbumArtist(),
+		Genre:       m.Genre(),
+		Track:       track,
+		Year:        m.Year(),
+	}, nil
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// StreamContentType marks HTTP requests and responses whose bodies carry
+	// framed messages, as used by the HTTP/2 transport
+	StreamContentType = "application/x-filegate-stream"
+
+	// SessionHeader names the HTTP/2 tunnel a message posted on its own
+	// stream belongs to
+	SessionHeader = "Filegate-Session"
+
+	// MaxFrameSize is the largest message a peer accepts. Responses travel
+	// whole in one message, so it leaves room for large downloads while
+	// stopping a peer from making the other buffer without end.
+	MaxFrameSize = 1 << 30
+
+	// MaxBodySize is the largest request or response body that fits in one
+	// message. Bodies are base64 encoded, and the rest leaves 1 MiB for the
+	// headers.
+	MaxBodySize = (MaxFrameSize - 1<<20) / 4 * 3
+)
+
+// ErrFrameTooLarge is returned for messages over MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// WriteFrame writes a message prefixed with its length, for transports that
+// carry messages in a byte stream
+func WriteFrame(w io.Writer, data []byte) error {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(data)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadFrame reads a message written by WriteFrame
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var size [8]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint64(size[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n)
+	}
+	// Grow the buffer as data arrives rather than trusting the length
+	var buf bytes.Buffer
+	buf.Grow(int(min(n, 1<<20)))
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
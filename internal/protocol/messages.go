@@ -16,12 +16,31 @@ const (
 	TypeHTTPRequest MessageType = "http_request"
 	// TypeHTTPResponse is sent by client to respond to an HTTP request
 	TypeHTTPResponse MessageType = "http_response"
+	// TypeCancel is sent by either side to abandon an HTTP request, e.g. when
+	// the browser aborted it
+	TypeCancel MessageType = "cancel"
+	// TypeStreamOpen is sent by the relay when a connection for an end-to-end
+	// encrypted or TCP tunnel arrives, or when it hands over a connection
+	// whose HTTP request outlives a request/response pair
+	TypeStreamOpen MessageType = "stream_open"
+	// TypeStreamData carries a stream's bytes in either direction
+	TypeStreamData MessageType = "stream_data"
+	// TypeStreamClose is sent by either side when a stream ends
+	TypeStreamClose MessageType = "stream_close"
+	// TypeStreamAck is sent by either side of a flow-controlled stream for
+	// the stream_data messages it consumed, letting the other send as many
+	// more
+	TypeStreamAck MessageType = "stream_ack"
 	// TypePing is sent to check connection health
 	TypePing MessageType = "ping"
 	// TypePong is the response to a ping
 	TypePong MessageType = "pong"
 	// TypeError is sent when an error occurs
 	TypeError MessageType = "error"
+	// TypeGoingAway is sent by a relay that is shutting down. It finishes the
+	// client's in-flight requests, then closes the connection for the client
+	// to reconnect, possibly to another relay.
+	TypeGoingAway MessageType = "going_away"
 )
 
 // Message is the base envelope for all WebSocket messages
@@ -34,6 +53,24 @@ type Message struct {
 type RegisterPayload struct {
 	// Version of the client for compatibility checking
 	Version string `json:"version"`
+	// Token authenticates the client with relays that require it
+	Token string `json:"token,omitempty"`
+	// Subdomain requests a specific subdomain instead of a generated one
+	Subdomain string `json:"subdomain,omitempty"`
+	// MaxBodySize is the largest request body the client accepts (0 for no
+	// limit), letting the relay reject larger uploads before buffering them
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	// E2E asks the relay to forward TLS connections unopened as streams
+	// instead of sending HTTP requests, so it never sees their content
+	E2E bool `json:"e2e,omitempty"`
+	// TCP asks for a raw TCP tunnel: connections to an allocated port, or TLS
+	// connections to the subdomain on the passthrough port, arrive as streams
+	TCP bool `json:"tcp,omitempty"`
+	// Port requests a specific port for a TCP tunnel
+	Port int `json:"port,omitempty"`
+	// FlowControl says the client acknowledges stream data and waits for
+	// acknowledgements, see StreamWindow
+	FlowControl bool `json:"flow_control,omitempty"`
 }
 
 // RegisteredPayload is sent by the relay after successful registration
@@ -42,6 +79,12 @@ type RegisteredPayload struct {
 	Subdomain string `json:"subdomain"`
 	// FullURL is the complete URL for accessing the WebDAV (e.g., "https://brave-tiger.davproxy.com")
 	FullURL string `json:"full_url"`
+	// Port is the port allocated to a TCP tunnel (0 if it is only reachable
+	// by SNI)
+	Port int `json:"port,omitempty"`
+	// FlowControl confirms that streams are flow-controlled, which needs
+	// both sides to support it
+	FlowControl bool `json:"flow_control,omitempty"`
 }
 
 // HTTPRequestPayload represents an incoming HTTP request to be forwarded
@@ -56,6 +99,12 @@ type HTTPRequestPayload struct {
 	Headers map[string][]string `json:"headers"`
 	// Body is the request body (base64 encoded for binary safety)
 	Body []byte `json:"body,omitempty"`
+	// Host is the public host the request was made to
+	Host string `json:"host,omitempty"`
+	// Scheme is "https" if the request reached the relay over TLS
+	Scheme string `json:"scheme,omitempty"`
+	// RemoteAddr is the address of the client that made the request
+	RemoteAddr string `json:"remote_addr,omitempty"`
 }
 
 // HTTPResponsePayload represents the response to an HTTP request
@@ -70,6 +119,43 @@ type HTTPResponsePayload struct {
 	Body []byte `json:"body,omitempty"`
 }
 
+// CancelPayload identifies the HTTP request to abandon
+type CancelPayload struct {
+	// ID matches the request ID
+	ID string `json:"id"`
+	// Reason is a human-readable explanation
+	Reason string `json:"reason,omitempty"`
+}
+
+// StreamPayload opens, carries data for, or closes a stream
+type StreamPayload struct {
+	// ID identifies the stream
+	ID string `json:"id"`
+	// RemoteAddr is the address of the connecting client (stream_open only)
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// HTTP marks a stream carrying HTTP requests for the client's handler,
+	// such as WebSocket upgrades (stream_open only)
+	HTTP bool `json:"http,omitempty"`
+	// Scheme is "https" if an HTTP stream reached the relay over TLS
+	// (stream_open only)
+	Scheme string `json:"scheme,omitempty"`
+	// Data is a chunk of the stream (stream_data only)
+	Data []byte `json:"data,omitempty"`
+	// Acked is how many stream_data messages were consumed (stream_ack
+	// only)
+	Acked int `json:"acked,omitempty"`
+}
+
+// StreamWindow is how many stream_data messages may be sent on a stream
+// before they are acknowledged. Each side buffers that many for a stream, so
+// a slow connection holds up only its own stream; a peer that sends more, or
+// doesn't do flow control and outruns the buffer, has the stream closed.
+const StreamWindow = 64
+
+// StreamAckBatch is how many consumed stream_data messages are acknowledged
+// at once, unless the stream's buffer runs empty first
+const StreamAckBatch = 16
+
 // ErrorPayload contains error information
 type ErrorPayload struct {
 	// Code is a machine-readable error code
@@ -78,6 +164,16 @@ type ErrorPayload struct {
 	Message string `json:"message"`
 }
 
+// GoingAwayPayload tells a client why the relay is going away and where to
+// reconnect
+type GoingAwayPayload struct {
+	// Reason is a human-readable explanation
+	Reason string `json:"reason,omitempty"`
+	// Reconnect is the tunnel URL of another relay to move to (empty to
+	// reconnect to the same URL, e.g. behind a load balancer)
+	Reconnect string `json:"reconnect,omitempty"`
+}
+
 // NewMessage creates a new message with the given type and payload
 func NewMessage(msgType MessageType, payload interface{}) (*Message, error) {
 	var rawPayload json.RawMessage
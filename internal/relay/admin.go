@@ -0,0 +1,305 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// errSubdomainReserved and errSubdomainBanned refuse subdomains
+	// operators set aside or banned
+	errSubdomainReserved = errors.New("subdomain is reserved")
+	errSubdomainBanned   = errors.New("subdomain is banned")
+)
+
+// TunnelInfo describes a connected tunnel to operators
+type TunnelInfo struct {
+	Subdomain     string    `json:"subdomain"`
+	URL           string    `json:"url"`
+	RemoteIP      string    `json:"remote_ip"`
+	Version       string    `json:"version"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	BytesIn       int64     `json:"bytes_in"`
+	BytesOut      int64     `json:"bytes_out"`
+	E2E           bool      `json:"e2e,omitempty"`
+	TCP           bool      `json:"tcp,omitempty"`
+	Port          int       `json:"port,omitempty"`
+}
+
+// Bans lists what operators banned
+type Bans struct {
+	IPs        []string `json:"ips"`
+	Subdomains []string `json:"subdomains"`
+}
+
+// Reservation is a subdomain operators set aside
+type Reservation struct {
+	Subdomain string `json:"subdomain"`
+	// Token is the registration token that may use the subdomain; it is
+	// never listed, only whether there is one
+	Token    string `json:"token,omitempty"`
+	HasToken bool   `json:"has_token"`
+}
+
+// Reserve sets subdomain aside for clients registering with token, or for
+// no one if token is empty. A client already using it keeps it until it
+// reconnects.
+func (h *Hub) Reserve(subdomain, token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reserved[subdomain] = token
+}
+
+// Unreserve makes a reserved subdomain available to anyone again, reporting
+// whether it was reserved
+func (h *Hub) Unreserve(subdomain string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.reserved[subdomain]
+	delete(h.reserved, subdomain)
+	return ok
+}
+
+// Reservations returns the reserved subdomains, without their tokens
+func (h *Hub) Reservations() []Reservation {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	reservations := make([]Reservation, 0, len(h.reserved))
+	for subdomain, token := range h.reserved {
+		reservations = append(reservations, Reservation{Subdomain: subdomain, HasToken: token != ""})
+	}
+	sort.Slice(reservations, func(i, j int) bool { return reservations[i].Subdomain < reservations[j].Subdomain })
+	return reservations
+}
+
+// BanSubdomain stops subdomain from being registered and returns the client
+// using it, if any
+func (h *Hub) BanSubdomain(subdomain string) *Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.banned[subdomain] = true
+	return h.clients[subdomain]
+}
+
+// UnbanSubdomain lifts a ban, reporting whether there was one
+func (h *Hub) UnbanSubdomain(subdomain string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ok := h.banned[subdomain]
+	delete(h.banned, subdomain)
+	return ok
+}
+
+// BannedSubdomains returns the banned subdomains in order
+func (h *Hub) BannedSubdomains() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return sortedKeys(h.banned)
+}
+
+// Tunnels describes the tunnels connected to this relay
+func (s *Server) Tunnels() []TunnelInfo {
+	now := time.Now()
+	clients := s.hub.Clients()
+	tunnels := make([]TunnelInfo, 0, len(clients))
+	for _, client := range clients {
+		tunnels = append(tunnels, TunnelInfo{
+			Subdomain:     client.Subdomain(),
+			URL:           s.publicURL(client),
+			RemoteIP:      client.RemoteIP(),
+			Version:       client.Version(),
+			ConnectedAt:   client.ConnectedAt(),
+			UptimeSeconds: int64(now.Sub(client.ConnectedAt()).Seconds()),
+			BytesIn:       client.BytesIn(),
+			BytesOut:      client.BytesOut(),
+			E2E:           client.E2E(),
+			TCP:           client.TCP(),
+			Port:          client.TCPPort(),
+		})
+	}
+	return tunnels
+}
+
+// BanIP refuses tunnels and visitors from ip and disconnects its tunnels
+func (s *Server) BanIP(ip string) {
+	s.bansMu.Lock()
+	s.bannedIPs[ip] = true
+	s.bansMu.Unlock()
+
+	for _, client := range s.hub.Clients() {
+		if client.RemoteIP() == ip {
+			log.Printf("Disconnecting %s: %s is banned", client.Subdomain(), ip)
+			client.Kick("Banned by the relay operator")
+		}
+	}
+}
+
+// UnbanIP lifts a ban, reporting whether there was one
+func (s *Server) UnbanIP(ip string) bool {
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	ok := s.bannedIPs[ip]
+	delete(s.bannedIPs, ip)
+	return ok
+}
+
+// bannedAddr reports whether the IP of a host:port address is banned
+func (s *Server) bannedAddr(addr string) bool {
+	ip := hostOf(addr)
+	s.bansMu.RLock()
+	defer s.bansMu.RUnlock()
+	return s.bannedIPs[ip]
+}
+
+// AdminHandler serves the admin API to requests with the bearer token:
+//
+//	GET    /tunnels                   connected tunnels
+//	DELETE /tunnels/{subdomain}       disconnect a tunnel
+//	GET    /bans                      banned IPs and subdomains
+//	PUT    /bans/ips/{ip}             ban an IP, disconnecting its tunnels
+//	DELETE /bans/ips/{ip}             lift an IP ban
+//	PUT    /bans/subdomains/{name}    ban a subdomain, disconnecting its tunnel
+//	DELETE /bans/subdomains/{name}    lift a subdomain ban
+//	GET    /reservations              reserved subdomains
+//	PUT    /reservations/{name}       reserve a subdomain, for {"token": ...} if given
+//	DELETE /reservations/{name}       release a reserved subdomain
+//	POST   /drain                     stop accepting tunnels and move clients,
+//	                                  to {"reconnect": ...} if given
+//	DELETE /drain                     accept tunnels again
+//
+// Bans, reservations and draining apply to this relay only.
+func (s *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Tunnels())
+	})
+	mux.HandleFunc("DELETE /tunnels/{subdomain}", func(w http.ResponseWriter, r *http.Request) {
+		client := s.hub.GetClient(r.PathValue("subdomain"))
+		if client == nil {
+			http.Error(w, "Tunnel not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Disconnecting %s by operator request", client.Subdomain())
+		client.Kick("Disconnected by the relay operator")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		s.bansMu.RLock()
+		ips := sortedKeys(s.bannedIPs)
+		s.bansMu.RUnlock()
+		writeJSON(w, Bans{IPs: ips, Subdomains: s.hub.BannedSubdomains()})
+	})
+	mux.HandleFunc("PUT /bans/ips/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(r.PathValue("ip"))
+		if ip == nil {
+			http.Error(w, "Invalid IP address", http.StatusBadRequest)
+			return
+		}
+		s.BanIP(ip.String())
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /bans/ips/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(r.PathValue("ip"))
+		if ip == nil || !s.UnbanIP(ip.String()) {
+			http.Error(w, "IP is not banned", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /bans/subdomains/{subdomain}", func(w http.ResponseWriter, r *http.Request) {
+		subdomain := r.PathValue("subdomain")
+		if !ValidSubdomain(subdomain) {
+			http.Error(w, "Invalid subdomain", http.StatusBadRequest)
+			return
+		}
+		if client := s.hub.BanSubdomain(subdomain); client != nil {
+			log.Printf("Disconnecting %s: subdomain is banned", subdomain)
+			client.Kick("Banned by the relay operator")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /bans/subdomains/{subdomain}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.hub.UnbanSubdomain(r.PathValue("subdomain")) {
+			http.Error(w, "Subdomain is not banned", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /reservations", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.hub.Reservations())
+	})
+	mux.HandleFunc("PUT /reservations/{subdomain}", func(w http.ResponseWriter, r *http.Request) {
+		subdomain := r.PathValue("subdomain")
+		if !ValidSubdomain(subdomain) {
+			http.Error(w, "Invalid subdomain", http.StatusBadRequest)
+			return
+		}
+		var reservation Reservation
+		if err := json.NewDecoder(r.Body).Decode(&reservation); err != nil && err != io.EOF {
+			http.Error(w, "Malformed reservation", http.StatusBadRequest)
+			return
+		}
+		s.hub.Reserve(subdomain, reservation.Token)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /reservations/{subdomain}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.hub.Unreserve(r.PathValue("subdomain")) {
+			http.Error(w, "Subdomain is not reserved", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		var drain struct {
+			Reconnect string `json:"reconnect"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&drain); err != nil && err != io.EOF {
+			http.Error(w, "Malformed drain request", http.StatusBadRequest)
+			return
+		}
+		log.Println("Draining: no longer accepting tunnels, moving clients")
+		s.startDrain("The relay is draining for maintenance", drain.Reconnect)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("DELETE /drain", func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Accepting tunnels again")
+		s.resume()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="relay admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
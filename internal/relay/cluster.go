@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// forwardedForHeader carries the client address of a request one relay
+	// passes on to another, and forwardedSigHeader proves a relay sent it
+	forwardedForHeader = "Filegate-Forwarded-For"
+	forwardedSigHeader = "Filegate-Forwarded-Signature"
+	// forwardedMaxAge is how far a forwarded request's signature time may be
+	// from the receiving relay's clock
+	forwardedMaxAge = time.Minute
+)
+
+// forwardSignature signs the client address of a request to host forwarded
+// at unix time t, with the secret the relays of a cluster share
+func (s *Server) forwardSignature(addr, host string, t int64) string {
+	mac := hmac.New(sha256.New, s.clusterSecret)
+	fmt.Fprintf(mac, "%d\n%s\n%s", t, addr, host)
+	return strconv.FormatInt(t, 10) + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// forwardedFor returns the client address another relay of the cluster
+// passed r on for, or "" if r didn't come from one. The headers are removed
+// either way, so nobody else can claim another address.
+func (s *Server) forwardedFor(r *http.Request) string {
+	addr := r.Header.Get(forwardedForHeader)
+	sig := r.Header.Get(forwardedSigHeader)
+	r.Header.Del(forwardedForHeader)
+	r.Header.Del(forwardedSigHeader)
+	if addr == "" || len(s.clusterSecret) == 0 {
+		return ""
+	}
+	ts, _, _ := strings.Cut(sig, ":")
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(t, 0)).Abs() > forwardedMaxAge {
+		return ""
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.forwardSignature(addr, r.Host, t))) {
+		return ""
+	}
+	return addr
+}
+
+// owner returns the URL of the other relay holding subdomain's tunnel, or ""
+// if it is held here or nowhere
+func (s *Server) owner(ctx context.Context, subdomain string) string {
+	if subdomain == "" {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, registryTimeout)
+	defer cancel()
+	node, err := s.hub.Owner(ctx, subdomain)
+	if err != nil {
+		log.Printf("Lookup of %s failed: %v", subdomain, err)
+		return ""
+	}
+	if node == s.hub.Node() {
+		return ""
+	}
+	return node
+}
+
+// forward passes a request for a tunnel held by another relay on to it
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, node string) {
+	target, err := url.Parse(node)
+	if err != nil {
+		http.Error(w, "Tunnel error: invalid relay address", http.StatusBadGateway)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+			pr.Out.Header.Set(forwardedForHeader, pr.In.RemoteAddr)
+			pr.Out.Header.Set(forwardedSigHeader, s.forwardSignature(pr.In.RemoteAddr, pr.Out.Host, time.Now().Unix()))
+			pr.Out.Header.Set("X-Forwarded-Proto", requestScheme(pr.In))
+		},
+		// Event streams must not wait for a buffer to fill
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Forwarding to %s failed: %v", node, err)
+			http.Error(w, "Tunnel error: relay holding the tunnel is unreachable", http.StatusBadGateway)
+		},
+	}
+	if bridgeable(r) {
+		// Upgrades and event streams outlive the server's timeouts
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// forwardPassthrough passes a TLS connection for a tunnel held by another
+// relay on to that relay's passthrough port
+func (s *Server) forwardPassthrough(conn net.Conn, node string) {
+	defer conn.Close()
+	target, err := url.Parse(node)
+	if err != nil {
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", net.JoinHostPort(target.Hostname(), strconv.Itoa(s.e2ePort)), 10*time.Second)
+	if err != nil {
+		log.Printf("Forwarding to %s failed: %v", node, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
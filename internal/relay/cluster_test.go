@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filegate/filegate/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const testSecret = "cluster secret"
+
+// startRelay serves a relay of a cluster sharing registry on a loopback
+// listener and returns it with its URL
+func startRelay(t *testing.T, registry Registry) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeURL := "http://" + ln.Addr().String()
+	s := NewServer(Config{Domain: "test.local", Registry: registry, NodeURL: nodeURL, ClusterSecret: testSecret})
+	hs := httptest.NewUnstartedServer(s)
+	hs.Listener.Close()
+	hs.Listener = ln
+	hs.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx, "")
+		hs.Close()
+	})
+	return s, nodeURL
+}
+
+// connectTunnel registers subdomain with the relay at relayURL and answers
+// every request with the client address the relay gives for it
+func connectTunnel(t *testing.T, relayURL, subdomain string) {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(relayURL, "http")+"/tunnel", nil)
+	if err != nil {
+		t.Fatalf("connecting the tunnel: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	send := func(msgType protocol.MessageType, payload any) {
+		msg, _ := protocol.NewMessage(msgType, payload)
+		data, _ := msg.Marshal()
+		ws.WriteMessage(websocket.TextMessage, data)
+	}
+	send(protocol.TypeRegister, protocol.RegisterPayload{Version: "test", Subdomain: subdomain})
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	if msg, err := protocol.Unmarshal(data); err != nil || msg.Type != protocol.TypeRegistered {
+		t.Fatalf("registering: %s", data)
+	}
+
+	go func() {
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := protocol.Unmarshal(data)
+			if err != nil || msg.Type != protocol.TypeHTTPRequest {
+				continue
+			}
+			var req protocol.HTTPRequestPayload
+			msg.ParsePayload(&req)
+			send(protocol.TypeHTTPResponse, protocol.HTTPResponsePayload{
+				ID:         req.ID,
+				StatusCode: http.StatusOK,
+				Body:       []byte(req.RemoteAddr),
+			})
+		}
+	}()
+}
+
+// get asks s for the tunnel of subdomain as a visitor at remoteAddr
+func get(s *Server, subdomain, remoteAddr string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "http://"+subdomain+".test.local/", nil)
+	r.RemoteAddr = remoteAddr
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestForwardToOtherRelay(t *testing.T) {
+	registry := newStandInRegistry(t)
+	a, urlA := startRelay(t, registry)
+	b, _ := startRelay(t, registry)
+	connectTunnel(t, urlA, "demo")
+
+	// B doesn't hold the tunnel, so it passes the request on to A with the
+	// visitor's address
+	w := get(b, "demo", "203.0.113.7:1234", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "203.0.113.7:1234" {
+		t.Fatalf("request through the other relay: %d %q", w.Code, w.Body)
+	}
+
+	// A's bans apply to visitors that come through B
+	a.BanIP("203.0.113.7")
+	if w := get(b, "demo", "203.0.113.7:1234", nil); w.Code != http.StatusForbidden {
+		t.Errorf("banned visitor through the other relay: %d, want 403", w.Code)
+	}
+
+	if w := get(b, "missing", "203.0.113.8:1234", nil); w.Code != http.StatusNotFound {
+		t.Errorf("request for an unknown tunnel: %d, want 404", w.Code)
+	}
+}
+
+func TestForwardedForNeedsSignature(t *testing.T) {
+	registry := newStandInRegistry(t)
+	a, urlA := startRelay(t, registry)
+	connectTunnel(t, urlA, "demo")
+	a.BanIP("203.0.113.7")
+
+	// A banned visitor can't pass as someone else
+	w := get(a, "demo", "203.0.113.7:1234", map[string]string{forwardedForHeader: "198.51.100.1:1"})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unsigned %s: %d %q, want 403", forwardedForHeader, w.Code, w.Body)
+	}
+
+	// Nor with a signature for another address, or an old one
+	now := time.Now().Unix()
+	for name, header := range map[string]map[string]string{
+		"other address": {
+			forwardedForHeader: "198.51.100.1:1",
+			forwardedSigHeader: a.forwardSignature("198.51.100.2:1", "demo.test.local", now),
+		},
+		"expired": {
+			forwardedForHeader: "198.51.100.1:1",
+			forwardedSigHeader: a.forwardSignature("198.51.100.1:1", "demo.test.local", now-3600),
+		},
+	} {
+		if w := get(a, "demo", "203.0.113.7:1234", header); w.Code != http.StatusForbidden {
+			t.Errorf("%s: %d %q, want 403", name, w.Code, w.Body)
+		}
+	}
+
+	header := map[string]string{
+		forwardedForHeader: "198.51.100.1:1",
+		forwardedSigHeader: a.forwardSignature("198.51.100.1:1", "demo.test.local", now),
+	}
+	if w := get(a, "demo", "203.0.113.7:1234", header); w.Code != http.StatusOK || w.Body.String() != "198.51.100.1:1" {
+		t.Errorf("signed %s: %d %q", forwardedForHeader, w.Code, w.Body)
+	}
+}
+
+func TestForwardedForWithoutSecret(t *testing.T) {
+	s := NewServer(Config{Domain: "test.local"})
+	defer s.Shutdown(context.Background(), "")
+
+	r := httptest.NewRequest("GET", "http://demo.test.local/", nil)
+	r.Header.Set(forwardedForHeader, "198.51.100.1:1")
+	r.Header.Set(forwardedSigHeader, s.forwardSignature("198.51.100.1:1", "demo.test.local", time.Now().Unix()))
+	if addr := s.forwardedFor(r); addr != "" {
+		t.Errorf("forwardedFor without a cluster secret = %q", addr)
+	}
+	if r.Header.Get(forwardedForHeader) != "" || r.Header.Get(forwardedSigHeader) != "" {
+		t.Error("forwarding headers not removed")
+	}
+}
@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/filegate/filegate/internal/protocol"
+)
+
+// Drain stops the relay accepting tunnels, and has /health report it
+// unavailable so load balancers send new clients elsewhere, or resumes both
+func (s *Server) Drain(draining bool) {
+	s.draining.Store(draining)
+}
+
+// Draining reports whether the relay stopped accepting tunnels
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// drainGrace is how long a drain through the admin API lets clients finish
+// their requests before disconnecting them
+const drainGrace = 30 * time.Second
+
+// errDrainCalledOff stops the client moves of a drain that was called off,
+// leaving the clients connected
+var errDrainCalledOff = errors.New("drain called off")
+
+// startDrain drains the relay for the admin API, moving clients in the
+// background until resume calls it off
+func (s *Server) startDrain(reason, reconnect string) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	s.drainMu.Lock()
+	if s.cancelDrain != nil {
+		s.cancelDrain(errDrainCalledOff)
+	}
+	s.cancelDrain = cancel
+	s.drainMu.Unlock()
+
+	s.Drain(true)
+	go func() {
+		ctx, stop := context.WithTimeout(ctx, drainGrace)
+		defer stop()
+		s.moveClients(ctx, reason, reconnect)
+	}()
+}
+
+// resume accepts tunnels again and calls off the drain startDrain began.
+// Clients already told to move do so when their connection next drops.
+func (s *Server) resume() {
+	s.drainMu.Lock()
+	if s.cancelDrain != nil {
+		s.cancelDrain(errDrainCalledOff)
+		s.cancelDrain = nil
+	}
+	s.drainMu.Unlock()
+	s.Drain(false)
+}
+
+// Shutdown drains the relay before it exits: it stops accepting tunnels and
+// moves the connected clients with moveClients, disconnecting those still
+// busy when ctx is done. It then stops renewing leases.
+func (s *Server) Shutdown(ctx context.Context, reconnect string) error {
+	defer s.hub.Close()
+	s.Drain(true)
+	return s.moveClients(ctx, "The relay is shutting down", reconnect)
+}
+
+// moveClients sends every client a going_away message telling it to
+// reconnect, to the relay tunnel URL reconnect if given. Clients keep getting
+// requests meanwhile; each is disconnected once nothing is forwarded to it,
+// or when ctx is done.
+func (s *Server) moveClients(ctx context.Context, reason, reconnect string) error {
+	for _, client := range s.hub.Clients() {
+		client.send(protocol.TypeGoingAway, protocol.GoingAwayPayload{Reason: reason, Reconnect: reconnect})
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		clients := s.hub.Clients()
+		if len(clients) == 0 {
+			return nil
+		}
+		for _, client := range clients {
+			if client.active.Load() == 0 {
+				client.Close()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(context.Cause(ctx), errDrainCalledOff) {
+				log.Println("Drain called off; keeping the remaining clients")
+				return ctx.Err()
+			}
+			for _, client := range s.hub.Clients() {
+				client.Kick("The relay shut down")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
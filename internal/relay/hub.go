@@ -2,12 +2,17 @@ package relay
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/filegate/filegate/internal/protocol"
-	"github.com/gorilla/websocket"
 )
 
 const (
@@ -21,13 +26,33 @@ const (
 
 // Client represents a connected tunnel client
 type Client struct {
-	subdomain string
-	conn      *websocket.Conn
-	mu        sync.Mutex
+	subdomain   string
+	maxBodySize int64
+	e2e         bool
+	tcp         bool
+	tcpPort     int
+	flowControl bool
+	conn        Conn
+	mu          sync.Mutex
+
+	// remoteIP, version and connectedAt describe the CLI for operators
+	remoteIP    string
+	version     string
+	connectedAt time.Time
+	// bytesIn and bytesOut count the tunnel's messages in each direction
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// active counts the requests and streams being forwarded, which a
+	// draining relay lets finish
+	active atomic.Int64
 
 	// pending tracks pending requests waiting for responses
 	pending   map[string]chan *protocol.HTTPResponsePayload
 	pendingMu sync.Mutex
+
+	// streams tracks the connections of end-to-end encrypted and TCP tunnels
+	streams   map[string]*relayStream
+	streamsMu sync.Mutex
 }
 
 // Hub manages all connected tunnel clients
@@ -36,55 +61,137 @@ type Hub struct {
 	mu      sync.RWMutex
 
 	domain string // Base domain (e.g., "davproxy.com")
+
+	// registry leases subdomains to node, this relay, so other relays
+	// know where their tunnels are
+	registry Registry
+	node     string
+
+	// reserved maps subdomains operators set aside to the token that may
+	// register them ("" if none may), and banned holds those no one may
+	reserved map[string]string
+	banned   map[string]bool
+
+	// done stops the lease renewals when the hub is closed
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// NewHub creates a new hub
-func NewHub(domain string) *Hub {
-	return &Hub{
-		clients: make(map[string]*Client),
-		domain:  domain,
+// NewHub creates a new hub that leases subdomains from registry as node. It
+// renews the leases of its clients until it is closed.
+func NewHub(domain string, registry Registry, node string) *Hub {
+	h := &Hub{
+		clients:  make(map[string]*Client),
+		domain:   domain,
+		registry: registry,
+		node:     node,
+		reserved: make(map[string]string),
+		banned:   make(map[string]bool),
+		done:     make(chan struct{}),
 	}
+	go h.renewLeases()
+	return h
 }
 
-// Register adds a new client and returns the assigned subdomain
-func (h *Hub) Register(conn *websocket.Conn) (*Client, error) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+// Close stops renewing leases. The subdomains of clients still connected
+// become free once their leases run out.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// Register adds a new client connected from remoteAddr and returns the
+// assigned subdomain. If the registration requests a subdomain, that one is
+// used, provided it is valid, free and not reserved for another token.
+func (h *Hub) Register(conn Conn, reg *protocol.RegisterPayload, remoteAddr string) (*Client, error) {
+	newClient := func(subdomain string) *Client {
+		return &Client{
+			subdomain:   subdomain,
+			maxBodySize: reg.MaxBodySize,
+			e2e:         reg.E2E,
+			tcp:         reg.TCP,
+			tcpPort:     reg.Port,
+			flowControl: reg.FlowControl,
+			conn:        conn,
+			remoteIP:    hostOf(remoteAddr),
+			version:     reg.Version,
+			connectedAt: time.Now(),
+			pending:     make(map[string]chan *protocol.HTTPResponsePayload),
+			streams:     make(map[string]*relayStream),
+		}
+	}
+
+	if requested := reg.Subdomain; requested != "" {
+		if !ValidSubdomain(requested) {
+			return nil, fmt.Errorf("invalid subdomain %q", requested)
+		}
+		client := newClient(requested)
+		if err := h.claim(client, reg.Token); err != nil {
+			switch {
+			case errors.Is(err, ErrSubdomainTaken):
+				return nil, fmt.Errorf("subdomain %q is already in use", requested)
+			case errors.Is(err, errSubdomainReserved):
+				return nil, fmt.Errorf("subdomain %q is reserved", requested)
+			case errors.Is(err, errSubdomainBanned):
+				return nil, fmt.Errorf("subdomain %q is banned", requested)
+			}
+			return nil, err
+		}
+		return client, nil
+	}
 
 	// Generate unique subdomain
-	var subdomain string
 	for i := 0; i < MaxSubdomainAttempts; i++ {
-		var err error
-		subdomain, err = GenerateSubdomain()
+		subdomain, err := GenerateSubdomain()
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate subdomain: %w", err)
 		}
-
-		if _, exists := h.clients[subdomain]; !exists {
-			break
+		client := newClient(subdomain)
+		err = h.claim(client, reg.Token)
+		if err == nil {
+			return client, nil
 		}
-
-		if i == MaxSubdomainAttempts-1 {
-			return nil, fmt.Errorf("failed to generate unique subdomain after %d attempts", MaxSubdomainAttempts)
+		if !errors.Is(err, ErrSubdomainTaken) && !errors.Is(err, errSubdomainReserved) && !errors.Is(err, errSubdomainBanned) {
+			return nil, err
 		}
 	}
+	return nil, fmt.Errorf("failed to generate unique subdomain after %d attempts", MaxSubdomainAttempts)
+}
 
-	client := &Client{
-		subdomain: subdomain,
-		conn:      conn,
-		pending:   make(map[string]chan *protocol.HTTPResponsePayload),
+// claim adds client under its subdomain if neither this relay nor another
+// has it, and operators let token have it
+func (h *Hub) claim(client *Client, token string) error {
+	h.mu.Lock()
+	if _, exists := h.clients[client.subdomain]; exists {
+		h.mu.Unlock()
+		return ErrSubdomainTaken
 	}
-
-	h.clients[subdomain] = client
-	return client, nil
+	if h.banned[client.subdomain] {
+		h.mu.Unlock()
+		return errSubdomainBanned
+	}
+	if owner, ok := h.reserved[client.subdomain]; ok && (owner == "" || owner != token) {
+		h.mu.Unlock()
+		return errSubdomainReserved
+	}
+	h.clients[client.subdomain] = client
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	if err := h.registry.Claim(ctx, client.subdomain, h.node, LeaseTTL); err != nil {
+		h.mu.Lock()
+		delete(h.clients, client.subdomain)
+		h.mu.Unlock()
+		return err
+	}
+	return nil
 }
 
 // Unregister removes a client
 func (h *Hub) Unregister(subdomain string) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	if client, exists := h.clients[subdomain]; exists {
+	client, exists := h.clients[subdomain]
+	if exists {
 		// Cancel all pending requests
 		client.pendingMu.Lock()
 		for _, ch := range client.pending {
@@ -92,9 +199,74 @@ func (h *Hub) Unregister(subdomain string) {
 		}
 		client.pending = make(map[string]chan *protocol.HTTPResponsePayload)
 		client.pendingMu.Unlock()
+		client.closeStreams()
 
 		delete(h.clients, subdomain)
 	}
+	h.mu.Unlock()
+
+	if exists {
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+		if err := h.registry.Release(ctx, subdomain, h.node); err != nil {
+			log.Printf("Failed to release %s: %v", subdomain, err)
+		}
+	}
+}
+
+// renewLeases keeps the subdomains of connected clients leased, dropping
+// clients whose lease was lost so they reconnect and claim it again
+func (h *Hub) renewLeases() {
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.done:
+			return
+		}
+		h.mu.RLock()
+		clients := make([]*Client, 0, len(h.clients))
+		for _, client := range h.clients {
+			clients = append(clients, client)
+		}
+		h.mu.RUnlock()
+
+		for _, client := range clients {
+			ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+			err := h.registry.Renew(ctx, client.subdomain, h.node, LeaseTTL)
+			cancel()
+			switch {
+			case errors.Is(err, ErrLeaseLost):
+				log.Printf("Lease on %s lost, disconnecting its client", client.subdomain)
+				client.conn.Close()
+			case err != nil:
+				log.Printf("Failed to renew %s: %v", client.subdomain, err)
+			}
+		}
+	}
+}
+
+// Owner returns the node holding subdomain's tunnel, or "" if no node does
+func (h *Hub) Owner(ctx context.Context, subdomain string) (string, error) {
+	return h.registry.Lookup(ctx, subdomain)
+}
+
+// Node returns the name this relay leases subdomains under
+func (h *Hub) Node() string {
+	return h.node
+}
+
+// Clients returns the connected clients ordered by subdomain
+func (h *Hub) Clients() []*Client {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].subdomain < clients[j].subdomain })
+	return clients
 }
 
 // GetClient returns a client by subdomain
@@ -121,6 +293,48 @@ func (c *Client) Subdomain() string {
 	return c.subdomain
 }
 
+// MaxBodySize returns the largest request body the client accepts (0 for no
+// limit)
+func (c *Client) MaxBodySize() int64 {
+	return c.maxBodySize
+}
+
+// E2E reports whether the client terminates TLS itself, so the relay only
+// forwards its connections
+func (c *Client) E2E() bool {
+	return c.e2e
+}
+
+// TCP reports whether the client forwards raw TCP connections
+func (c *Client) TCP() bool {
+	return c.tcp
+}
+
+// TCPPort returns the port allocated to a TCP tunnel, or 0
+func (c *Client) TCPPort() int {
+	return c.tcpPort
+}
+
+// RemoteIP returns the address the client connected from
+func (c *Client) RemoteIP() string {
+	return c.remoteIP
+}
+
+// Version returns the version the client registered with
+func (c *Client) Version() string {
+	return c.version
+}
+
+// ConnectedAt returns when the client registered
+func (c *Client) ConnectedAt() time.Time {
+	return c.connectedAt
+}
+
+// BytesIn and BytesOut return how much the tunnel carried from and to the
+// client
+func (c *Client) BytesIn() int64  { return c.bytesIn.Load() }
+func (c *Client) BytesOut() int64 { return c.bytesOut.Load() }
+
 // SendRequest sends an HTTP request to the client and waits for a response
 func (c *Client) SendRequest(ctx context.Context, req *protocol.HTTPRequestPayload) (*protocol.HTTPResponsePayload, error) {
 	// Create response channel
@@ -141,18 +355,7 @@ func (c *Client) SendRequest(ctx context.Context, req *protocol.HTTPRequestPaylo
 	if err != nil {
 		return nil, fmt.Errorf("failed to create message: %w", err)
 	}
-
-	data, err := msg.Marshal()
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal message: %w", err)
-	}
-
-	c.mu.Lock()
-	c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
-	err = c.conn.WriteMessage(websocket.TextMessage, data)
-	c.mu.Unlock()
-
-	if err != nil {
+	if err := c.write(msg); err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
@@ -164,8 +367,11 @@ func (c *Client) SendRequest(ctx context.Context, req *protocol.HTTPRequestPaylo
 		}
 		return resp, nil
 	case <-ctx.Done():
+		// Tell the client to stop working on it
+		c.SendCancel(req.ID, ctx.Err().Error())
 		return nil, ctx.Err()
 	case <-time.After(RequestTimeout):
+		c.SendCancel(req.ID, "request timeout")
 		return nil, fmt.Errorf("request timeout")
 	}
 }
@@ -183,22 +389,69 @@ func (c *Client) HandleResponse(resp *protocol.HTTPResponsePayload) {
 	}
 }
 
+// HandleCancel answers a pending request the client gave up on with a
+// 502 Bad Gateway
+func (c *Client) HandleCancel(cancel *protocol.CancelPayload) {
+	reason := cancel.Reason
+	if reason == "" {
+		reason = "request cancelled"
+	}
+	c.HandleResponse(&protocol.HTTPResponsePayload{
+		ID:         cancel.ID,
+		StatusCode: http.StatusBadGateway,
+		Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       []byte("Tunnel error: " + reason + "\n"),
+	})
+}
+
+// SendCancel tells the client to abandon a request
+func (c *Client) SendCancel(id, reason string) error {
+	return c.send(protocol.TypeCancel, protocol.CancelPayload{ID: id, Reason: reason})
+}
+
 // SendPong sends a pong response
 func (c *Client) SendPong() error {
 	msg, err := protocol.NewMessage(protocol.TypePong, nil)
 	if err != nil {
 		return err
 	}
+	return c.write(msg)
+}
 
+// send creates a message and sends it to the client
+func (c *Client) send(msgType protocol.MessageType, payload interface{}) error {
+	msg, err := protocol.NewMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return c.write(msg)
+}
+
+// write sends a message to the client
+func (c *Client) write(msg *protocol.Message) error {
 	data, err := msg.Marshal()
 	if err != nil {
 		return err
 	}
+	// The client would drop the whole tunnel over a message it refuses
+	if len(data) > protocol.MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes", protocol.ErrFrameTooLarge, len(data))
+	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
-	return c.conn.WriteMessage(websocket.TextMessage, data)
+	if err := c.conn.WriteMessage(data); err != nil {
+		return err
+	}
+	c.bytesOut.Add(int64(len(data)))
+	return nil
+}
+
+// Kick tells the client why the relay is dropping it and disconnects it
+func (c *Client) Kick(reason string) {
+	c.send(protocol.TypeError, protocol.ErrorPayload{Code: "disconnected", Message: reason})
+	c.conn.Close()
 }
 
 // Close closes the client connection
@@ -207,3 +460,11 @@ func (c *Client) Close() error {
 	defer c.mu.Unlock()
 	return c.conn.Close()
 }
+
+// hostOf returns the IP of a host:port address
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
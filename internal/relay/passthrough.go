@@ -0,0 +1,293 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/filegate/filegate/internal/protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	// streamChunkSize is the most stream data sent in one message. It stays
+	// below the HTTP/2 transport's side-stream threshold so chunks keep
+	// their order.
+	streamChunkSize = 32 << 10
+	// helloTimeout bounds reading a TLS ClientHello
+	helloTimeout = 10 * time.Second
+)
+
+// ServePassthrough accepts TLS connections on ln and forwards those for end-
+// to-end encrypted and TCP tunnels, picked by SNI, to their CLI without
+// decrypting them. It returns when ln is closed.
+func (s *Server) ServePassthrough(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handlePassthrough(conn)
+	}
+}
+
+func (s *Server) handlePassthrough(conn net.Conn) {
+	if s.bannedAddr(conn.RemoteAddr().String()) {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	serverName, replay, err := peekServerName(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	subdomain := s.extractSubdomain(serverName)
+	client := s.hub.GetClient(subdomain)
+	if client == nil {
+		if node := s.owner(context.Background(), subdomain); node != "" {
+			s.forwardPassthrough(replay, node)
+			return
+		}
+	}
+	if client == nil || !(client.E2E() || client.TCP()) {
+		conn.Close()
+		return
+	}
+	client.serveStream(replay, protocol.StreamPayload{})
+}
+
+// errHelloRead stops the handshake once the ClientHello is read
+var errHelloRead = errors.New("hello read")
+
+// peekServerName reads the TLS ClientHello on conn and returns the server
+// name it asks for, along with a connection that replays the hello
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var hello bytes.Buffer
+	var serverName string
+	err := tls.Server(&readOnlyConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if serverName == "" {
+		return "", nil, fmt.Errorf("no server name in TLS hello: %w", err)
+	}
+	return serverName, &replayConn{Conn: conn, r: io.MultiReader(&hello, conn)}, nil
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without answering it
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// replayConn reads the bytes already consumed before the rest of the
+// connection
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// relayStream is a connection being forwarded to a CLI
+type relayStream struct {
+	conn net.Conn
+	// out holds data from the CLI waiting to be written; nil marks the end
+	out chan []byte
+	// credit holds a token for each message the CLI may still be sent, if
+	// it does flow control
+	credit chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// wait takes the credit to send the CLI a message, reporting false if the
+// stream closed first
+func (st *relayStream) wait() bool {
+	select {
+	case <-st.credit:
+		return true
+	case <-st.done:
+		return false
+	}
+}
+
+// close closes the connection, reporting whether this call did it
+func (st *relayStream) close() bool {
+	closed := false
+	st.once.Do(func() {
+		close(st.done)
+		st.conn.Close()
+		closed = true
+	})
+	return closed
+}
+
+// writeLoop writes data from the CLI to the connection, passing ack, if
+// given, how many messages were written since it was last called
+func (st *relayStream) writeLoop(ack func(n int)) {
+	written := 0
+	for {
+		select {
+		case data := <-st.out:
+			if data == nil {
+				st.close()
+				return
+			}
+			st.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			if _, err := st.conn.Write(data); err != nil {
+				st.close()
+				return
+			}
+			written++
+			if ack != nil && (written >= protocol.StreamAckBatch || len(st.out) == 0) {
+				ack(written)
+				written = 0
+			}
+		case <-st.done:
+			return
+		}
+	}
+}
+
+// serveStream forwards conn to the client until either side closes it. open
+// is sent to the client with the stream's ID, and the remote address unless
+// it has one.
+func (c *Client) serveStream(conn net.Conn, open protocol.StreamPayload) {
+	c.active.Add(1)
+	defer c.active.Add(-1)
+
+	id := uuid.New().String()
+	st := &relayStream{
+		conn: conn,
+		// Room for a full window and the end
+		out:    make(chan []byte, protocol.StreamWindow+1),
+		credit: make(chan struct{}, protocol.StreamWindow),
+		done:   make(chan struct{}),
+	}
+	for range protocol.StreamWindow {
+		st.credit <- struct{}{}
+	}
+	c.streamsMu.Lock()
+	c.streams[id] = st
+	c.streamsMu.Unlock()
+	defer func() {
+		c.streamsMu.Lock()
+		delete(c.streams, id)
+		c.streamsMu.Unlock()
+	}()
+
+	open.ID = id
+	if open.RemoteAddr == "" {
+		open.RemoteAddr = conn.RemoteAddr().String()
+	}
+	if err := c.send(protocol.TypeStreamOpen, open); err != nil {
+		log.Printf("Stream to %s failed: %v", c.subdomain, err)
+		st.close()
+		return
+	}
+	var ack func(n int)
+	if c.flowControl {
+		ack = func(n int) {
+			c.send(protocol.TypeStreamAck, protocol.StreamPayload{ID: id, Acked: n})
+		}
+	}
+	go st.writeLoop(ack)
+
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if c.flowControl && !st.wait() {
+				break
+			}
+			data := protocol.StreamPayload{ID: id, Data: buf[:n]}
+			if c.send(protocol.TypeStreamData, data) != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Tell the client, unless it ended the stream
+	if st.close() {
+		c.send(protocol.TypeStreamClose, protocol.StreamPayload{ID: id})
+	}
+}
+
+// HandleStreamData queues data the client sent for its stream's connection
+func (c *Client) HandleStreamData(p *protocol.StreamPayload) {
+	if len(p.Data) > 0 {
+		c.deliverStream(p.ID, p.Data)
+	}
+}
+
+// HandleStreamClose closes a stream's connection once the data before it
+// is written
+func (c *Client) HandleStreamClose(p *protocol.StreamPayload) {
+	c.deliverStream(p.ID, nil)
+}
+
+// HandleStreamAck lets more data be sent on a stream the client caught up on
+func (c *Client) HandleStreamAck(p *protocol.StreamPayload) {
+	c.streamsMu.Lock()
+	st := c.streams[p.ID]
+	c.streamsMu.Unlock()
+	if st == nil {
+		return
+	}
+	for range min(p.Acked, protocol.StreamWindow) {
+		select {
+		case st.credit <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// deliverStream queues data for a stream's connection. Waiting for a slow
+// connection would hold up every other stream of the tunnel, so a stream
+// whose buffer is full is closed instead; a client doing flow control never
+// fills it.
+func (c *Client) deliverStream(id string, data []byte) {
+	c.streamsMu.Lock()
+	st := c.streams[id]
+	c.streamsMu.Unlock()
+	if st == nil {
+		return
+	}
+	select {
+	case st.out <- data:
+	default:
+		log.Printf("Closing a stream of %s: the connection fell behind", c.subdomain)
+		if st.close() {
+			c.send(protocol.TypeStreamClose, protocol.StreamPayload{ID: id})
+		}
+	}
+}
+
+// closeStreams ends every stream, e.g. when the tunnel goes away
+func (c *Client) closeStreams() {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	for _, st := range c.streams {
+		st.close()
+	}
+}
@@ -0,0 +1,289 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisKeyPrefix namespaces the registry's keys
+	redisKeyPrefix = "filegate:tunnel:"
+	// redisTimeout bounds each command, including connecting
+	redisTimeout = 5 * time.Second
+	// redisMaxIdle is how many connections are kept open between commands.
+	// Commands beyond that run at once on connections of their own.
+	redisMaxIdle = 4
+)
+
+// The lease scripts run atomically in Redis. KEYS[1] is the subdomain's key,
+// ARGV[1] the node and ARGV[2] the TTL in milliseconds.
+const (
+	claimScript = `local v = redis.call("GET", KEYS[1])
+if v == false or v == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0`
+	renewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+	releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+)
+
+// RedisRegistry is a Registry shared by relays through Redis, or anything
+// speaking its protocol (see ServeRedisStandIn)
+type RedisRegistry struct {
+	addr     string
+	username string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// redisConn is a connection to Redis, used by one command at a time
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisRegistry creates a registry for a redis://[user:password@]host:port[/db]
+// URL. It connects on first use, and keeps a few connections open so lease
+// renewals don't hold up the lookups of requests.
+func NewRedisRegistry(rawURL string) (*RedisRegistry, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid registry URL %q: expected redis://host:port", rawURL)
+	}
+	r := &RedisRegistry{addr: u.Host}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid registry database %q", db)
+		}
+	}
+	return r, nil
+}
+
+func (r *RedisRegistry) Claim(ctx context.Context, subdomain, node string, ttl time.Duration) error {
+	n, err := r.eval(ctx, claimScript, subdomain, node, ttl)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSubdomainTaken
+	}
+	return nil
+}
+
+func (r *RedisRegistry) Renew(ctx context.Context, subdomain, node string, ttl time.Duration) error {
+	n, err := r.eval(ctx, renewScript, subdomain, node, ttl)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (r *RedisRegistry) Release(ctx context.Context, subdomain, node string) error {
+	_, err := r.eval(ctx, releaseScript, subdomain, node, 0)
+	return err
+}
+
+func (r *RedisRegistry) Lookup(ctx context.Context, subdomain string) (string, error) {
+	reply, err := r.do(ctx, "GET", redisKeyPrefix+subdomain)
+	if err != nil {
+		return "", err
+	}
+	node, _ := reply.(string)
+	return node, nil
+}
+
+// eval runs a lease script, returning its integer result
+func (r *RedisRegistry) eval(ctx context.Context, script, subdomain, node string, ttl time.Duration) (int64, error) {
+	reply, err := r.do(ctx, "EVAL", script, "1", redisKeyPrefix+subdomain, node, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("registry: unexpected reply %v", reply)
+	}
+	return n, nil
+}
+
+// do sends a command on an idle connection, or a new one, and reads its
+// reply. A connection that fails is dropped.
+func (r *RedisRegistry) do(ctx context.Context, args ...string) (any, error) {
+	c, err := r.get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("registry: %w", err)
+	}
+	reply, err := c.roundTrip(ctx, args)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.conn.Close()
+	} else {
+		r.put(c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("registry: %w", err)
+	}
+	return reply, nil
+}
+
+// get takes an idle connection, or connects if there is none
+func (r *RedisRegistry) get(ctx context.Context) (*redisConn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.mu.Unlock()
+	return r.connect(ctx)
+}
+
+// put keeps a connection for the next command, or closes it if enough are
+// kept already
+func (r *RedisRegistry) put(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle) >= redisMaxIdle {
+		c.conn.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+}
+
+func (r *RedisRegistry) connect(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: redisTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	var setup [][]string
+	if r.password != "" {
+		if r.username != "" {
+			setup = append(setup, []string{"AUTH", r.username, r.password})
+		} else {
+			setup = append(setup, []string{"AUTH", r.password})
+		}
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, args := range setup {
+		if _, err := c.roundTrip(ctx, args); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) roundTrip(ctx context.Context, args []string) (any, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	if _, err := c.conn.Write(encodeCommand(args)); err != nil {
+		return nil, err
+	}
+	return readReply(c.reader)
+}
+
+// redisError is an error reply, which leaves the connection usable
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// encodeCommand encodes a command as a RESP array of bulk strings
+func encodeCommand(args []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
+
+// readReply reads one RESP reply: a string, an int64, nil, a []any or a
+// redisError
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("malformed reply %q", line)
+}
+
+// readLine reads a CRLF-terminated line without the CRLF
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
@@ -0,0 +1,103 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// LeaseTTL is how long a node owns a subdomain without renewing it, so
+	// the subdomains of a node that dies become free again
+	LeaseTTL = 30 * time.Second
+	// renewInterval is how often leases of connected tunnels are renewed
+	renewInterval = LeaseTTL / 3
+	// registryTimeout bounds each registry operation
+	registryTimeout = 5 * time.Second
+)
+
+var (
+	// ErrSubdomainTaken is returned by Registry.Claim when another node
+	// holds the subdomain
+	ErrSubdomainTaken = errors.New("subdomain is held by another relay")
+	// ErrLeaseLost is returned by Registry.Renew when the lease expired and
+	// the subdomain is no longer the node's
+	ErrLeaseLost = errors.New("subdomain lease lost")
+)
+
+// Registry records which relay node holds the tunnel of each subdomain, so
+// several relays can serve one domain. Nodes lease subdomains for a TTL and
+// renew the leases while their tunnels are connected.
+type Registry interface {
+	// Claim leases subdomain to node for ttl, or extends node's lease. It
+	// returns ErrSubdomainTaken if another node holds it.
+	Claim(ctx context.Context, subdomain, node string, ttl time.Duration) error
+	// Renew extends node's lease, returning ErrLeaseLost if node no longer
+	// holds it
+	Renew(ctx context.Context, subdomain, node string, ttl time.Duration) error
+	// Release gives up node's lease, if it still holds it
+	Release(ctx context.Context, subdomain, node string) error
+	// Lookup returns the node holding subdomain, or "" if none does
+	Lookup(ctx context.Context, subdomain string) (string, error)
+}
+
+// MemoryRegistry is a Registry for a single relay
+type MemoryRegistry struct {
+	mu     sync.Mutex
+	leases map[string]lease
+}
+
+type lease struct {
+	node    string
+	expires time.Time
+}
+
+// NewMemoryRegistry creates an empty in-process registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{leases: make(map[string]lease)}
+}
+
+// holder returns the node holding subdomain's unexpired lease, or ""
+func (r *MemoryRegistry) holder(subdomain string) string {
+	l, ok := r.leases[subdomain]
+	if !ok || time.Now().After(l.expires) {
+		return ""
+	}
+	return l.node
+}
+
+func (r *MemoryRegistry) Claim(ctx context.Context, subdomain, node string, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if holder := r.holder(subdomain); holder != "" && holder != node {
+		return ErrSubdomainTaken
+	}
+	r.leases[subdomain] = lease{node: node, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (r *MemoryRegistry) Renew(ctx context.Context, subdomain, node string, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.holder(subdomain) != node {
+		return ErrLeaseLost
+	}
+	r.leases[subdomain] = lease{node: node, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (r *MemoryRegistry) Release(ctx context.Context, subdomain, node string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.holder(subdomain) == node {
+		delete(r.leases, subdomain)
+	}
+	return nil
+}
+
+func (r *MemoryRegistry) Lookup(ctx context.Context, subdomain string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.holder(subdomain), nil
+}
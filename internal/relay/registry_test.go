@@ -0,0 +1,158 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStandInRegistry returns a RedisRegistry using a stand-in served on a
+// loopback listener
+func newStandInRegistry(t *testing.T) *RedisRegistry {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go ServeRedisStandIn(ln)
+
+	registry, err := NewRedisRegistry("redis://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestRegistryLeases(t *testing.T) {
+	for name, registry := range map[string]Registry{
+		"memory": NewMemoryRegistry(),
+		"redis":  newStandInRegistry(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			lookup := func(want string) {
+				t.Helper()
+				if node, err := registry.Lookup(ctx, "demo"); err != nil || node != want {
+					t.Errorf("Lookup = %q, %v; want %q", node, err, want)
+				}
+			}
+
+			lookup("")
+			if err := registry.Claim(ctx, "demo", "a", time.Minute); err != nil {
+				t.Fatalf("Claim: %v", err)
+			}
+			lookup("a")
+			if err := registry.Claim(ctx, "demo", "b", time.Minute); !errors.Is(err, ErrSubdomainTaken) {
+				t.Errorf("Claim of a held subdomain: %v, want ErrSubdomainTaken", err)
+			}
+			if err := registry.Claim(ctx, "demo", "a", time.Minute); err != nil {
+				t.Errorf("Claim by the holder: %v", err)
+			}
+
+			if err := registry.Renew(ctx, "demo", "a", time.Minute); err != nil {
+				t.Errorf("Renew: %v", err)
+			}
+			if err := registry.Renew(ctx, "demo", "b", time.Minute); !errors.Is(err, ErrLeaseLost) {
+				t.Errorf("Renew by another node: %v, want ErrLeaseLost", err)
+			}
+
+			// Only the holder can release a lease
+			if err := registry.Release(ctx, "demo", "b"); err != nil {
+				t.Errorf("Release by another node: %v", err)
+			}
+			lookup("a")
+			if err := registry.Release(ctx, "demo", "a"); err != nil {
+				t.Errorf("Release: %v", err)
+			}
+			lookup("")
+			if err := registry.Renew(ctx, "demo", "a", time.Minute); !errors.Is(err, ErrLeaseLost) {
+				t.Errorf("Renew after Release: %v, want ErrLeaseLost", err)
+			}
+		})
+	}
+}
+
+func TestRegistryLeaseExpiry(t *testing.T) {
+	for name, registry := range map[string]Registry{
+		"memory": NewMemoryRegistry(),
+		"redis":  newStandInRegistry(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := registry.Claim(ctx, "demo", "a", 50*time.Millisecond); err != nil {
+				t.Fatalf("Claim: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			if node, err := registry.Lookup(ctx, "demo"); err != nil || node != "" {
+				t.Errorf("Lookup of an expired lease = %q, %v", node, err)
+			}
+			if err := registry.Renew(ctx, "demo", "a", time.Minute); !errors.Is(err, ErrLeaseLost) {
+				t.Errorf("Renew of an expired lease: %v, want ErrLeaseLost", err)
+			}
+			if err := registry.Claim(ctx, "demo", "b", time.Minute); err != nil {
+				t.Errorf("Claim of an expired lease: %v", err)
+			}
+		})
+	}
+}
+
+func TestRedisRegistryConcurrentCommands(t *testing.T) {
+	registry := newStandInRegistry(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subdomain := fmt.Sprintf("demo-%d", i)
+			if err := registry.Claim(ctx, subdomain, "a", time.Minute); err != nil {
+				errs <- err
+				return
+			}
+			if node, err := registry.Lookup(ctx, subdomain); err != nil || node != "a" {
+				errs <- fmt.Errorf("Lookup(%s) = %q, %v", subdomain, node, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	registry.mu.Lock()
+	idle := len(registry.idle)
+	registry.mu.Unlock()
+	if idle > redisMaxIdle {
+		t.Errorf("%d idle connections kept, want at most %d", idle, redisMaxIdle)
+	}
+}
+
+func TestRedisRegistryReconnects(t *testing.T) {
+	registry := newStandInRegistry(t)
+	ctx := context.Background()
+	if err := registry.Claim(ctx, "demo", "a", time.Minute); err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+
+	// A dropped connection is replaced by the next command
+	registry.mu.Lock()
+	for _, c := range registry.idle {
+		c.conn.Close()
+	}
+	registry.mu.Unlock()
+	if _, err := registry.Lookup(ctx, "demo"); err == nil {
+		t.Error("Lookup on a closed connection succeeded")
+	}
+	if node, err := registry.Lookup(ctx, "demo"); err != nil || node != "a" {
+		t.Errorf("Lookup after reconnecting = %q, %v", node, err)
+	}
+}
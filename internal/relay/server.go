@@ -1,12 +1,17 @@
 package relay
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/filegate/filegate/internal/protocol"
@@ -24,9 +29,30 @@ var upgrader = websocket.Upgrader{
 
 // Server is the relay server that handles tunnel connections and HTTP proxying
 type Server struct {
-	hub    *Hub
-	mux    *http.ServeMux
-	domain string
+	hub     *Hub
+	mux     *http.ServeMux
+	domain  string
+	tokens  map[string]bool
+	e2ePort int
+	// tcpPorts allocates ports to TCP tunnels, nil if the relay has none
+	tcpPorts *tcpPorts
+	// clusterSecret signs requests passed on to other relays
+	clusterSecret []byte
+
+	// streams holds the HTTP/2 tunnels by session, for messages posted on
+	// streams of their own
+	streams   map[string]*streamConn
+	streamsMu sync.Mutex
+
+	// bannedIPs may neither open tunnels nor reach them, and draining
+	// refuses new tunnels, as set through the admin API
+	bannedIPs map[string]bool
+	bansMu    sync.RWMutex
+	draining  atomic.Bool
+	// cancelDrain calls off the client moves of a drain started through
+	// the admin API
+	cancelDrain context.CancelCauseFunc
+	drainMu     sync.Mutex
 }
 
 // Config holds configuration for the relay server
@@ -35,15 +61,55 @@ type Config struct {
 	Domain string
 	// Port is the port to listen on
 	Port int
+	// Tokens, if non-empty, are the only tokens clients may register with
+	Tokens []string
+	// E2EPort is where TLS connections for end-to-end encrypted tunnels
+	// arrive, served by ServePassthrough (0 if the relay doesn't offer them)
+	E2EPort int
+	// TCPPortMin and TCPPortMax bound the ports allocated to TCP tunnels (0
+	// if TCP tunnels are only reachable through E2EPort by SNI)
+	TCPPortMin int
+	TCPPortMax int
+	// Registry records which relay holds each tunnel (defaults to a
+	// MemoryRegistry for a single relay)
+	Registry Registry
+	// NodeURL is how other relays sharing Registry reach this one, e.g.
+	// "http://10.0.0.5:8080"
+	NodeURL string
+	// ClusterSecret is shared by the relays of a cluster to sign the client
+	// addresses of the requests they pass on to each other. Without it,
+	// client addresses from other relays aren't trusted.
+	ClusterSecret string
 }
 
 // NewServer creates a new relay server
 func NewServer(cfg Config) *Server {
-	hub := NewHub(cfg.Domain)
+	registry := cfg.Registry
+	if registry == nil {
+		registry = NewMemoryRegistry()
+	}
+	node := cfg.NodeURL
+	if node == "" {
+		node = "local"
+	}
+	hub := NewHub(cfg.Domain, registry, node)
 	s := &Server{
-		hub:    hub,
-		mux:    http.NewServeMux(),
-		domain: cfg.Domain,
+		hub:     hub,
+		mux:     http.NewServeMux(),
+		domain:  cfg.Domain,
+		tokens:  make(map[string]bool),
+		e2ePort: cfg.E2EPort,
+
+		clusterSecret: []byte(cfg.ClusterSecret),
+
+		streams:   make(map[string]*streamConn),
+		bannedIPs: make(map[string]bool),
+	}
+	if cfg.TCPPortMin > 0 && cfg.TCPPortMax >= cfg.TCPPortMin {
+		s.tcpPorts = newTCPPorts(cfg.TCPPortMin, cfg.TCPPortMax)
+	}
+	for _, token := range cfg.Tokens {
+		s.tokens[token] = true
 	}
 
 	// Register routes
@@ -59,23 +125,57 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
-// handleHealth returns server health status
+// handleHealth returns server health status, unavailable while draining
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if s.Draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, `{"status":"draining","clients":%d}`, s.hub.ClientCount())
+		return
+	}
 	fmt.Fprintf(w, `{"status":"ok","clients":%d}`, s.hub.ClientCount())
 }
 
-// handleTunnel handles WebSocket connections from CLI clients
+// handleTunnel handles tunnel connections from CLI clients, over a WebSocket
+// or an HTTP/2 stream
 func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+	var conn Conn
+	switch {
+	case websocket.IsWebSocketUpgrade(r):
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade failed: %v", err)
+			return
+		}
+		ws.SetReadLimit(protocol.MaxFrameSize)
+		conn = &wsConn{conn: ws}
+	case r.Method == "POST" && r.Header.Get("Content-Type") == protocol.StreamContentType:
+		if id := r.Header.Get(protocol.SessionHeader); id != "" {
+			s.handleStreamMessage(w, r, id)
+			return
+		}
+		stream, err := newStreamConn(w, r)
+		if err != nil {
+			log.Printf("Tunnel stream failed: %v", err)
+			return
+		}
+		s.streamsMu.Lock()
+		s.streams[stream.id] = stream
+		s.streamsMu.Unlock()
+		defer func() {
+			s.streamsMu.Lock()
+			delete(s.streams, stream.id)
+			s.streamsMu.Unlock()
+		}()
+		conn = stream
+	default:
+		http.Error(w, "Expected a WebSocket or HTTP/2 tunnel", http.StatusBadRequest)
 		return
 	}
 
 	// Wait for registration message
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	_, data, err := conn.ReadMessage()
+	data, err := conn.ReadMessage()
 	if err != nil {
 		log.Printf("Failed to read registration: %v", err)
 		conn.Close()
@@ -90,26 +190,84 @@ func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var reg protocol.RegisterPayload
+	if err := msg.ParsePayload(&reg); err != nil {
+		s.sendError(conn, "invalid_registration", "Malformed register payload")
+		conn.Close()
+		return
+	}
+
+	if s.bannedAddr(r.RemoteAddr) {
+		s.sendError(conn, "banned", "This address is banned from the relay")
+		conn.Close()
+		return
+	}
+	if s.Draining() {
+		s.sendError(conn, "draining", "The relay is not accepting tunnels right now")
+		conn.Close()
+		return
+	}
+
+	if !s.authorized(reg.Token) {
+		s.sendError(conn, "unauthorized", "Invalid or missing relay token")
+		conn.Close()
+		return
+	}
+
+	if reg.E2E && s.e2ePort == 0 {
+		s.sendError(conn, "e2e_unsupported", "This relay doesn't offer end-to-end encrypted tunnels")
+		conn.Close()
+		return
+	}
+	if reg.TCP && s.tcpPorts == nil && s.e2ePort == 0 {
+		s.sendError(conn, "tcp_unsupported", "This relay doesn't offer TCP tunnels")
+		conn.Close()
+		return
+	}
+
+	// TCP tunnels get a port of their own where the relay has some, and
+	// Register records it
+	var tcpListener net.Listener
+	if !reg.TCP || s.tcpPorts == nil {
+		reg.Port = 0
+	} else {
+		ln, port, err := s.tcpPorts.listen(reg.Port)
+		if err != nil {
+			s.sendError(conn, "registration_failed", err.Error())
+			conn.Close()
+			return
+		}
+		defer func() {
+			ln.Close()
+			s.tcpPorts.release(port)
+		}()
+		tcpListener = ln
+		reg.Port = port
+	}
+
 	// Register client
-	client, err := s.hub.Register(conn)
+	client, err := s.hub.Register(conn, &reg, r.RemoteAddr)
 	if err != nil {
 		s.sendError(conn, "registration_failed", err.Error())
 		conn.Close()
 		return
 	}
+	if tcpListener != nil {
+		go s.serveTCP(client, tcpListener)
+	}
 
 	log.Printf("Client registered: %s", client.Subdomain())
 
 	// Send registration confirmation
-	fullURL := fmt.Sprintf("https://%s.%s", client.Subdomain(), s.domain)
+	fullURL := s.publicURL(client)
 	regPayload := protocol.RegisteredPayload{
-		Subdomain: client.Subdomain(),
-		FullURL:   fullURL,
+		Subdomain:   client.Subdomain(),
+		FullURL:     fullURL,
+		Port:        client.tcpPort,
+		FlowControl: client.flowControl,
 	}
 
-	respMsg, _ := protocol.NewMessage(protocol.TypeRegistered, regPayload)
-	respData, _ := respMsg.Marshal()
-	conn.WriteMessage(websocket.TextMessage, respData)
+	client.send(protocol.TypeRegistered, regPayload)
 
 	// Handle messages from client
 	defer func() {
@@ -119,10 +277,11 @@ func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	for {
-		_, data, err := conn.ReadMessage()
+		data, err := conn.ReadMessage()
 		if err != nil {
 			return
 		}
+		client.bytesIn.Add(int64(len(data)))
 
 		msg, err := protocol.Unmarshal(data)
 		if err != nil {
@@ -135,12 +294,91 @@ func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
 			if err := msg.ParsePayload(&resp); err == nil {
 				client.HandleResponse(&resp)
 			}
+		case protocol.TypeCancel:
+			var cancel protocol.CancelPayload
+			if err := msg.ParsePayload(&cancel); err == nil {
+				client.HandleCancel(&cancel)
+			}
+		case protocol.TypeStreamData:
+			var stream protocol.StreamPayload
+			if err := msg.ParsePayload(&stream); err == nil {
+				client.HandleStreamData(&stream)
+			}
+		case protocol.TypeStreamClose:
+			var stream protocol.StreamPayload
+			if err := msg.ParsePayload(&stream); err == nil {
+				client.HandleStreamClose(&stream)
+			}
+		case protocol.TypeStreamAck:
+			var stream protocol.StreamPayload
+			if err := msg.ParsePayload(&stream); err == nil {
+				client.HandleStreamAck(&stream)
+			}
 		case protocol.TypePing:
 			client.SendPong()
 		}
 	}
 }
 
+// handleStreamMessage passes a message an HTTP/2 tunnel posted on a stream of
+// its own to the tunnel
+func (s *Server) handleStreamMessage(w http.ResponseWriter, r *http.Request, id string) {
+	s.streamsMu.Lock()
+	stream := s.streams[id]
+	s.streamsMu.Unlock()
+	if stream == nil {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	// Large responses can take longer than the server's read timeout
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+	if r.ContentLength > protocol.MaxFrameSize {
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, protocol.MaxFrameSize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read message", http.StatusBadRequest)
+		return
+	}
+	if err := stream.deliver(data, r.Context().Done()); err != nil {
+		http.Error(w, "Tunnel closed", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publicURL returns the URL a client's share is reached at. End-to-end
+// encrypted tunnels are served on the passthrough port, and TCP tunnels on
+// their own port, or by SNI on the passthrough port if they have none.
+func (s *Server) publicURL(client *Client) string {
+	if client.TCPPort() != 0 {
+		return fmt.Sprintf("tcp://%s:%d", s.domain, client.TCPPort())
+	}
+	host := client.Subdomain() + "." + s.domain
+	if (client.E2E() || client.TCP()) && s.e2ePort != 443 {
+		host = fmt.Sprintf("%s:%d", host, s.e2ePort)
+	}
+	if client.TCP() {
+		return "tls://" + host
+	}
+	return "https://" + host
+}
+
+// authorized checks a registration token against the configured tokens
+func (s *Server) authorized(token string) bool {
+	if len(s.tokens) == 0 {
+		return true
+	}
+	return s.tokens[token]
+}
+
 // handleProxy handles HTTP requests and proxies them to the appropriate client
 func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
 	// Extract subdomain from Host header
@@ -162,15 +400,69 @@ func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Find client
+	// Requests passed on by another relay carry the original client address
+	remoteAddr := r.RemoteAddr
+	forwarded := s.forwardedFor(r)
+	if forwarded != "" {
+		remoteAddr = forwarded
+	}
+	if s.bannedAddr(remoteAddr) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	client := s.hub.GetClient(subdomain)
 	if client == nil {
+		// Another relay may hold the tunnel; only pass requests on once
+		if node := s.owner(r.Context(), subdomain); node != "" && forwarded == "" {
+			s.forward(w, r, node)
+			return
+		}
 		http.Error(w, "Tunnel not found", http.StatusNotFound)
 		return
 	}
 
+	client.active.Add(1)
+	defer client.active.Add(-1)
+
+	// The CLI of an end-to-end encrypted tunnel only accepts TLS it
+	// terminates itself
+	if client.E2E() {
+		http.Error(w, "This share is end-to-end encrypted; open "+s.publicURL(client), http.StatusMisdirectedRequest)
+		return
+	}
+	if client.TCP() {
+		http.Error(w, "This is a TCP tunnel; connect to "+s.publicURL(client), http.StatusMisdirectedRequest)
+		return
+	}
+
+	// Upgrades and event streams outlive a request/response pair, so the
+	// connection is handed to the client whole
+	if bridgeable(r) {
+		s.bridge(w, r, client, remoteAddr)
+		return
+	}
+
+	// Reject bodies the client won't accept, or that don't fit in one
+	// message, before buffering them
+	limit := int64(protocol.MaxBodySize)
+	if accepted := client.MaxBodySize(); accepted > 0 && accepted < limit {
+		limit = accepted
+	}
+	if r.ContentLength > limit {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
 	// Read request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
@@ -182,6 +474,10 @@ func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
 		Path:    r.URL.RequestURI(),
 		Headers: r.Header,
 		Body:    body,
+
+		Host:       r.Host,
+		Scheme:     requestScheme(r),
+		RemoteAddr: remoteAddr,
 	}
 
 	// Send request to client and wait for response
@@ -205,6 +501,49 @@ func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp.Body)
 }
 
+// bridgeable reports whether a request should get the connection to itself:
+// WebSocket and other upgrades, and server-sent events. Only HTTP/1
+// connections without a request body can be handed over.
+func bridgeable(r *http.Request) bool {
+	if r.ProtoMajor != 1 || r.ContentLength != 0 {
+		return false
+	}
+	return r.Header.Get("Upgrade") != "" ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// bridge takes over the connection of r and forwards it, starting with r,
+// over a stream to the client's handler
+func (s *Server) bridge(w http.ResponseWriter, r *http.Request, client *Client, remoteAddr string) {
+	var req bytes.Buffer
+	if err := r.Write(&req); err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Tunnel error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	// The server's timeouts were meant for a single request
+	conn.SetDeadline(time.Time{})
+
+	client.serveStream(&replayConn{Conn: conn, r: io.MultiReader(&req, buffered)}, protocol.StreamPayload{
+		RemoteAddr: remoteAddr,
+		HTTP:       true,
+		Scheme:     requestScheme(r),
+	})
+}
+
+// requestScheme returns the scheme the public URL was requested with,
+// trusting the proxy that terminates TLS in front of the relay
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
 // extractSubdomain extracts the subdomain from a host like "brave-tiger.davproxy.com"
 func (s *Server) extractSubdomain(host string) string {
 	// Remove port if present
@@ -232,11 +571,11 @@ func (s *Server) extractSubdomain(host string) string {
 	return subdomain
 }
 
-func (s *Server) sendError(conn *websocket.Conn, code, message string) {
+func (s *Server) sendError(conn Conn, code, message string) {
 	msg, _ := protocol.NewMessage(protocol.TypeError, protocol.ErrorPayload{
 		Code:    code,
 		Message: message,
 	})
 	data, _ := msg.Marshal()
-	conn.WriteMessage(websocket.TextMessage, data)
+	conn.WriteMessage(data)
 }
@@ -0,0 +1,32 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/filegate/filegate/internal/protocol"
+)
+
+func TestProxyBodyTooLarge(t *testing.T) {
+	s, url := startRelay(t, NewMemoryRegistry())
+	connectTunnel(t, url, "demo")
+
+	// A body that can't fit in one message is refused before the relay
+	// reads it, even when the client sets no limit
+	r := httptest.NewRequest("PUT", "http://demo.test.local/a.bin", strings.NewReader("x"))
+	r.ContentLength = protocol.MaxBodySize + 1
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT past the message size: %d, want 413", w.Code)
+	}
+
+	r = httptest.NewRequest("PUT", "http://demo.test.local/a.bin", strings.NewReader("x"))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("small PUT: %d %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,215 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisStandIn is an in-memory server for the part of the Redis protocol
+// RedisRegistry uses
+type redisStandIn struct {
+	mu   sync.Mutex
+	keys map[string]standInKey
+}
+
+type standInKey struct {
+	value string
+	// expires is zero for keys without a TTL
+	expires time.Time
+}
+
+// ServeRedisStandIn serves an in-memory stand-in for Redis on ln, so several
+// relays can share a registry without running Redis, e.g. to try a
+// multi-node setup. It understands GET, SET, DEL, PEXPIRE and the
+// registry's scripts, and keeps nothing on disk. It returns when ln is
+// closed.
+func ServeRedisStandIn(ln net.Listener) error {
+	s := &redisStandIn{keys: make(map[string]standInKey)}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *redisStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, ok := reply.([]any)
+		if !ok || len(items) == 0 {
+			fmt.Fprint(conn, "-ERR expected a command array\r\n")
+			continue
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if _, err := conn.Write(s.run(args)); err != nil {
+			return
+		}
+	}
+}
+
+// run executes a command and returns the encoded reply
+func (s *redisStandIn) run(args []string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return []byte("+PONG\r\n")
+	case "AUTH", "SELECT":
+		// There is one keyspace and no users
+		return []byte("+OK\r\n")
+	case "GET":
+		if len(args) != 2 {
+			break
+		}
+		return bulkReply(s.get(args[1]))
+	case "SET":
+		if len(args) < 3 {
+			break
+		}
+		return s.set(args[1], args[2], args[3:])
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.get(key); ok {
+				n++
+			}
+			delete(s.keys, key)
+		}
+		return intReply(n)
+	case "PEXPIRE":
+		if len(args) != 3 {
+			break
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			break
+		}
+		return intReply(s.expire(args[1], ms))
+	case "EVAL":
+		if len(args) != 6 || args[2] != "1" {
+			break
+		}
+		return s.eval(args[1], args[3], args[4], args[5])
+	}
+	return []byte(fmt.Sprintf("-ERR unsupported command '%s'\r\n", args[0]))
+}
+
+// get returns a key's value if it exists and hasn't expired
+func (s *redisStandIn) get(key string) (string, bool) {
+	k, ok := s.keys[key]
+	if !ok {
+		return "", false
+	}
+	if !k.expires.IsZero() && time.Now().After(k.expires) {
+		delete(s.keys, key)
+		return "", false
+	}
+	return k.value, true
+}
+
+// set handles SET with its NX, XX and PX options
+func (s *redisStandIn) set(key, value string, opts []string) []byte {
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 0; i < len(opts); i++ {
+		switch strings.ToUpper(opts[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "PX":
+			if i+1 == len(opts) {
+				return []byte("-ERR syntax error\r\n")
+			}
+			ms, err := strconv.ParseInt(opts[i+1], 10, 64)
+			if err != nil || ms <= 0 {
+				return []byte("-ERR invalid expire time\r\n")
+			}
+			ttl = time.Duration(ms) * time.Millisecond
+			i++
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	_, exists := s.get(key)
+	if (nx && exists) || (xx && !exists) {
+		return []byte("$-1\r\n")
+	}
+	k := standInKey{value: value}
+	if ttl > 0 {
+		k.expires = time.Now().Add(ttl)
+	}
+	s.keys[key] = k
+	return []byte("+OK\r\n")
+}
+
+// expire sets a key's TTL, returning 1 if it exists
+func (s *redisStandIn) expire(key string, ms int64) int {
+	if _, ok := s.get(key); !ok {
+		return 0
+	}
+	k := s.keys[key]
+	k.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+	s.keys[key] = k
+	return 1
+}
+
+// eval runs one of RedisRegistry's lease scripts, which it recognises by
+// their text
+func (s *redisStandIn) eval(script, key, node, ttl string) []byte {
+	ms, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil {
+		return []byte("-ERR invalid TTL\r\n")
+	}
+	value, exists := s.get(key)
+	held := exists && value == node
+
+	switch script {
+	case claimScript:
+		if exists && !held {
+			return intReply(0)
+		}
+		s.keys[key] = standInKey{value: node, expires: time.Now().Add(time.Duration(ms) * time.Millisecond)}
+		return intReply(1)
+	case renewScript:
+		if !held {
+			return intReply(0)
+		}
+		return intReply(s.expire(key, ms))
+	case releaseScript:
+		if !held {
+			return intReply(0)
+		}
+		delete(s.keys, key)
+		return intReply(1)
+	}
+	return []byte("-ERR unsupported script\r\n")
+}
+
+func bulkReply(value string, ok bool) []byte {
+	if !ok {
+		return []byte("$-1\r\n")
+	}
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
+}
+
+func intReply(n int) []byte {
+	return []byte(fmt.Sprintf(":%d\r\n", n))
+}
@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/filegate/filegate/internal/protocol"
+)
+
+// tcpPorts hands out the ports TCP tunnels are reached on
+type tcpPorts struct {
+	min, max int
+
+	mu   sync.Mutex
+	used map[int]bool
+}
+
+func newTCPPorts(min, max int) *tcpPorts {
+	return &tcpPorts{min: min, max: max, used: make(map[int]bool)}
+}
+
+// listen listens on the requested port, or the first free one if requested
+// is 0
+func (p *tcpPorts) listen(requested int) (net.Listener, int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if requested != 0 {
+		if requested < p.min || requested > p.max {
+			return nil, 0, fmt.Errorf("port %d is outside %d-%d", requested, p.min, p.max)
+		}
+		if p.used[requested] {
+			return nil, 0, fmt.Errorf("port %d is already in use", requested)
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", requested))
+		if err != nil {
+			return nil, 0, fmt.Errorf("port %d is unavailable: %w", requested, err)
+		}
+		p.used[requested] = true
+		return ln, requested, nil
+	}
+
+	for port := p.min; port <= p.max; port++ {
+		if p.used[port] {
+			continue
+		}
+		// Skip ports something else on the machine took
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			continue
+		}
+		p.used[port] = true
+		return ln, port, nil
+	}
+	return nil, 0, errors.New("no free ports for TCP tunnels")
+}
+
+func (p *tcpPorts) release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, port)
+}
+
+// serveTCP forwards the connections to a TCP tunnel's port until ln is closed
+func (s *Server) serveTCP(client *Client, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if s.bannedAddr(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+		go client.serveStream(conn, protocol.StreamPayload{})
+	}
+}
@@ -0,0 +1,211 @@
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/filegate/filegate/internal/protocol"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Conn carries protocol messages between the relay and a CLI client.
+// ReadMessage and WriteMessage are each called from one goroutine at a time;
+// Close may be called concurrently with both.
+type Conn interface {
+	// ReadMessage returns the next message from the client
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends a message to the client
+	WriteMessage(data []byte) error
+	// SetReadDeadline makes ReadMessage fail after t (zero for no deadline)
+	SetReadDeadline(t time.Time) error
+	// SetWriteDeadline makes WriteMessage fail after t (zero for no deadline)
+	SetWriteDeadline(t time.Time) error
+	// Close ends the tunnel
+	Close() error
+}
+
+// wsConn carries a tunnel over a WebSocket
+type wsConn struct {
+	conn *websocket.Conn
+}
+
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	_, data, err := c.conn.ReadMessage()
+	return data, err
+}
+
+func (c *wsConn) WriteMessage(data []byte) error {
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+func (c *wsConn) Close() error                       { return c.conn.Close() }
+
+// streamConn carries a tunnel over a long-lived HTTP/2 (or full-duplex
+// HTTP/1.1) request: the request body brings messages from the client and
+// the response body takes messages to it. The client may also post large
+// messages on streams of their own, which arrive through inbound.
+type streamConn struct {
+	id string
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	frames  chan frame
+	inbound chan []byte
+	readErr error
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// writeMu keeps writes from racing the handler returning, after which
+	// the response may not be touched
+	writeMu   sync.Mutex
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// frame is a message read from the request body
+type frame struct {
+	data []byte
+	err  error
+}
+
+// newStreamConn starts the response of a tunnel request. The caller must
+// keep the handler running until the connection is closed.
+func newStreamConn(w http.ResponseWriter, r *http.Request) (*streamConn, error) {
+	rc := http.NewResponseController(w)
+	// HTTP/2 streams are always full duplex; HTTP/1.1 needs asking
+	rc.EnableFullDuplex()
+	// The tunnel outlives the server's read and write timeouts
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	c := &streamConn{
+		id:      uuid.New().String(),
+		w:       w,
+		rc:      rc,
+		frames:  make(chan frame),
+		inbound: make(chan []byte),
+		done:    make(chan struct{}),
+	}
+	w.Header().Set("Content-Type", protocol.StreamContentType)
+	w.Header().Set(protocol.SessionHeader, c.id)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+	go c.readLoop(r.Body)
+	return c, nil
+}
+
+func (c *streamConn) readLoop(body io.Reader) {
+	r := bufio.NewReader(body)
+	for {
+		data, err := protocol.ReadFrame(r)
+		select {
+		case c.frames <- frame{data: data, err: err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *streamConn) ReadMessage() ([]byte, error) {
+	if c.readErr != nil {
+		return nil, c.readErr
+	}
+
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case f := <-c.frames:
+		c.readErr = f.err
+		return f.data, f.err
+	case data := <-c.inbound:
+		return data, nil
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	case <-c.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// deliver hands a message posted on another stream to ReadMessage
+func (c *streamConn) deliver(data []byte, cancel <-chan struct{}) error {
+	select {
+	case c.inbound <- data:
+		return nil
+	case <-c.done:
+		return net.ErrClosed
+	case <-cancel:
+		return errors.New("request cancelled")
+	}
+}
+
+func (c *streamConn) WriteMessage(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	// HTTP/2 resets a stream whose write deadline passes, even while idle,
+	// so the deadline only applies during the write
+	c.rc.SetWriteDeadline(deadline)
+	defer c.rc.SetWriteDeadline(time.Time{})
+
+	if err := protocol.WriteFrame(c.w, data); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// Close ends the tunnel, interrupting a write in progress
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.rc.SetWriteDeadline(time.Now())
+		c.writeMu.Lock()
+		c.closed = true
+		c.writeMu.Unlock()
+	})
+	return nil
+}
@@ -66,3 +66,25 @@ func GenerateSubdomain() (string, error) {
 
 	return fmt.Sprintf("%s-%s", adjectives[adjIdx.Int64()], nouns[nounIdx.Int64()]), nil
 }
+
+// reservedSubdomains can't be requested by clients
+var reservedSubdomains = map[string]bool{
+	"www": true, "api": true, "admin": true, "relay": true, "tunnel": true, "health": true,
+}
+
+// ValidSubdomain reports whether name is usable as a requested subdomain: a
+// single DNS label of 3-63 lowercase letters, digits and inner hyphens
+func ValidSubdomain(name string) bool {
+	if len(name) < 3 || len(name) > 63 || reservedSubdomains[name] {
+		return false
+	}
+	if name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
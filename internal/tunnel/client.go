@@ -3,15 +3,21 @@ package tunnel
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/filegate/filegate/internal/protocol"
-	"github.com/gorilla/websocket"
 )
 
 const (
@@ -22,21 +28,63 @@ const (
 	initialReconnectDelay = 1 * time.Second
 	maxReconnectDelay     = 30 * time.Second
 	reconnectMultiplier   = 2.0
+	// stickyAttempts is how many reconnects ask for the previous subdomain
+	// (and TCP port) before taking any, so the URL survives dropped
+	// connections
+	stickyAttempts = 5
 
 	// Ping/pong settings
 	pingInterval = 30 * time.Second
 	pongWait     = 10 * time.Second
 )
 
+// errGoingAway ends a connection the relay asked the client to move from
+var errGoingAway = errors.New("relay is going away")
+
+// maxResponseBody is the largest response body sent back to the relay
+var maxResponseBody = protocol.MaxBodySize
+
+// relayError is an error message from the relay
+type relayError protocol.ErrorPayload
+
+func (e *relayError) Error() string { return "server error: " + e.Message }
+
 // Client manages the WebSocket connection to the relay server
 type Client struct {
-	relayURL string
-	handler  http.Handler
-	conn     *websocket.Conn
-	mu       sync.Mutex
+	relayURL    string
+	token       string
+	requested   string
+	maxBodySize int64
+	handler     http.Handler
+	network     *Network
+	transport   Transport
+	conn        Conn
+	mu          sync.Mutex
 
 	subdomain string
 	fullURL   string
+	// previous is the subdomain to ask for again after a reconnect
+	previous       string
+	stickyFailures int
+	// previousPort is the relay port of a TCP tunnel to ask for again
+	requestedPort int
+	previousPort  int
+
+	// inflight cancels the requests being handled, by request ID
+	inflight   map[string]context.CancelFunc
+	inflightMu sync.Mutex
+
+	// e2e and TCP tunnels get streams instead of HTTP requests
+	e2e       bool
+	tcp       bool
+	listener  *streamListener
+	streams   map[string]*stream
+	streamsMu sync.Mutex
+	// httpStreams are connections the relay handed over for requests that
+	// outlive a request/response pair, served with handler
+	httpStreams *streamListener
+	// flowControl is set when the relay acknowledges stream data
+	flowControl bool
 
 	onConnected    func(subdomain, fullURL string)
 	onDisconnected func(err error)
@@ -45,10 +93,30 @@ type Client struct {
 
 // Config holds configuration for the tunnel client
 type Config struct {
-	// RelayURL is the WebSocket URL of the relay server (e.g., "wss://davproxy.com/tunnel")
+	// RelayURL is the tunnel URL of the relay server (e.g.,
+	// "wss://davproxy.com/tunnel", or "https://davproxy.com/tunnel" for HTTP/2)
 	RelayURL string
+	// Network sets proxies and TLS for the default transports
+	Network *Network
+	// Transport opens the tunnel (defaults to TransportFor(RelayURL, Network))
+	Transport Transport
+	// Token authenticates with relays that require it
+	Token string
+	// Subdomain requests a specific subdomain (a random one is assigned if empty)
+	Subdomain string
+	// MaxBodySize asks the relay to reject larger request bodies (0 for no limit)
+	MaxBodySize int64
 	// Handler is the HTTP handler (WebDAV server) to forward requests to
 	Handler http.Handler
+	// E2E has the relay forward TLS connections unopened instead of sending
+	// HTTP requests. They are accepted from Listener, and the caller
+	// terminates TLS.
+	E2E bool
+	// TCP asks for a raw TCP tunnel. Connections are accepted from Listener
+	// like those of E2E tunnels.
+	TCP bool
+	// Port requests a specific relay port for a TCP tunnel
+	Port int
 	// OnConnected is called when connection is established
 	OnConnected func(subdomain, fullURL string)
 	// OnDisconnected is called when connection is lost
@@ -61,7 +129,19 @@ type Config struct {
 func New(cfg Config) *Client {
 	return &Client{
 		relayURL:       cfg.RelayURL,
+		token:          cfg.Token,
+		requested:      cfg.Subdomain,
+		maxBodySize:    cfg.MaxBodySize,
 		handler:        cfg.Handler,
+		network:        cfg.Network,
+		transport:      cfg.Transport,
+		inflight:       make(map[string]context.CancelFunc),
+		e2e:            cfg.E2E,
+		tcp:            cfg.TCP,
+		requestedPort:  cfg.Port,
+		listener:       newStreamListener(),
+		httpStreams:    newStreamListener(),
+		streams:        make(map[string]*stream),
 		onConnected:    cfg.OnConnected,
 		onDisconnected: cfg.OnDisconnected,
 		onReconnecting: cfg.OnReconnecting,
@@ -70,9 +150,44 @@ func New(cfg Config) *Client {
 
 // Connect establishes a connection to the relay server and blocks until closed
 func (c *Client) Connect(ctx context.Context) error {
+	if c.transport == nil {
+		transport, err := TransportFor(c.relayURL, c.network)
+		if err != nil {
+			return err
+		}
+		c.transport = transport
+	}
+
+	if c.handler != nil {
+		srv := c.streamServer()
+		go srv.Serve(c.httpStreams)
+		defer srv.Close()
+	}
 	return c.connectWithRetry(ctx)
 }
 
+// streamServer serves the HTTP streams, such as WebSocket upgrades, that the
+// relay hands over
+func (c *Client) streamServer() *http.Server {
+	return &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Tell the handler the public scheme, as handleHTTPRequest does
+			if s, ok := r.Context().Value(streamKey{}).(*stream); ok && s.scheme == "https" {
+				r = r.WithContext(r.Context())
+				r.TLS = &tls.ConnectionState{}
+			}
+			c.handler.ServeHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, streamKey{}, conn)
+		},
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+}
+
+// streamKey holds the stream of a request in its context
+type streamKey struct{}
+
 func (c *Client) connectWithRetry(ctx context.Context) error {
 	delay := initialReconnectDelay
 	attempt := 0
@@ -94,10 +209,19 @@ func (c *Client) connectWithRetry(ctx context.Context) error {
 			c.onDisconnected(err)
 		}
 
+		// A relay going away asked for the reconnect, so there is nothing to
+		// back off from
+		if errors.Is(err, errGoingAway) {
+			attempt = 0
+			delay = initialReconnectDelay
+		}
 		attempt++
 		if c.onReconnecting != nil {
 			c.onReconnecting(attempt)
 		}
+		if errors.Is(err, errGoingAway) {
+			continue
+		}
 
 		// Wait before reconnecting
 		select {
@@ -116,8 +240,7 @@ func (c *Client) connectWithRetry(ctx context.Context) error {
 
 func (c *Client) connectOnce(ctx context.Context) error {
 	// Connect to relay
-	dialer := websocket.DefaultDialer
-	conn, _, err := dialer.DialContext(ctx, c.relayURL, nil)
+	conn, err := c.transport.Dial(ctx, c.relayURL)
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
@@ -133,6 +256,16 @@ func (c *Client) connectOnce(ctx context.Context) error {
 		c.mu.Unlock()
 	}()
 
+	// Unblock reads when the caller cancels
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Requests handled on this connection stop when it closes, as their
+	// responses can't be delivered anymore
+	connCtx, cancelRequests := context.WithCancel(ctx)
+	defer cancelRequests()
+	defer c.closeStreams()
+
 	// Send registration
 	if err := c.register(); err != nil {
 		return fmt.Errorf("registration failed: %w", err)
@@ -140,6 +273,17 @@ func (c *Client) connectOnce(ctx context.Context) error {
 
 	// Wait for registration confirmation
 	if err := c.waitForRegistered(); err != nil {
+		// The relay may still hold the old connection; give up on the
+		// previous subdomain after a few tries. A draining relay refuses
+		// every tunnel, so that doesn't count.
+		var relayErr *relayError
+		draining := errors.As(err, &relayErr) && relayErr.Code == "draining"
+		if c.requested == "" && c.previous != "" && !draining {
+			if c.stickyFailures++; c.stickyFailures >= stickyAttempts {
+				c.previous = ""
+				c.previousPort = 0
+			}
+		}
 		return fmt.Errorf("registration confirmation failed: %w", err)
 	}
 
@@ -149,15 +293,22 @@ func (c *Client) connectOnce(ctx context.Context) error {
 	}
 
 	// Start ping goroutine
-	go c.pingLoop(ctx)
+	go c.pingLoop(connCtx)
 
 	// Handle messages
-	return c.handleMessages(ctx)
+	return c.handleMessages(connCtx)
 }
 
 func (c *Client) register() error {
 	msg, err := protocol.NewMessage(protocol.TypeRegister, protocol.RegisterPayload{
-		Version: Version,
+		Version:     Version,
+		Token:       c.token,
+		Subdomain:   c.subdomainToRequest(),
+		MaxBodySize: c.maxBodySize,
+		E2E:         c.e2e,
+		TCP:         c.tcp,
+		Port:        c.portToRequest(),
+		FlowControl: true,
 	})
 	if err != nil {
 		return err
@@ -170,7 +321,24 @@ func (c *Client) register() error {
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.conn.WriteMessage(websocket.TextMessage, data)
+	return c.conn.WriteMessage(data)
+}
+
+// subdomainToRequest returns the configured subdomain, or the one from the
+// previous connection so clients can keep using the same URL
+func (c *Client) subdomainToRequest() string {
+	if c.requested != "" {
+		return c.requested
+	}
+	return c.previous
+}
+
+// portToRequest is like subdomainToRequest for the port of a TCP tunnel
+func (c *Client) portToRequest() int {
+	if c.requestedPort != 0 {
+		return c.requestedPort
+	}
+	return c.previousPort
 }
 
 func (c *Client) waitForRegistered() error {
@@ -182,7 +350,7 @@ func (c *Client) waitForRegistered() error {
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	defer conn.SetReadDeadline(time.Time{})
 
-	_, data, err := conn.ReadMessage()
+	data, err := conn.ReadMessage()
 	if err != nil {
 		return err
 	}
@@ -193,9 +361,9 @@ func (c *Client) waitForRegistered() error {
 	}
 
 	if msg.Type == protocol.TypeError {
-		var errPayload protocol.ErrorPayload
+		var errPayload relayError
 		msg.ParsePayload(&errPayload)
-		return fmt.Errorf("server error: %s", errPayload.Message)
+		return &errPayload
 	}
 
 	if msg.Type != protocol.TypeRegistered {
@@ -209,11 +377,18 @@ func (c *Client) waitForRegistered() error {
 
 	c.subdomain = payload.Subdomain
 	c.fullURL = payload.FullURL
+	c.previous = payload.Subdomain
+	c.previousPort = payload.Port
+	c.flowControl = payload.FlowControl
+	c.stickyFailures = 0
 
 	return nil
 }
 
 func (c *Client) handleMessages(ctx context.Context) error {
+	// away is set once the relay asked the client to move. The relay keeps
+	// sending requests and closes the connection when they are done.
+	var away *protocol.GoingAwayPayload
 	for {
 		select {
 		case <-ctx.Done():
@@ -229,8 +404,17 @@ func (c *Client) handleMessages(ctx context.Context) error {
 			return fmt.Errorf("connection closed")
 		}
 
-		_, data, err := conn.ReadMessage()
+		data, err := conn.ReadMessage()
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if away != nil {
+				if away.Reason != "" {
+					return fmt.Errorf("%w: %s", errGoingAway, away.Reason)
+				}
+				return errGoingAway
+			}
 			return err
 		}
 
@@ -241,7 +425,32 @@ func (c *Client) handleMessages(ctx context.Context) error {
 
 		switch msg.Type {
 		case protocol.TypeHTTPRequest:
-			go c.handleHTTPRequest(msg)
+			if c.e2e || c.tcp {
+				// There is no HTTP handler, or the relay must not see the
+				// share's content, so refuse to answer
+				var req protocol.HTTPRequestPayload
+				if msg.ParsePayload(&req) == nil {
+					c.send(protocol.TypeCancel, protocol.CancelPayload{ID: req.ID, Reason: "tunnel only accepts streams"})
+				}
+				continue
+			}
+			go c.handleHTTPRequest(ctx, msg)
+		case protocol.TypeStreamOpen, protocol.TypeStreamData, protocol.TypeStreamClose, protocol.TypeStreamAck:
+			var payload protocol.StreamPayload
+			if err := msg.ParsePayload(&payload); err == nil {
+				c.handleStream(msg.Type, &payload)
+			}
+		case protocol.TypeCancel:
+			var cancel protocol.CancelPayload
+			if err := msg.ParsePayload(&cancel); err == nil {
+				c.cancelRequest(cancel.ID)
+			}
+		case protocol.TypeGoingAway:
+			if away == nil {
+				away = &protocol.GoingAwayPayload{}
+				msg.ParsePayload(away)
+				c.moveTo(away.Reconnect)
+			}
 		case protocol.TypePong:
 			// Pong received, connection is healthy
 		case protocol.TypeError:
@@ -252,14 +461,77 @@ func (c *Client) handleMessages(ctx context.Context) error {
 	}
 }
 
-func (c *Client) handleHTTPRequest(msg *protocol.Message) {
+// moveTo switches to the relay tunnel URL a relay going away sent the client
+// to, if any. A relay reached over TLS can't move the client to one without.
+func (c *Client) moveTo(relayURL string) {
+	if relayURL == "" || relayURL == c.relayURL {
+		return
+	}
+	next, err := url.Parse(relayURL)
+	if err != nil {
+		log.Printf("Ignoring the relay to move to: %v", err)
+		return
+	}
+	if current, err := url.Parse(c.relayURL); err == nil && secureScheme(current.Scheme) && !secureScheme(next.Scheme) {
+		log.Printf("Ignoring the relay to move to: %s isn't encrypted like %s", relayURL, c.relayURL)
+		return
+	}
+	// A transport the caller chose is kept; the default ones follow the
+	// URL's scheme
+	switch c.transport.(type) {
+	case *WebSocketTransport, *HTTP2Transport:
+		transport, err := TransportFor(relayURL, c.network)
+		if err != nil {
+			log.Printf("Ignoring the relay to move to: %v", err)
+			return
+		}
+		c.transport = transport
+	}
+	log.Printf("Moving to relay %s", relayURL)
+	c.relayURL = relayURL
+}
+
+// secureScheme reports whether a relay URL scheme uses TLS
+func secureScheme(scheme string) bool {
+	return scheme == "wss" || scheme == "https"
+}
+
+func (c *Client) handleHTTPRequest(ctx context.Context, msg *protocol.Message) {
 	var reqPayload protocol.HTTPRequestPayload
 	if err := msg.ParsePayload(&reqPayload); err != nil {
 		return
 	}
 
-	// Create HTTP request
-	req := httptest.NewRequest(reqPayload.Method, reqPayload.Path, bytes.NewReader(reqPayload.Body))
+	ctx, cancel := context.WithCancel(ctx)
+	c.inflightMu.Lock()
+	c.inflight[reqPayload.ID] = cancel
+	c.inflightMu.Unlock()
+	defer func() {
+		c.inflightMu.Lock()
+		delete(c.inflight, reqPayload.ID)
+		c.inflightMu.Unlock()
+		cancel()
+	}()
+
+	// A panicking handler fails the request instead of the whole tunnel, as
+	// net/http does for local servers
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic serving %s %s: %v\n%s", reqPayload.Method, reqPayload.Path, r, debug.Stack())
+			c.send(protocol.TypeCancel, protocol.CancelPayload{ID: reqPayload.ID, Reason: "internal error"})
+		}
+	}()
+
+	// Create HTTP request, for the public URL if the relay says what it is
+	target := reqPayload.Path
+	if reqPayload.Host != "" && reqPayload.Scheme != "" && strings.HasPrefix(reqPayload.Path, "/") {
+		target = reqPayload.Scheme + "://" + reqPayload.Host + reqPayload.Path
+	}
+	req := httptest.NewRequest(reqPayload.Method, target, &contextReader{ctx: ctx, r: bytes.NewReader(reqPayload.Body)})
+	req = req.WithContext(ctx)
+	if reqPayload.RemoteAddr != "" {
+		req.RemoteAddr = reqPayload.RemoteAddr
+	}
 	for key, values := range reqPayload.Headers {
 		for _, value := range values {
 			req.Header.Add(key, value)
@@ -270,36 +542,162 @@ func (c *Client) handleHTTPRequest(msg *protocol.Message) {
 	rec := httptest.NewRecorder()
 
 	// Handle the request with WebDAV server
-	c.handler.ServeHTTP(rec, req)
+	c.handler.ServeHTTP(&contextWriter{ResponseWriter: rec, ctx: ctx}, req)
+
+	// Nobody is waiting for the response of a cancelled request
+	if ctx.Err() != nil {
+		return
+	}
 
 	// Read response body
 	respBody, _ := io.ReadAll(rec.Body)
 
+	// A response too large for one message fails on its own instead of
+	// taking the tunnel down with it
+	if len(respBody) > maxResponseBody {
+		log.Printf("%s %s: response of %d bytes is too large for the tunnel", reqPayload.Method, reqPayload.Path, len(respBody))
+		c.send(protocol.TypeHTTPResponse, protocol.HTTPResponsePayload{
+			ID:         reqPayload.ID,
+			StatusCode: http.StatusBadGateway,
+			Headers:    http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       []byte("Response too large\n"),
+		})
+		return
+	}
+
 	// Send response back
-	respPayload := protocol.HTTPResponsePayload{
+	c.send(protocol.TypeHTTPResponse, protocol.HTTPResponsePayload{
 		ID:         reqPayload.ID,
 		StatusCode: rec.Code,
 		Headers:    rec.Header(),
 		Body:       respBody,
+	})
+}
+
+// cancelRequest stops the handler working on a request the relay abandoned
+func (c *Client) cancelRequest(id string) {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	if cancel, ok := c.inflight[id]; ok {
+		cancel()
 	}
+}
 
-	respMsg, err := protocol.NewMessage(protocol.TypeHTTPResponse, respPayload)
+// send writes a message to the relay, if connected
+func (c *Client) send(msgType protocol.MessageType, payload interface{}) error {
+	msg, err := protocol.NewMessage(msgType, payload)
 	if err != nil {
-		return
+		return err
 	}
 
-	data, err := respMsg.Marshal()
+	data, err := msg.Marshal()
 	if err != nil {
-		return
+		return err
+	}
+	// The relay would drop the whole tunnel over a message it refuses
+	if len(data) > protocol.MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes", protocol.ErrFrameTooLarge, len(data))
 	}
 
+	// Writes happen outside the lock so a large response doesn't hold up
+	// the others
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.conn != nil {
-		c.conn.WriteMessage(websocket.TextMessage, data)
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	return conn.WriteMessage(data)
+}
+
+// handleStream opens, feeds or ends a stream
+func (c *Client) handleStream(msgType protocol.MessageType, p *protocol.StreamPayload) {
+	if msgType == protocol.TypeStreamOpen {
+		listener := c.listener
+		if p.HTTP {
+			listener = c.httpStreams
+		}
+		if (p.HTTP && c.handler == nil) || (!p.HTTP && !c.e2e && !c.tcp) {
+			c.send(protocol.TypeStreamClose, protocol.StreamPayload{ID: p.ID})
+			return
+		}
+		s := newStream(c, p)
+		c.streamsMu.Lock()
+		c.streams[p.ID] = s
+		c.streamsMu.Unlock()
+		go listener.offer(s)
+		return
+	}
+
+	c.streamsMu.Lock()
+	s := c.streams[p.ID]
+	c.streamsMu.Unlock()
+	if s == nil {
+		return
+	}
+	switch {
+	case msgType == protocol.TypeStreamClose:
+		s.deliver(nil)
+	case msgType == protocol.TypeStreamAck:
+		s.acked(p.Acked)
+	case len(p.Data) > 0:
+		s.deliver(p.Data)
 	}
 }
 
+func (c *Client) removeStream(id string) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	delete(c.streams, id)
+}
+
+// closeStreams ends the streams of a tunnel connection that went away
+func (c *Client) closeStreams() {
+	c.streamsMu.Lock()
+	streams := make([]*stream, 0, len(c.streams))
+	for _, s := range c.streams {
+		streams = append(streams, s)
+	}
+	c.streamsMu.Unlock()
+	for _, s := range streams {
+		s.Close()
+	}
+}
+
+// Listener returns the connections of an E2E or TCP tunnel. Closing it stops
+// accepting them.
+func (c *Client) Listener() net.Listener {
+	return c.listener
+}
+
+// contextReader fails reads once its request is cancelled, so handlers stop
+// writing uploads nobody will get a response for
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextWriter fails writes once its request is cancelled, so handlers stop
+// reading files into the response
+type contextWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(p)
+}
+
 func (c *Client) pingLoop(ctx context.Context) {
 	ticker := time.NewTicker(pingInterval)
 	defer ticker.Stop()
@@ -315,21 +713,7 @@ func (c *Client) pingLoop(ctx context.Context) {
 }
 
 func (c *Client) sendPing() {
-	msg, err := protocol.NewMessage(protocol.TypePing, nil)
-	if err != nil {
-		return
-	}
-
-	data, err := msg.Marshal()
-	if err != nil {
-		return
-	}
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.conn != nil {
-		c.conn.WriteMessage(websocket.TextMessage, data)
-	}
+	c.send(protocol.TypePing, nil)
 }
 
 // Close closes the connection
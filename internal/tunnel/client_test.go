@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filegate/filegate/internal/protocol"
+)
+
+// recordConn keeps the messages written to it
+type recordConn struct {
+	mu       sync.Mutex
+	messages [][]byte
+}
+
+func (c *recordConn) ReadMessage() ([]byte, error)      { select {} }
+func (c *recordConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *recordConn) Close() error                      { return nil }
+
+func (c *recordConn) WriteMessage(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, data)
+	return nil
+}
+
+func TestResponseTooLarge(t *testing.T) {
+	defer func(limit int) { maxResponseBody = limit }(maxResponseBody)
+	maxResponseBody = 10
+
+	c := New(Config{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	})})
+	conn := &recordConn{}
+	c.conn = conn
+
+	for path, want := range map[string]int{
+		"/small":                  http.StatusOK,
+		"/much-too-large-to-send": http.StatusBadGateway,
+	} {
+		msg, err := protocol.NewMessage(protocol.TypeHTTPRequest, protocol.HTTPRequestPayload{ID: path, Method: "GET", Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.messages = nil
+		c.handleHTTPRequest(context.Background(), msg)
+
+		if len(conn.messages) != 1 {
+			t.Fatalf("GET %s: %d messages sent, want 1", path, len(conn.messages))
+		}
+		reply, err := protocol.Unmarshal(conn.messages[0])
+		if err != nil || reply.Type != protocol.TypeHTTPResponse {
+			t.Fatalf("GET %s: reply %s", path, conn.messages[0])
+		}
+		var resp protocol.HTTPResponsePayload
+		reply.ParsePayload(&resp)
+		if resp.ID != path || resp.StatusCode != want {
+			t.Errorf("GET %s: %s %d, want %d", path, resp.ID, resp.StatusCode, want)
+		}
+	}
+}
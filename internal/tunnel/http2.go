@@ -0,0 +1,207 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/filegate/filegate/internal/protocol"
+)
+
+// sideStreamThreshold is the size above which a message gets its own HTTP/2
+// stream instead of queueing on the tunnel stream
+const sideStreamThreshold = 64 << 10
+
+// HTTP2Transport carries the tunnel over HTTP/2, which gets through proxies
+// that mangle WebSockets. One long-lived POST carries messages both ways, and
+// large messages from the CLI, such as file downloads, are posted on streams
+// of their own so they don't hold up everything else. http:// URLs speak
+// HTTP/2 without TLS.
+type HTTP2Transport struct {
+	// Client makes the requests (defaults to one suited to the URL and
+	// Network)
+	Client *http.Client
+	// Network sets proxies and TLS (nil uses the defaults)
+	Network *Network
+}
+
+// Dial opens the tunnel stream
+func (t *HTTP2Transport) Dial(ctx context.Context, relayURL string) (Conn, error) {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return nil, err
+	}
+	client := t.Client
+	if client == nil {
+		client = newHTTP2Client(u.Scheme, t.Network)
+	}
+
+	// The stream outlives ctx, which only bounds the dial
+	connCtx, cancel := context.WithCancel(context.Background())
+	up, upWriter := io.Pipe()
+	req, err := http.NewRequestWithContext(connCtx, "POST", relayURL, up)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", protocol.StreamContentType)
+
+	stop := context.AfterFunc(ctx, cancel)
+	resp, err := client.Do(req)
+	stop()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("relay answered %s", resp.Status)
+	}
+
+	c := &http2Conn{
+		client:  client,
+		url:     relayURL,
+		session: resp.Header.Get(protocol.SessionHeader),
+		up:      upWriter,
+		frames:  make(chan frame),
+		ctx:     connCtx,
+		cancel:  cancel,
+	}
+	go c.readLoop(resp.Body)
+	return c, nil
+}
+
+// newHTTP2Client returns a client that prefers HTTP/2, falling back to
+// HTTP/1.1 over TLS when a proxy insists
+func newHTTP2Client(scheme string, network *Network) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = network.proxy()
+	transport.TLSClientConfig = network.tlsConfig()
+	if scheme == "http" {
+		// Without TLS there is nothing to negotiate with, so speak HTTP/2
+		// directly
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = &protocols
+	}
+	return &http.Client{Transport: transport}
+}
+
+// frame is a message read from the tunnel stream
+type frame struct {
+	data []byte
+	err  error
+}
+
+// http2Conn is a tunnel over HTTP/2 streams
+type http2Conn struct {
+	client  *http.Client
+	url     string
+	session string
+
+	up      *io.PipeWriter
+	writeMu sync.Mutex
+
+	frames   chan frame
+	readErr  error
+	mu       sync.Mutex
+	deadline time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// readLoop hands messages from the response body to ReadMessage
+func (c *http2Conn) readLoop(body io.ReadCloser) {
+	defer body.Close()
+	r := bufio.NewReader(body)
+	for {
+		data, err := protocol.ReadFrame(r)
+		select {
+		case c.frames <- frame{data: data, err: err}:
+		case <-c.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *http2Conn) ReadMessage() ([]byte, error) {
+	if c.readErr != nil {
+		return nil, c.readErr
+	}
+
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case f := <-c.frames:
+		c.readErr = f.err
+		return f.data, f.err
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	case <-c.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (c *http2Conn) WriteMessage(data []byte) error {
+	if len(data) > sideStreamThreshold && c.session != "" {
+		return c.post(data)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return protocol.WriteFrame(c.up, data)
+}
+
+// post sends a message on its own stream
+func (c *http2Conn) post(data []byte) error {
+	req, err := http.NewRequestWithContext(c.ctx, "POST", c.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", protocol.StreamContentType)
+	req.Header.Set(protocol.SessionHeader, c.session)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("relay answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *http2Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+// Close ends the tunnel stream and any messages still being posted
+func (c *http2Conn) Close() error {
+	c.cancel()
+	c.up.CloseWithError(net.ErrClosed)
+	return nil
+}
@@ -0,0 +1,150 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// NetworkConfig sets how the tunnel reaches the relay
+type NetworkConfig struct {
+	// Proxy is an http:// or socks5:// proxy URL, with user:password@ for
+	// authentication (defaults to HTTPS_PROXY, HTTP_PROXY and NO_PROXY)
+	Proxy string
+	// CAFile is a PEM bundle of root certificates to trust besides the
+	// system ones, e.g. a corporate CA
+	CAFile string
+	// CertFile and KeyFile hold a PEM client certificate and key for mutual
+	// TLS with the relay
+	CertFile string
+	KeyFile  string
+	// Pins are SHA-256 hashes of public keys, base64 encoded with an optional
+	// "sha256/" prefix. The relay's certificate chain must contain one.
+	Pins []string
+}
+
+// Network is how transports reach the relay. The zero value connects
+// directly or through the proxy environment variables, with the system's
+// root certificates.
+type Network struct {
+	// Proxy returns the proxy for a request (nil uses the environment)
+	Proxy func(*http.Request) (*url.URL, error)
+	// TLS configures connections to the relay (nil uses the defaults)
+	TLS *tls.Config
+}
+
+// NewNetwork loads the certificates and proxy a NetworkConfig names
+func NewNetwork(cfg NetworkConfig) (*Network, error) {
+	n := &Network{}
+
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q (use http:// or socks5://)", proxyURL.Scheme)
+		}
+		n.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" && len(cfg.Pins) == 0 {
+		return n, nil
+	}
+	n.TLS = &tls.Config{}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		n.TLS.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		n.TLS.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.Pins) > 0 {
+		pins, err := parsePins(cfg.Pins)
+		if err != nil {
+			return nil, err
+		}
+		n.TLS.VerifyConnection = func(cs tls.ConnectionState) error {
+			return checkPins(cs, pins)
+		}
+	}
+	return n, nil
+}
+
+// proxy returns the proxy function transports should use
+func (n *Network) proxy() func(*http.Request) (*url.URL, error) {
+	if n == nil || n.Proxy == nil {
+		return http.ProxyFromEnvironment
+	}
+	return n.Proxy
+}
+
+// tlsConfig returns a copy of the TLS configuration, or nil for the defaults
+func (n *Network) tlsConfig() *tls.Config {
+	if n == nil || n.TLS == nil {
+		return nil
+	}
+	return n.TLS.Clone()
+}
+
+// parsePins decodes public key pins
+func parsePins(values []string) ([][]byte, error) {
+	var pins [][]byte
+	for _, value := range values {
+		encoded := strings.TrimLeft(strings.TrimPrefix(value, "sha256/"), "/")
+		pin, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q: expected a base64 SHA-256 hash", value)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// checkPins accepts a connection whose verified certificate chain contains
+// one of the pinned public keys. Only verified chains count: the relay can
+// send any extra certificates it likes, so a pinned key among them proves
+// nothing.
+func checkPins(cs tls.ConnectionState, pins [][]byte) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("relay certificate doesn't match any pinned public key")
+}
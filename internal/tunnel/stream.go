@@ -0,0 +1,246 @@
+package tunnel
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/filegate/filegate/internal/protocol"
+)
+
+const (
+	// streamChunkSize is the most stream data sent in one message. It stays
+	// below sideStreamThreshold so chunks keep their order on HTTP/2.
+	streamChunkSize = 32 << 10
+)
+
+// tunnelAddr is the address of the tunnel end of passthrough streams
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "tunnel" }
+func (tunnelAddr) String() string  { return "tunnel" }
+
+// streamListener hands out the passthrough streams of an end-to-end encrypted
+// tunnel
+type streamListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newStreamListener() *streamListener {
+	return &streamListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr { return tunnelAddr{} }
+
+// offer waits for conn to be accepted, closing it if the listener closes
+func (l *streamListener) offer(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// stream is a connection forwarded unopened by the relay
+type stream struct {
+	id     string
+	client *Client
+	remote net.Addr
+	// scheme is the public scheme of an HTTP stream
+	scheme string
+
+	// in holds data from the relay; nil marks the end
+	in  chan []byte
+	buf []byte
+	eof bool
+	// flow is set when the relay does flow control: credit then holds a
+	// token for each message the relay may still be sent, and consumed
+	// counts the messages read but not acknowledged yet
+	flow     bool
+	credit   chan struct{}
+	consumed int
+	done     chan struct{}
+	once     sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	// deadlineSet is closed when the read deadline changes, waking Read
+	deadlineSet chan struct{}
+}
+
+func newStream(c *Client, p *protocol.StreamPayload) *stream {
+	var remote net.Addr = tunnelAddr{}
+	if addr, err := net.ResolveTCPAddr("tcp", p.RemoteAddr); err == nil {
+		remote = addr
+	}
+	s := &stream{
+		id:     p.ID,
+		client: c,
+		remote: remote,
+		scheme: p.Scheme,
+		// Room for a full window and the end
+		in:          make(chan []byte, protocol.StreamWindow+1),
+		flow:        c.flowControl,
+		credit:      make(chan struct{}, protocol.StreamWindow),
+		done:        make(chan struct{}),
+		deadlineSet: make(chan struct{}),
+	}
+	for range protocol.StreamWindow {
+		s.credit <- struct{}{}
+	}
+	return s
+}
+
+// deliver queues data from the relay. Waiting for a slow reader would hold
+// up every other stream of the tunnel, so a stream whose buffer is full is
+// closed instead; a relay doing flow control never fills it.
+func (s *stream) deliver(data []byte) {
+	select {
+	case s.in <- data:
+	default:
+		log.Printf("Closing stream %s: it wasn't read fast enough", s.id)
+		s.Close()
+	}
+}
+
+// acked lets n more messages be sent to the relay
+func (s *stream) acked(n int) {
+	for range min(n, protocol.StreamWindow) {
+		select {
+		case s.credit <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		if err := s.receive(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// receive waits for the next chunk of data until the read deadline. It
+// returns without one when the deadline changes, so Read can look at the
+// new one.
+func (s *stream) receive() error {
+	s.mu.Lock()
+	deadline, deadlineSet := s.readDeadline, s.deadlineSet
+	s.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-s.in:
+		if data == nil {
+			s.eof = true
+		} else if s.flow {
+			s.consumed++
+			if s.consumed >= protocol.StreamAckBatch || len(s.in) == 0 {
+				s.client.send(protocol.TypeStreamAck, protocol.StreamPayload{ID: s.id, Acked: s.consumed})
+				s.consumed = 0
+			}
+		}
+		s.buf = data
+		return nil
+	case <-s.done:
+		return net.ErrClosed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-deadlineSet:
+		return nil
+	}
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if s.flow {
+			select {
+			case <-s.credit:
+			case <-s.done:
+				return written, net.ErrClosed
+			}
+		} else {
+			select {
+			case <-s.done:
+				return written, net.ErrClosed
+			default:
+			}
+		}
+		chunk := p[:min(len(p), streamChunkSize)]
+		if err := s.client.send(protocol.TypeStreamData, protocol.StreamPayload{ID: s.id, Data: chunk}); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close ends the stream and tells the relay to close the connection
+func (s *stream) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.client.removeStream(s.id)
+		s.client.send(protocol.TypeStreamClose, protocol.StreamPayload{ID: s.id})
+	})
+	return nil
+}
+
+func (s *stream) LocalAddr() net.Addr  { return tunnelAddr{} }
+func (s *stream) RemoteAddr() net.Addr { return s.remote }
+
+func (s *stream) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	close(s.deadlineSet)
+	s.deadlineSet = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is accepted but not enforced; writes only wait for the
+// tunnel, which has its own timeouts
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/filegate/filegate/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Conn carries protocol messages between the CLI and the relay. ReadMessage
+// is called from one goroutine at a time; WriteMessage and Close may be
+// called concurrently with everything else.
+type Conn interface {
+	// ReadMessage returns the next message from the relay
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends a message to the relay
+	WriteMessage(data []byte) error
+	// SetReadDeadline makes ReadMessage fail after t (zero for no deadline)
+	SetReadDeadline(t time.Time) error
+	// Close ends the tunnel
+	Close() error
+}
+
+// Transport opens tunnels to a relay
+type Transport interface {
+	Dial(ctx context.Context, relayURL string) (Conn, error)
+}
+
+// TransportFor returns the transport for a relay URL's scheme: a WebSocket
+// for ws:// and wss://, and HTTP/2 streams for http:// and https://. A nil
+// network uses the defaults.
+func TransportFor(relayURL string, network *Network) (Transport, error) {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay URL: %w", err)
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+		return &WebSocketTransport{Network: network}, nil
+	case "http", "https":
+		return &HTTP2Transport{Network: network}, nil
+	}
+	return nil, fmt.Errorf("unsupported relay URL scheme %q (use wss:// or https://)", u.Scheme)
+}
+
+// WebSocketTransport carries the tunnel over a single WebSocket
+type WebSocketTransport struct {
+	// Network sets proxies and TLS (nil uses the defaults)
+	Network *Network
+}
+
+// Dial connects to the relay's WebSocket endpoint
+func (t *WebSocketTransport) Dial(ctx context.Context, relayURL string) (Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = t.Network.proxy()
+	dialer.TLSClientConfig = t.Network.tlsConfig()
+	conn, _, err := dialer.DialContext(ctx, relayURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(protocol.MaxFrameSize)
+	return &wsConn{conn: conn}, nil
+}
+
+// wsConn adapts a WebSocket, which allows only one writer at a time
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	_, data, err := c.conn.ReadMessage()
+	return data, err
+}
+
+func (c *wsConn) WriteMessage(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Close tells the relay the tunnel is going away before closing it, so the
+// relay fails pending requests right away instead of on a read error
+func (c *wsConn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "client closing")
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.conn.Close()
+}
@@ -0,0 +1,324 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// syncChecksumLimit is the largest file hashed while a download waits.
+	// Larger files are hashed in the background unless the client asks for
+	// a digest.
+	syncChecksumLimit = 32 << 20
+
+	// maxCachedChecksums bounds the checksum cache
+	maxCachedChecksums = 10000
+
+	// maxQueuedChecksums bounds the files waiting to be hashed
+	maxQueuedChecksums = 256
+)
+
+var checksumsName = xml.Name{Space: "http://owncloud.org/ns", Local: "checksums"}
+
+// sums are the checksums of a file's content
+type sums struct {
+	sha256 []byte
+	md5    []byte
+}
+
+// multiHash computes sums while content is written to it
+type multiHash struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func newMultiHash() *multiHash {
+	return &multiHash{sha256: sha256.New(), md5: md5.New()}
+}
+
+func (h *multiHash) Write(p []byte) (int, error) {
+	h.sha256.Write(p)
+	h.md5.Write(p)
+	return len(p), nil
+}
+
+func (h *multiHash) sums() *sums {
+	return &sums{sha256: h.sha256.Sum(nil), md5: h.md5.Sum(nil)}
+}
+
+// checksums caches file checksums by path, size and modification time, and
+// hashes files in the background
+type checksums struct {
+	mu      sync.Mutex
+	entries map[string]*checksumEntry
+	queue   []string
+	queued  map[string]bool
+	running bool
+}
+
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sums    *sums
+}
+
+func newChecksums() *checksums {
+	return &checksums{
+		entries: make(map[string]*checksumEntry),
+		queued:  make(map[string]bool),
+	}
+}
+
+// get returns the cached sums of the file at local, or nil if the file
+// changed since it was hashed
+func (c *checksums) get(local string, fi os.FileInfo) *sums {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[local]
+	if e == nil || e.size != fi.Size() || !e.modTime.Equal(fi.ModTime()) {
+		return nil
+	}
+	return e.sums
+}
+
+func (c *checksums) put(local string, fi os.FileInfo, s *sums) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedChecksums {
+		// Evict an arbitrary entry; hashing again is only a cost
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[local] = &checksumEntry{size: fi.Size(), modTime: fi.ModTime(), sums: s}
+}
+
+// compute hashes the file at local and caches the result
+func (c *checksums) compute(local string) (*sums, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	before, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	h := newMultiHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	s := h.sums()
+
+	// Don't cache sums of a file that changed while it was read
+	if after, err := os.Stat(local); err == nil && after.Size() == before.Size() && after.ModTime().Equal(before.ModTime()) {
+		c.put(local, before, s)
+	}
+	return s, nil
+}
+
+// lookup returns the sums of the file at local, hashing it now if wait is set
+// and in the background otherwise
+func (c *checksums) lookup(local string, fi os.FileInfo, wait bool) *sums {
+	if s := c.get(local, fi); s != nil {
+		return s
+	}
+	if wait {
+		s, _ := c.compute(local)
+		return s
+	}
+	c.enqueue(local)
+	return nil
+}
+
+// enqueue asks the worker to hash a file, dropping the request when busy
+func (c *checksums) enqueue(local string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queued[local] || len(c.queue) >= maxQueuedChecksums {
+		return
+	}
+	c.queued[local] = true
+	c.queue = append(c.queue, local)
+	if !c.running {
+		c.running = true
+		go c.worker()
+	}
+}
+
+// worker hashes queued files one at a time, exiting when the queue is empty
+func (c *checksums) worker() {
+	for {
+		c.mu.Lock()
+		if len(c.queue) == 0 {
+			c.running = false
+			c.mu.Unlock()
+			return
+		}
+		local := c.queue[0]
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+
+		c.compute(local)
+
+		c.mu.Lock()
+		delete(c.queued, local)
+		c.mu.Unlock()
+	}
+}
+
+// setDigestHeaders adds Repr-Digest (RFC 9530) and the older Digest
+// (RFC 3230) headers to a GET or HEAD response for a file
+func (s *Server) setDigestHeaders(w http.ResponseWriter, r *http.Request) {
+	fi, err := s.fs.Stat(r.Context(), r.URL.Path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	wanted := r.Header.Get("Want-Repr-Digest") != "" || r.Header.Get("Want-Digest") != ""
+	sums := s.checksums.lookup(s.localPath(r.URL.Path), fi, wanted || fi.Size() <= syncChecksumLimit)
+	if sums == nil {
+		return
+	}
+	w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sums.sha256)+":")
+	w.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sums.sha256)+
+		",MD5="+base64.StdEncoding.EncodeToString(sums.md5))
+}
+
+// digestCheck holds the digests a client sent with an upload
+type digestCheck struct {
+	sha256 []byte
+	md5    []byte
+}
+
+// parseContentDigest reads the expected digests from Content-Digest
+// (RFC 9530) or the older Digest header. It returns nil when neither names
+// an algorithm filegate supports.
+func parseContentDigest(h http.Header) (*digestCheck, error) {
+	var check digestCheck
+	if v := h.Get("Content-Digest"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				return nil, fmt.Errorf("malformed Content-Digest")
+			}
+			if err := check.set(alg, value[1:len(value)-1]); err != nil {
+				return nil, err
+			}
+		}
+	} else if v := h.Get("Digest"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok {
+				return nil, fmt.Errorf("malformed Digest")
+			}
+			if err := check.set(alg, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if check.sha256 == nil && check.md5 == nil {
+		return nil, nil
+	}
+	return &check, nil
+}
+
+func (c *digestCheck) set(alg, value string) error {
+	var dst *[]byte
+	switch strings.ToLower(alg) {
+	case "sha-256":
+		dst = &c.sha256
+	case "md5":
+		dst = &c.md5
+	default:
+		return nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("malformed %s digest", alg)
+	}
+	*dst = sum
+	return nil
+}
+
+// verify reports which algorithm doesn't match, or "" if all do
+func (c *digestCheck) verify(s *sums) string {
+	if c.sha256 != nil && !bytes.Equal(c.sha256, s.sha256) {
+		return "sha-256"
+	}
+	if c.md5 != nil && !bytes.Equal(c.md5, s.md5) {
+		return "md5"
+	}
+	return ""
+}
+
+// checksumFS adds ownCloud's checksums property to files in PROPFIND
+// responses, using cached checksums only so listings stay fast
+type checksumFS struct {
+	webdav.FileSystem
+	sums      *checksums
+	localPath func(name string) string
+}
+
+func (c *checksumFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := c.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	// Only wrap files opened for listings so downloads keep os.File's fast
+	// paths
+	if method, _ := ctx.Value(methodKey).(string); method != "PROPFIND" {
+		return f, nil
+	}
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		return &checksumFile{File: f, fi: fi, local: c.localPath(name), sums: c.sums}, nil
+	}
+	return f, nil
+}
+
+// checksumFile is a file with a checksums property
+type checksumFile struct {
+	webdav.File
+	fi    os.FileInfo
+	local string
+	sums  *checksums
+}
+
+// DeadProps returns the checksums if they are cached, and otherwise hashes
+// the file in the background for the next listing
+func (f *checksumFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	s := f.sums.lookup(f.local, f.fi, false)
+	if s == nil {
+		return nil, nil
+	}
+	value := fmt.Sprintf(`<oc:checksum xmlns:oc="%s">SHA256:%x MD5:%x</oc:checksum>`, checksumsName.Space, s.sha256, s.md5)
+	return map[xml.Name]webdav.Property{
+		checksumsName: {XMLName: checksumsName, InnerXML: []byte(value)},
+	}, nil
+}
+
+// Patch rejects every change, as happens for files without dead properties
+func (f *checksumFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
@@ -0,0 +1,114 @@
+package webdav
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha256Digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func TestParseContentDigest(t *testing.T) {
+	for _, tc := range []struct {
+		header, value string
+		wantCheck     bool
+		wantErr       bool
+	}{
+		{"Content-Digest", sha256Digest("x"), true, false},
+		{"Content-Digest", "sha-512=:AAAA:, " + sha256Digest("x"), true, false},
+		{"Content-Digest", "sha-512=:AAAA:", false, false},
+		{"Content-Digest", "sha-256=AAAA", false, true},
+		{"Content-Digest", "sha-256=:not base64!:", false, true},
+		{"Digest", "MD5=" + base64.StdEncoding.EncodeToString(make([]byte, 16)), true, false},
+		{"Digest", "SHA-256", false, true},
+	} {
+		h := http.Header{}
+		h.Set(tc.header, tc.value)
+		check, err := parseContentDigest(h)
+		if (err != nil) != tc.wantErr || (check != nil) != tc.wantCheck {
+			t.Errorf("%s: %s: got %+v, %v", tc.header, tc.value, check, err)
+		}
+	}
+}
+
+func TestPutVerifiesContentDigest(t *testing.T) {
+	s := newTestServer(t, Config{})
+
+	w := do(s, "PUT", "/a.txt", "hello", map[string]string{"Content-Digest": sha256Digest("hello")})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT with a matching digest: %d", w.Code)
+	}
+	w = do(s, "GET", "/a.txt", "", nil)
+	if got := w.Header().Get("Repr-Digest"); got != sha256Digest("hello") {
+		t.Errorf("Repr-Digest = %q", got)
+	}
+
+	w = do(s, "PUT", "/b.txt", "hello", map[string]string{"Content-Digest": sha256Digest("other")})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with a wrong digest: %d, want 400", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("rejected upload left a file: %v", err)
+	}
+
+	md5sum := md5.Sum([]byte("other"))
+	w = do(s, "PUT", "/b.txt", "hello", map[string]string{"Digest": "MD5=" + base64.StdEncoding.EncodeToString(md5sum[:])})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with a wrong MD5 Digest: %d, want 400", w.Code)
+	}
+	if w := do(s, "PUT", "/b.txt", "hello", map[string]string{"Content-Digest": "sha-256=:x"}); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with a malformed digest: %d, want 400", w.Code)
+	}
+}
+
+func TestOverwriteWithBadDigestKeepsOriginal(t *testing.T) {
+	for _, cfg := range []Config{{}, {Versions: true}, {Trash: true, Quota: 1 << 20}} {
+		s := newTestServer(t, cfg)
+		writeFile(t, s.root, "/a.txt", "original")
+
+		w := do(s, "PUT", "/a.txt", "replacement", map[string]string{"Content-Digest": sha256Digest("something else")})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%+v: PUT: %d, want 400", cfg, w.Code)
+		}
+		if got := readFile(t, s.root, "/a.txt"); got != "original" {
+			t.Errorf("%+v: file changed to %q", cfg, got)
+		}
+		entries, _ := os.ReadDir(s.root)
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), tempPrefix) {
+				t.Errorf("%+v: temporary file %s left behind", cfg, e.Name())
+			}
+		}
+		if s.versions != nil {
+			if list, _ := s.versions.List("/a.txt"); len(list) != 0 {
+				t.Errorf("%+v: failed PUT left versions %+v", cfg, list)
+			}
+		}
+	}
+}
+
+func TestChecksumsProperty(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if w := do(s, "PUT", "/a.txt", "hello", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d", w.Code)
+	}
+
+	w := do(s, "PROPFIND", "/a.txt", "", map[string]string{"Depth": "0"})
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND: %d", w.Code)
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	want := `<oc:checksum xmlns:oc="http://owncloud.org/ns">SHA256:` + hex.EncodeToString(sum[:])
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("PROPFIND response lacks %s:\n%s", want, w.Body)
+	}
+}
@@ -0,0 +1,17 @@
+package webdav
+
+import "golang.org/x/sys/windows"
+
+// diskSpace returns the bytes available to the current user and the total
+// size of the volume holding path
+func diskSpace(path string) (free, total int64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var avail, size, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &avail, &size, &totalFree); err != nil {
+		return 0, 0, err
+	}
+	return int64(avail), int64(size), nil
+}
@@ -0,0 +1,149 @@
+package webdav
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"golang.org/x/net/webdav"
+)
+
+// hideFS makes some paths invisible to clients: they can't be listed, read,
+// written or created. It also applies the symlink policy.
+type hideFS struct {
+	webdav.FileSystem
+	// hidden reports whether a cleaned, slash-separated path is hidden
+	hidden func(name string, isDir bool) bool
+	// links decides which symlinks may be followed (nil follows all)
+	links *symlinkPolicy
+}
+
+func (h *hideFS) isHidden(ctx context.Context, name string) bool {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return false
+	}
+	actual, ok := h.resolve(name)
+	if !ok {
+		return true
+	}
+	isDir := false
+	if fi, err := h.FileSystem.Stat(ctx, name); err == nil {
+		isDir = fi.IsDir()
+	}
+	return h.hidden(name, isDir) || h.hidden(actual, isDir)
+}
+
+// resolve applies the symlink policy, returning the path name really refers
+// to so a link can't expose a hidden path under another name
+func (h *hideFS) resolve(name string) (string, bool) {
+	if h.links == nil {
+		return name, true
+	}
+	return h.links.resolve(name)
+}
+
+func (h *hideFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if h.isHidden(ctx, name) {
+		return os.ErrPermission
+	}
+	return h.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (h *hideFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if h.isHidden(ctx, name) {
+		if flag&os.O_CREATE != 0 {
+			return nil, os.ErrPermission
+		}
+		return nil, os.ErrNotExist
+	}
+	f, err := h.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		name = path.Clean("/" + name)
+		actual, _ := h.resolve(name)
+		return &hideDir{File: f, ctx: ctx, name: name, actual: actual, fs: h}, nil
+	}
+	return f, nil
+}
+
+func (h *hideFS) RemoveAll(ctx context.Context, name string) error {
+	if h.isHidden(ctx, name) {
+		return os.ErrNotExist
+	}
+	return h.FileSystem.RemoveAll(ctx, name)
+}
+
+func (h *hideFS) Rename(ctx context.Context, oldName, newName string) error {
+	if h.isHidden(ctx, oldName) {
+		return os.ErrNotExist
+	}
+	if h.isHidden(ctx, newName) {
+		return os.ErrPermission
+	}
+	return h.FileSystem.Rename(ctx, oldName, newName)
+}
+
+func (h *hideFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if h.isHidden(ctx, name) {
+		return nil, os.ErrNotExist
+	}
+	return h.FileSystem.Stat(ctx, name)
+}
+
+// hideDir leaves hidden entries out of directory listings, and lists
+// followed symlinks as their targets
+type hideDir struct {
+	webdav.File
+	ctx  context.Context
+	name string
+	// actual is the directory's path with symlinks resolved
+	actual string
+	fs     *hideFS
+}
+
+func (d *hideDir) Readdir(count int) ([]os.FileInfo, error) {
+	var visible []os.FileInfo
+	for {
+		entries, err := d.File.Readdir(count)
+		for _, fi := range entries {
+			if fi, ok := d.entry(fi); ok {
+				visible = append(visible, fi)
+			}
+		}
+		// Keep reading until count visible entries are found or the
+		// directory is exhausted
+		if err != nil || count <= 0 || len(visible) >= count || len(entries) == 0 {
+			return visible, err
+		}
+	}
+}
+
+// entry returns what to list for a directory entry, and false to leave it out
+func (d *hideDir) entry(fi os.FileInfo) (os.FileInfo, bool) {
+	name := path.Join(d.name, fi.Name())
+	actual := path.Join(d.actual, fi.Name())
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var ok bool
+		if actual, ok = d.fs.resolve(name); !ok {
+			return nil, false
+		}
+		// Dangling links are left out too
+		target, err := d.fs.FileSystem.Stat(d.ctx, name)
+		if err != nil {
+			return nil, false
+		}
+		fi = renamedInfo{FileInfo: target, name: fi.Name()}
+	}
+	return fi, !d.fs.hidden(name, fi.IsDir()) && !d.fs.hidden(actual, fi.IsDir())
+}
+
+// renamedInfo is a symlink target's info under the link's name
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi renamedInfo) Name() string { return fi.name }
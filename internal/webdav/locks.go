@@ -0,0 +1,416 @@
+package webdav
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/webdav"
+)
+
+// LockInfo describes a WebDAV lock
+type LockInfo struct {
+	Token string `json:"token"`
+	// Path is the locked resource, relative to the share root
+	Path string `json:"path"`
+	// OwnerXML is the owner the client sent, as XML
+	OwnerXML  string `json:"owner_xml,omitempty"`
+	ZeroDepth bool   `json:"zero_depth,omitempty"`
+	// Timeout is negative for locks that never expire
+	Timeout   time.Duration `json:"timeout"`
+	Expires   time.Time     `json:"expires,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// Owner returns the text of the owner XML, such as a name or an address
+func (l *LockInfo) Owner() string {
+	var parts []string
+	dec := xml.NewDecoder(strings.NewReader(l.OwnerXML))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		if text, ok := tok.(xml.CharData); ok {
+			if s := strings.TrimSpace(string(text)); s != "" {
+				parts = append(parts, s)
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// DefaultLockPath returns where the locks of the share at root are kept
+func DefaultLockPath(root string) string {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(dir, "filegate", "locks", hex.EncodeToString(sum[:8])+".json")
+}
+
+// LockStore is a webdav.LockSystem that keeps locks in a file, so clients
+// holding a lock keep it across restarts. The file is reread when it changes,
+// which lets another process list locks and force-unlock them.
+type LockStore struct {
+	path string
+
+	mu      sync.Mutex
+	locks   map[string]*lock
+	modTime time.Time
+	size    int64
+}
+
+type lock struct {
+	LockInfo
+	// held is set while a request is using the lock
+	held bool
+	// temporary locks are the ones the handler takes for the duration of a
+	// single request, through requestLocks; they aren't saved
+	temporary bool
+}
+
+// requestLocks is the LockStore as requests other than LOCK see it. The only
+// locks they create are the ones the handler holds while it runs, which are
+// kept in memory.
+type requestLocks struct {
+	*LockStore
+}
+
+func (r requestLocks) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return r.create(now, details, true)
+}
+
+// OpenLockStore loads the locks saved at path
+func OpenLockStore(path string) (*LockStore, error) {
+	s := &LockStore{path: path, locks: make(map[string]*lock)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// List returns the active locks ordered by path
+func (s *LockStore) List() ([]LockInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	s.collectExpired(time.Now())
+
+	var locks []LockInfo
+	for _, l := range s.locks {
+		if !l.temporary {
+			locks = append(locks, l.LockInfo)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Path < locks[j].Path })
+	return locks, nil
+}
+
+// ForceUnlock removes a lock even if its owner still uses it
+func (s *LockStore) ForceUnlock(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	if _, ok := s.locks[token]; !ok {
+		return webdav.ErrNoSuchLock
+	}
+	delete(s.locks, token)
+	return s.save()
+}
+
+func (s *LockStore) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh(now)
+
+	var l0, l1 *lock
+	if name0 != "" {
+		if l0 = s.lookup(slashClean(name0), conditions...); l0 == nil {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	if name1 != "" {
+		if l1 = s.lookup(slashClean(name1), conditions...); l1 == nil {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	// Don't hold the same lock twice
+	if l1 == l0 {
+		l1 = nil
+	}
+
+	for _, l := range []*lock{l0, l1} {
+		if l != nil {
+			l.held = true
+		}
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, l := range []*lock{l0, l1} {
+			if l != nil {
+				l.held = false
+			}
+		}
+	}, nil
+}
+
+// Create creates a lock and saves it
+func (s *LockStore) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return s.create(now, details, false)
+}
+
+func (s *LockStore) create(now time.Time, details webdav.LockDetails, temporary bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh(now)
+
+	root := slashClean(details.Root)
+	if !s.canCreate(root, details.ZeroDepth) {
+		return "", webdav.ErrLocked
+	}
+
+	l := &lock{
+		LockInfo: LockInfo{
+			Token:     "urn:uuid:" + uuid.NewString(),
+			Path:      root,
+			OwnerXML:  details.OwnerXML,
+			ZeroDepth: details.ZeroDepth,
+			Timeout:   details.Duration,
+			CreatedAt: now,
+		},
+		temporary: temporary,
+	}
+	if details.Duration >= 0 {
+		l.Expires = now.Add(details.Duration)
+	}
+	s.locks[l.Token] = l
+
+	if !l.temporary {
+		if err := s.save(); err != nil {
+			delete(s.locks, l.Token)
+			return "", err
+		}
+	}
+	return l.Token, nil
+}
+
+func (s *LockStore) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh(now)
+
+	l := s.locks[token]
+	if l == nil {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	if l.held {
+		return webdav.LockDetails{}, webdav.ErrLocked
+	}
+	l.Timeout = duration
+	l.Expires = time.Time{}
+	if duration >= 0 {
+		l.Expires = now.Add(duration)
+	}
+	if !l.temporary {
+		if err := s.save(); err != nil {
+			return webdav.LockDetails{}, err
+		}
+	}
+	return l.details(), nil
+}
+
+func (s *LockStore) Unlock(now time.Time, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh(now)
+
+	l := s.locks[token]
+	if l == nil {
+		return webdav.ErrNoSuchLock
+	}
+	if l.held {
+		return webdav.ErrLocked
+	}
+	delete(s.locks, token)
+	if l.temporary {
+		return nil
+	}
+	return s.save()
+}
+
+func (l *lock) details() webdav.LockDetails {
+	return webdav.LockDetails{
+		Root:      l.Path,
+		Duration:  l.Timeout,
+		OwnerXML:  l.OwnerXML,
+		ZeroDepth: l.ZeroDepth,
+	}
+}
+
+// lookup returns the lock on name matching one of the conditions, provided
+// no other request holds it. It works like the in-memory lock system's.
+func (s *LockStore) lookup(name string, conditions ...webdav.Condition) *lock {
+	for _, c := range conditions {
+		l := s.locks[c.Token]
+		if l == nil || l.held {
+			continue
+		}
+		if name == l.Path {
+			return l
+		}
+		if l.ZeroDepth {
+			continue
+		}
+		if l.Path == "/" || strings.HasPrefix(name, l.Path+"/") {
+			return l
+		}
+	}
+	return nil
+}
+
+// canCreate reports whether name can be locked: it isn't locked itself or by
+// an infinite-depth lock above it, and for an infinite-depth lock nothing
+// below it is locked either
+func (s *LockStore) canCreate(name string, zeroDepth bool) bool {
+	for _, l := range s.locks {
+		switch {
+		case l.Path == name:
+			return false
+		case !l.ZeroDepth && isWithin(name, l.Path):
+			return false
+		case !zeroDepth && isWithin(l.Path, name):
+			return false
+		}
+	}
+	return true
+}
+
+// isWithin reports whether name is strictly below dir
+func isWithin(name, dir string) bool {
+	return name != dir && (dir == "/" || strings.HasPrefix(name, dir+"/"))
+}
+
+// refresh picks up changes made by other processes and drops expired locks.
+// Errors are ignored so a damaged file can't block every request; the next
+// save replaces it.
+func (s *LockStore) refresh(now time.Time) {
+	s.reload()
+	s.collectExpired(now)
+}
+
+func (s *LockStore) collectExpired(now time.Time) {
+	expired := false
+	for token, l := range s.locks {
+		if !l.held && !l.Expires.IsZero() && now.After(l.Expires) {
+			delete(s.locks, token)
+			expired = expired || !l.temporary
+		}
+	}
+	if expired {
+		s.save()
+	}
+}
+
+// reload reads the file if it changed since it was last read or written.
+// Temporary locks and the held state of saved ones are kept.
+func (s *LockStore) reload() error {
+	fi, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		fi = nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read locks: %w", err)
+	}
+	if fi == nil && s.modTime.IsZero() || fi != nil && fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return nil
+	}
+
+	var saved []LockInfo
+	if fi != nil {
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return fmt.Errorf("failed to read locks: %w", err)
+		}
+		if err := json.Unmarshal(data, &saved); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to parse %s: %w", s.path, err)
+		}
+		s.modTime, s.size = fi.ModTime(), fi.Size()
+	} else {
+		s.modTime, s.size = time.Time{}, 0
+	}
+
+	locks := make(map[string]*lock, len(saved))
+	for token, l := range s.locks {
+		if l.temporary {
+			locks[token] = l
+		}
+	}
+	for _, info := range saved {
+		l := &lock{LockInfo: info}
+		if old, ok := s.locks[info.Token]; ok {
+			l.held = old.held
+		}
+		locks[info.Token] = l
+	}
+	s.locks = locks
+	return nil
+}
+
+// save writes the locks that outlive a request to the file
+func (s *LockStore) save() error {
+	saved := []LockInfo{}
+	for _, l := range s.locks {
+		if !l.temporary {
+			saved = append(saved, l.LockInfo)
+		}
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Path < saved[j].Path })
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to save locks: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save locks: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to save locks: %w", err)
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime, s.size = fi.ModTime(), fi.Size()
+	}
+	return nil
+}
+
+// slashClean cleans a lock path the way the webdav package does
+func slashClean(name string) string {
+	if name == "" || name[0] != '/' {
+		name = "/" + name
+	}
+	return path.Clean(name)
+}
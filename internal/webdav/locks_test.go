@@ -0,0 +1,172 @@
+package webdav
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func openTestLockStore(t *testing.T, path string) *LockStore {
+	t.Helper()
+	store, err := OpenLockStore(path)
+	if err != nil {
+		t.Fatalf("OpenLockStore: %v", err)
+	}
+	return store
+}
+
+func TestLockStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.json")
+	store := openTestLockStore(t, path)
+	now := time.Now()
+
+	// A client lock without owner or timeout is saved like any other
+	token, err := store.Create(now, webdav.LockDetails{Root: "/a.txt", Duration: -1, ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := store.Create(now, webdav.LockDetails{Root: "/docs", Duration: time.Hour, OwnerXML: "<D:href>alice</D:href>"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Locks requests take while they run aren't
+	if _, err := (requestLocks{store}).Create(now, webdav.LockDetails{Root: "/b.txt", Duration: -1, ZeroDepth: true}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	locks, err := openTestLockStore(t, path).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 2 || locks[0].Path != "/a.txt" || locks[0].Token != token || locks[1].Path != "/docs" {
+		t.Fatalf("reloaded locks = %+v", locks)
+	}
+	if owner := locks[1].Owner(); owner != "alice" {
+		t.Errorf("Owner = %q", owner)
+	}
+
+	// The reloaded lock still guards the file
+	reopened := openTestLockStore(t, path)
+	if _, err := reopened.Create(now, webdav.LockDetails{Root: "/a.txt", Duration: -1}); !errors.Is(err, webdav.ErrLocked) {
+		t.Errorf("Create on a locked file: %v, want ErrLocked", err)
+	}
+	release, err := reopened.Confirm(now, "/a.txt", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm with the token: %v", err)
+	}
+	release()
+}
+
+func TestLockStoreExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.json")
+	store := openTestLockStore(t, path)
+	now := time.Now()
+
+	token, err := store.Create(now, webdav.LockDetails{Root: "/a.txt", Duration: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Refresh(now.Add(30*time.Second), token, time.Minute); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	// Still locked after the original timeout thanks to the refresh
+	if _, err := store.Create(now.Add(70*time.Second), webdav.LockDetails{Root: "/a.txt", Duration: -1}); !errors.Is(err, webdav.ErrLocked) {
+		t.Errorf("Create before expiry: %v, want ErrLocked", err)
+	}
+
+	later := now.Add(2 * time.Minute)
+	if _, err := store.Confirm(later, "/a.txt", "", webdav.Condition{Token: token}); !errors.Is(err, webdav.ErrConfirmationFailed) {
+		t.Errorf("Confirm after expiry: %v, want ErrConfirmationFailed", err)
+	}
+	if locks, _ := openTestLockStore(t, path).List(); len(locks) != 0 {
+		t.Errorf("expired lock still saved: %+v", locks)
+	}
+}
+
+func TestLockStoreForceUnlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.json")
+	server := openTestLockStore(t, path)
+	now := time.Now()
+
+	token, err := server.Create(now, webdav.LockDetails{Root: "/a.txt", Duration: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lock owner can't unlock while a request holds the lock
+	release, err := server.Confirm(now, "/a.txt", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Unlock(now, token); !errors.Is(err, webdav.ErrLocked) {
+		t.Errorf("Unlock of a held lock: %v, want ErrLocked", err)
+	}
+	release()
+
+	// Another process, like `filegate locks unlock`, removes it anyway
+	if err := openTestLockStore(t, path).ForceUnlock(token); err != nil {
+		t.Fatalf("ForceUnlock: %v", err)
+	}
+	if _, err := server.Confirm(now, "/a.txt", "", webdav.Condition{Token: token}); !errors.Is(err, webdav.ErrConfirmationFailed) {
+		t.Errorf("Confirm after force-unlock: %v, want ErrConfirmationFailed", err)
+	}
+	if _, err := server.Create(now, webdav.LockDetails{Root: "/a.txt", Duration: -1}); err != nil {
+		t.Errorf("Create after force-unlock: %v", err)
+	}
+	if err := openTestLockStore(t, path).ForceUnlock(token); !errors.Is(err, webdav.ErrNoSuchLock) {
+		t.Errorf("second ForceUnlock: %v, want ErrNoSuchLock", err)
+	}
+}
+
+func TestLockStoreDepth(t *testing.T) {
+	store := openTestLockStore(t, filepath.Join(t.TempDir(), "locks.json"))
+	now := time.Now()
+
+	if _, err := store.Create(now, webdav.LockDetails{Root: "/docs", Duration: -1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{"/docs", "/docs/a.txt", "/"} {
+		if _, err := store.Create(now, webdav.LockDetails{Root: root, Duration: -1}); !errors.Is(err, webdav.ErrLocked) {
+			t.Errorf("Create %s: %v, want ErrLocked", root, err)
+		}
+	}
+	if _, err := store.Create(now, webdav.LockDetails{Root: "/other", Duration: -1}); err != nil {
+		t.Errorf("Create /other: %v", err)
+	}
+}
+
+const lockBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+
+func TestLockRequests(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "locks.json")
+	s := newTestServer(t, Config{LockFile: lockFile})
+	writeFile(t, s.root, "/a.txt", "hello")
+
+	w := do(s, "LOCK", "/a.txt", lockBody, map[string]string{"Timeout": "Infinite"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("LOCK: %d %s", w.Code, w.Body)
+	}
+	token := strings.Trim(w.Header().Get("Lock-Token"), "<>")
+
+	locks, err := openTestLockStore(t, lockFile).List()
+	if err != nil || len(locks) != 1 || locks[0].Token != token {
+		t.Fatalf("saved locks = %+v, %v", locks, err)
+	}
+
+	if w := do(s, "PUT", "/a.txt", "changed", nil); w.Code != http.StatusLocked {
+		t.Errorf("PUT without the token: %d, want 423", w.Code)
+	}
+	if w := do(s, "PUT", "/a.txt", "changed", map[string]string{"If": "(<" + token + ">)"}); w.Code >= 300 {
+		t.Errorf("PUT with the token: %d", w.Code)
+	}
+	if w := do(s, "UNLOCK", "/a.txt", "", map[string]string{"Lock-Token": "<" + token + ">"}); w.Code != http.StatusNoContent {
+		t.Errorf("UNLOCK: %d", w.Code)
+	}
+	if locks, _ := openTestLockStore(t, lockFile).List(); len(locks) != 0 {
+		t.Errorf("locks left after UNLOCK: %+v", locks)
+	}
+}
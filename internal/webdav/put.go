@@ -0,0 +1,95 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/webdav"
+)
+
+// tempPrefix starts the names of files being written before they are moved
+// into place. They are never visible and don't count against the quota.
+const tempPrefix = ".filegate-tmp-"
+
+// putFS writes the body of a PUT to a temporary file beside its target, which
+// replaces the target when the handler closes it, and only if the whole body
+// was accepted. A body rejected halfway, for its size or its digest, leaves
+// the existing file as it was.
+type putFS struct {
+	webdav.FileSystem
+	localPath func(name string) string
+}
+
+func (p *putFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	body, _ := ctx.Value(bodyKey).(*limitedBody)
+	if body == nil || flag&os.O_TRUNC == 0 {
+		return p.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+
+	// Open the target without truncating it, so the wrapped file systems
+	// still check the path, and create the file if it is new
+	_, statErr := p.FileSystem.Stat(ctx, name)
+	f, err := p.FileSystem.OpenFile(ctx, name, flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	created := errors.Is(statErr, os.ErrNotExist)
+
+	target := replaceTarget(p.localPath(name))
+	tmp, err := os.CreateTemp(filepath.Dir(target), tempPrefix+"*")
+	if err == nil {
+		if err = tmp.Chmod(fi.Mode().Perm()); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		if created {
+			os.Remove(target)
+		}
+		return nil, err
+	}
+	return &putFile{File: tmp, target: target, created: created, body: body}, nil
+}
+
+// replaceTarget returns the file to replace when writing to local: what it
+// refers to, so a followed symlink is written through instead of replaced
+func replaceTarget(local string) string {
+	if resolved, err := filepath.EvalSymlinks(local); err == nil {
+		return resolved
+	}
+	return local
+}
+
+// putFile is the temporary file a PUT body is written to
+type putFile struct {
+	*os.File
+	target string
+	// created is set when the target was created for this PUT, so it is
+	// removed again if the body is rejected
+	created bool
+	body    *limitedBody
+}
+
+// Close moves the content into place if the body was accepted, and discards
+// it otherwise
+func (f *putFile) Close() error {
+	err := f.File.Close()
+	if err == nil && f.body.done {
+		if err = os.Rename(f.Name(), f.target); err == nil {
+			return nil
+		}
+	}
+	os.Remove(f.Name())
+	if f.created {
+		os.Remove(f.target)
+	}
+	return err
+}
@@ -0,0 +1,411 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// usageTTL is how long a walk of the share stays valid when a quota is
+	// set. Uploads adjust the cached total in between, so this only matters
+	// for outside changes.
+	usageTTL = 30 * time.Second
+
+	// reserveAhead is how much space uploads of unknown length set aside at a
+	// time
+	reserveAhead = 64 << 10
+)
+
+var (
+	quotaUsedName      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+	quotaAvailableName = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+)
+
+// limits enforces the upload size, quota and free-space settings
+type limits struct {
+	root      string
+	maxUpload int64
+	quota     int64
+	minFree   int64
+
+	mu     sync.Mutex
+	used   int64
+	usedAt time.Time
+	// reserved is the space set aside for uploads in progress
+	reserved int64
+
+	// reserveMu makes checking for space and reserving it one step
+	reserveMu sync.Mutex
+}
+
+// usage returns the total size of the files in the share
+func (l *limits) usage() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.usedAt) > usageTTL {
+		l.used = treeSize(l.root)
+		l.usedAt = time.Now()
+	}
+	return l.used
+}
+
+// adjust records a change in usage without walking the share again
+func (l *limits) adjust(delta int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used += delta
+}
+
+// invalidate forces the next usage call to walk the share
+func (l *limits) invalidate() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.usedAt = time.Time{}
+}
+
+// available returns how many more bytes may be stored besides what uploads
+// in progress reserved, and false if neither a quota nor the free-space guard
+// limits it
+func (l *limits) available() (int64, bool) {
+	avail, limited := int64(0), false
+	if l.quota > 0 {
+		avail, limited = l.quota-l.usage(), true
+	}
+	if free, _, err := diskSpace(l.root); err == nil {
+		if free := free - l.minFree; !limited || free < avail {
+			avail, limited = free, true
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return max(avail-l.reserved, 0), limited
+}
+
+// allowance returns the largest upload that fits when replacing a file of
+// size existing, and the status to reject larger ones with. A negative
+// allowance means no limit.
+func (l *limits) allowance(existing int64) (int64, int) {
+	allowed, status := int64(-1), 0
+	if l.maxUpload > 0 {
+		allowed, status = l.maxUpload, http.StatusRequestEntityTooLarge
+	}
+	// Overwriting frees the old content first
+	if avail, ok := l.available(); ok {
+		if avail += existing; allowed < 0 || avail < allowed {
+			allowed, status = avail, http.StatusInsufficientStorage
+		}
+	}
+	return allowed, status
+}
+
+// reservation is space set aside for one upload, so concurrent uploads can't
+// go over the limits together
+type reservation struct {
+	limits *limits
+	// credit is the size of the file the upload replaces, which it frees
+	credit int64
+	size   int64
+}
+
+// reserve starts a reservation for an upload replacing a file of size
+// existing. It holds no space until cover is called.
+func (l *limits) reserve(existing int64) *reservation {
+	return &reservation{limits: l, credit: existing}
+}
+
+// cover sets aside enough space for the upload to grow to total bytes, and up
+// to ahead more bytes if they are available, reporting false if total isn't.
+// Reserving ahead saves uploads of unknown length from coming back for every
+// read.
+func (r *reservation) cover(total, ahead int64) bool {
+	need := total - r.credit - r.size
+	if need <= 0 {
+		return true
+	}
+	l := r.limits
+	l.reserveMu.Lock()
+	defer l.reserveMu.Unlock()
+	avail, limited := l.available()
+	if limited && need > avail {
+		return false
+	}
+	grow := need + ahead
+	if limited {
+		grow = min(grow, avail)
+	}
+	l.mu.Lock()
+	l.reserved += grow
+	l.mu.Unlock()
+	r.size += grow
+	return true
+}
+
+// fits returns the largest upload the reservation covers
+func (r *reservation) fits() int64 {
+	return r.size + r.credit
+}
+
+// release gives the space back once the upload is done, after its effect on
+// usage was recorded
+func (r *reservation) release() {
+	l := r.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reserved -= r.size
+	r.size = 0
+}
+
+// treeSize sums the sizes of the regular files under root. The trash and old
+// versions are left out, since clients can't manage them as files of the
+// share; unfinished uploads count, as they become files once complete.
+func treeSize(root string) int64 {
+	var total int64
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && filepath.Dir(path) == filepath.Clean(root) && (d.Name() == TrashDir || d.Name() == VersionsDir) {
+			return filepath.SkipDir
+		}
+		// Files being written are counted by the reservations of their uploads
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// servePut runs a PUT with the body capped at what the limits allow and
+// checked against the digests the client sent. The handler only sees a failed
+// read when the body is rejected, so its response is replaced with 413, 507
+// or 400. putFS writes the body to a temporary file, so the existing file is
+// only replaced once the whole body was accepted.
+func (s *Server) servePut(w http.ResponseWriter, r *http.Request) {
+	var existing int64
+	if fi, err := s.fs.Stat(r.Context(), r.URL.Path); err == nil && !fi.IsDir() {
+		existing = fi.Size()
+	}
+
+	allowed, status := s.limits.allowance(existing)
+	if allowed >= 0 && r.ContentLength > allowed {
+		http.Error(w, limitMessage(status, allowed), status)
+		return
+	}
+	space := s.limits.reserve(existing)
+	defer space.release()
+	if !space.cover(r.ContentLength, 0) {
+		http.Error(w, limitMessage(http.StatusInsufficientStorage, space.fits()), http.StatusInsufficientStorage)
+		return
+	}
+	check, err := parseContentDigest(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := s.snapshot(r.Context(), r.URL.Path)
+	if err != nil {
+		http.Error(w, "Failed to save the previous version", http.StatusInternalServerError)
+		return
+	}
+
+	body := &limitedBody{
+		ReadCloser:  r.Body,
+		remaining:   allowed,
+		limitStatus: status,
+		space:       space,
+		hash:        newMultiHash(),
+		check:       check,
+	}
+	r.Body = body
+	rw := &limitedResponse{ResponseWriter: w, body: body}
+	s.handler.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), bodyKey, body)))
+
+	local := s.localPath(r.URL.Path)
+	if rw.code < 300 {
+		s.limits.adjust(body.read - existing)
+		if fi, err := os.Stat(local); err == nil && fi.Size() == body.read {
+			s.checksums.put(local, fi, body.hash.sums())
+		}
+	}
+	s.settle(version, rw.code < 300)
+}
+
+// checkCopy rejects a COPY whose source wouldn't fit
+func (s *Server) checkCopy(w http.ResponseWriter, r *http.Request) bool {
+	avail, ok := s.limits.available()
+	if !ok {
+		return true
+	}
+	if size := treeSize(s.localPath(r.URL.Path)); size > avail {
+		http.Error(w, limitMessage(http.StatusInsufficientStorage, avail), http.StatusInsufficientStorage)
+		return false
+	}
+	return true
+}
+
+func limitMessage(status int, allowed int64) string {
+	if status == http.StatusRequestEntityTooLarge {
+		return fmt.Sprintf("Upload exceeds the %d byte limit", allowed)
+	}
+	return fmt.Sprintf("Not enough space: %d bytes available", allowed)
+}
+
+// limitedBody fails reads once more than remaining bytes are sent or the
+// space reserved for them can't grow, and at the end if the content doesn't
+// match the expected digests
+type limitedBody struct {
+	io.ReadCloser
+	remaining   int64 // negative for no limit
+	limitStatus int   // status for bodies over the limit
+	space       *reservation
+	read        int64
+	hash        *multiHash
+	check       *digestCheck
+	// done is set once the whole body was read and accepted
+	done bool
+
+	// status and message are the response to send instead of the
+	// handler's once the body was rejected
+	status  int
+	message string
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining >= 0 && int64(len(p)) > b.remaining+1 {
+		// Read one byte past the limit to tell "exactly full" from "too big"
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.remaining >= 0 && int64(n) > b.remaining {
+		b.status, b.message = b.limitStatus, limitMessage(b.limitStatus, b.read+b.remaining)
+		return 0, fmt.Errorf("upload limit exceeded")
+	}
+	if b.space != nil && !b.space.cover(b.read+int64(n), reserveAhead) {
+		b.status, b.message = http.StatusInsufficientStorage, limitMessage(http.StatusInsufficientStorage, b.space.fits())
+		return 0, fmt.Errorf("upload limit exceeded")
+	}
+	b.read += int64(n)
+	if b.remaining >= 0 {
+		b.remaining -= int64(n)
+	}
+	b.hash.Write(p[:n])
+	if err == io.EOF {
+		if b.check != nil {
+			if alg := b.check.verify(b.hash.sums()); alg != "" {
+				b.status, b.message = http.StatusBadRequest, fmt.Sprintf("Content-Digest mismatch: %s of the received content differs", alg)
+				return n, fmt.Errorf("content digest mismatch")
+			}
+		}
+		b.done = true
+	}
+	return n, err
+}
+
+// limitedResponse replaces the handler's response when the body was rejected
+type limitedResponse struct {
+	http.ResponseWriter
+	body     *limitedBody
+	code     int
+	replaced bool
+}
+
+func (w *limitedResponse) WriteHeader(code int) {
+	if w.code != 0 {
+		return
+	}
+	w.code = code
+	if w.body.status != 0 {
+		w.replaced = true
+		http.Error(w.ResponseWriter, w.body.message, w.body.status)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *limitedResponse) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// quotaFS reports quota properties (RFC 4331) on collections so clients can
+// show capacity
+type quotaFS struct {
+	webdav.FileSystem
+	limits *limits
+}
+
+func (q *quotaFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := q.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	// Only wrap directories so file transfers keep os.File's fast paths
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		return &quotaDir{File: f, limits: q.limits}, nil
+	}
+	return f, nil
+}
+
+// quotaDir is a directory with quota properties
+type quotaDir struct {
+	webdav.File
+	limits *limits
+}
+
+// DeadProps reports the share's usage against its quota, or the disk's usage
+// when there is no quota (which avoids walking large shares)
+func (d *quotaDir) DeadProps() (map[xml.Name]webdav.Property, error) {
+	var used int64
+	if d.limits.quota > 0 {
+		used = d.limits.usage()
+	} else if free, total, err := diskSpace(d.limits.root); err == nil {
+		used = total - free
+	} else {
+		return nil, nil
+	}
+	avail, ok := d.limits.available()
+	if !ok {
+		return nil, nil
+	}
+	return map[xml.Name]webdav.Property{
+		quotaUsedName:      quotaProperty(quotaUsedName, used),
+		quotaAvailableName: quotaProperty(quotaAvailableName, avail),
+	}, nil
+}
+
+// Patch rejects every change, as happens for files without dead properties
+func (d *quotaDir) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+func quotaProperty(name xml.Name, value int64) webdav.Property {
+	return webdav.Property{XMLName: name, InnerXML: []byte(strconv.FormatInt(value, 10))}
+}
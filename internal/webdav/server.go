@@ -1,18 +1,39 @@
 package webdav
 
 import (
+	"context"
 	"crypto/subtle"
+	"fmt"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/filegate/filegate/internal/ignore"
 	"golang.org/x/net/webdav"
 )
 
 // Server wraps a WebDAV handler with authentication
 type Server struct {
-	handler  *webdav.Handler
-	username string
-	password string
+	handler   *webdav.Handler
+	fs        webdav.FileSystem
+	root      string
+	users     map[string]string
+	readOnly  bool
+	limits    *limits
+	checksums *checksums
+	hide      *hideFS
+	uploads   *uploads
+
+	// lockHandler serves LOCK requests, whose locks are saved when there is
+	// a lock file
+	lockHandler *webdav.Handler
+
+	versions       *Versions
+	versionsKeep   int
+	versionsMaxAge time.Duration
 }
 
 // Config holds configuration for the WebDAV server
@@ -23,8 +44,52 @@ type Config struct {
 	Username string
 	// Password for Basic Auth
 	Password string
+	// Users holds additional username/password pairs allowed to log in
+	Users map[string]string
+	// ReadOnly rejects every method that would modify the share
+	ReadOnly bool
+	// MaxUploadSize is the largest file a single PUT may write (0 for no limit)
+	MaxUploadSize int64
+	// Quota caps the total size of the files in the share (0 for no limit)
+	Quota int64
+	// MinFreeSpace rejects writes that would leave less free disk space
+	MinFreeSpace int64
+	// Trash moves deleted items to TrashDir instead of removing them
+	Trash bool
+	// TrashRetention is how long trashed items are kept (0 keeps them forever)
+	TrashRetention time.Duration
+	// ShowHidden exposes files and folders whose names start with a dot
+	ShowHidden bool
+	// Exclude holds gitignore-style patterns for paths clients can't see
+	// or change. .filegateignore files in the share add to them.
+	Exclude []string
+	// Gitignore also applies the share's .gitignore files
+	Gitignore bool
+	// Symlinks sets which symlinks are followed (defaults to SymlinksWithinRoot)
+	Symlinks SymlinkPolicy
+	// LockFile keeps locks across restarts (empty keeps them in memory)
+	LockFile string
+	// Versions saves the previous content of files replaced by PUT, COPY or
+	// MOVE in VersionsDir, and serves it under /.versions
+	Versions bool
+	// VersionsKeep is how many versions of a file are kept (0 for no limit)
+	VersionsKeep int
+	// VersionsRetention is how long versions are kept (0 keeps them forever)
+	VersionsRetention time.Duration
 }
 
+// ctxKey is the type of context keys set by the server
+type ctxKey int
+
+const (
+	// userKey holds the authenticated username in request contexts
+	userKey ctxKey = iota
+	// methodKey holds the request method
+	methodKey
+	// bodyKey holds the limitedBody of a PUT, for putFS
+	bodyKey
+)
+
 // New creates a new WebDAV server
 func New(cfg Config) (*Server, error) {
 	root := cfg.Root
@@ -36,43 +101,228 @@ func New(cfg Config) (*Server, error) {
 		}
 	}
 
+	lim := &limits{
+		root:      root,
+		maxUpload: cfg.MaxUploadSize,
+		quota:     cfg.Quota,
+		minFree:   cfg.MinFreeSpace,
+	}
+	files := []string{ignore.FileName}
+	if cfg.Gitignore {
+		files = []string{".gitignore", ignore.FileName}
+	}
+	excluded, err := ignore.New(ignore.Config{Root: root, Patterns: cfg.Exclude, Files: files})
+	if err != nil {
+		return nil, err
+	}
+	links, err := newSymlinkPolicy(cfg.Symlinks, root)
+	if err != nil {
+		return nil, err
+	}
+	hidden := func(name string, isDir bool) bool {
+		// The trash, versions, uploads, files being written and ignore files
+		// are never visible, whatever the settings
+		base := path.Base(name)
+		if inTrash(name) || inVersions(name) || inUploads(name) || strings.HasPrefix(base, tempPrefix) || base == ignore.FileName {
+			return true
+		}
+		if !cfg.ShowHidden && isDotPath(name) {
+			return true
+		}
+		return excluded.Match(name, isDir)
+	}
+	hide := &hideFS{FileSystem: webdav.Dir(root), hidden: hidden, links: links}
+	var fs webdav.FileSystem = hide
+	if cfg.Trash {
+		trash := OpenTrash(root)
+		if cfg.TrashRetention > 0 {
+			if _, err := trash.Purge(cfg.TrashRetention); err != nil {
+				return nil, fmt.Errorf("failed to purge trash: %w", err)
+			}
+		}
+		fs = &trashFS{FileSystem: fs, trash: trash, retention: cfg.TrashRetention, lastPurge: time.Now()}
+	}
+	var versions *Versions
+	if cfg.Versions {
+		versions = OpenVersions(root)
+		if cfg.VersionsRetention > 0 {
+			if _, err := versions.PurgeExpired(cfg.VersionsRetention); err != nil {
+				return nil, fmt.Errorf("failed to purge old versions: %w", err)
+			}
+		}
+		store := filepath.Join(root, VersionsDir)
+		if err := os.MkdirAll(store, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create versions folder: %w", err)
+		}
+		fs = &versionFS{FileSystem: fs, store: webdav.Dir(store), hidden: hidden}
+	}
+	fs = &quotaFS{FileSystem: fs, limits: lim}
+	sums := newChecksums()
+	local := func(name string) string {
+		return localPath(root, versions != nil, name)
+	}
+	fs = &checksumFS{FileSystem: fs, sums: sums, localPath: local}
+	fs = &putFS{FileSystem: fs, localPath: local}
+
 	handler := &webdav.Handler{
-		FileSystem: webdav.Dir(root),
+		FileSystem: fs,
 		LockSystem: webdav.NewMemLS(),
 		Prefix:     "",
 	}
+	lockHandler := handler
+	if cfg.LockFile != "" {
+		store, err := OpenLockStore(cfg.LockFile)
+		if err != nil {
+			return nil, err
+		}
+		// Only LOCK requests create the locks clients hold; other requests
+		// lock for as long as they run, which isn't worth saving
+		handler.LockSystem = requestLocks{store}
+		lockHandler = &webdav.Handler{FileSystem: fs, LockSystem: store}
+	}
+
+	users := make(map[string]string, len(cfg.Users)+1)
+	for username, password := range cfg.Users {
+		users[username] = password
+	}
+	users[cfg.Username] = cfg.Password
+
+	uploads := newUploads(root)
+	uploads.purgeExpired()
 
 	return &Server{
-		handler:  handler,
-		username: cfg.Username,
-		password: cfg.Password,
+		handler:   handler,
+		fs:        fs,
+		root:      root,
+		users:     users,
+		readOnly:  cfg.ReadOnly,
+		limits:    lim,
+		checksums: sums,
+		hide:      hide,
+		uploads:   uploads,
+
+		lockHandler: lockHandler,
+
+		versions:       versions,
+		versionsKeep:   cfg.VersionsKeep,
+		versionsMaxAge: cfg.VersionsRetention,
 	}, nil
 }
 
 // ServeHTTP implements http.Handler with Basic Auth
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, upload := uploadID(r.URL.Path)
+	if upload && setUploadCORS(w, r) {
+		return
+	}
+
 	// Check Basic Auth
-	if !s.authenticate(r) {
+	username, ok := s.authenticate(r)
+	if !ok {
 		w.Header().Set("WWW-Authenticate", `Basic realm="filegate"`)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	ctx := context.WithValue(r.Context(), userKey, username)
+	r = r.WithContext(context.WithValue(ctx, methodKey, r.Method))
+
+	if s.readOnly && isWriteMethod(r.Method) {
+		http.Error(w, "Share is read-only", http.StatusForbidden)
+		return
+	}
+
+	if id, ok := uploadID(r.URL.Path); ok {
+		s.serveUpload(w, r, id)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		s.setDigestHeaders(w, r)
+	case "PUT":
+		s.servePut(w, r)
+		return
+	case "COPY", "MOVE":
+		if r.Method == "COPY" && !s.checkCopy(w, r) {
+			return
+		}
+		if dst := destination(r); dst != "" {
+			version, err := s.snapshot(r.Context(), dst)
+			if err != nil {
+				http.Error(w, "Failed to save the previous version", http.StatusInternalServerError)
+				return
+			}
+			rec := &statusRecorder{ResponseWriter: w}
+			s.handler.ServeHTTP(rec, r)
+			s.settle(version, rec.code < 300)
+			s.limits.invalidate()
+			return
+		}
+	case "LOCK":
+		s.lockHandler.ServeHTTP(w, r)
+		return
+	}
 
 	s.handler.ServeHTTP(w, r)
+
+	// Deletes and copies change usage by amounts that aren't known up front
+	if r.Method == "DELETE" || r.Method == "COPY" {
+		s.limits.invalidate()
+	}
+}
+
+// localPath maps a request path to the file system the way webdav.Dir does
+func (s *Server) localPath(name string) string {
+	return localPath(s.root, s.versions != nil, name)
+}
+
+// localPath maps a request path to the file under root, including versions
+// served under versionsPath when versioning is on
+func localPath(root string, versions bool, name string) string {
+	if sub, ok := versionsSubpath(name); ok && versions {
+		return filepath.Join(root, VersionsDir, filepath.FromSlash(sub))
+	}
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// isDotPath reports whether any component of a slash path starts with a dot
+func isDotPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
 }
 
-// authenticate checks the request for valid Basic Auth credentials
-func (s *Server) authenticate(r *http.Request) bool {
+// isWriteMethod reports whether a WebDAV method can modify the share. LOCK is
+// included because locking a missing path creates an empty file.
+func isWriteMethod(method string) bool {
+	switch method {
+	case "PUT", "DELETE", "MKCOL", "COPY", "MOVE", "PROPPATCH", "LOCK", "UNLOCK", "POST", "PATCH":
+		return true
+	}
+	return false
+}
+
+// authenticate checks the request for valid Basic Auth credentials and
+// returns the username
+func (s *Server) authenticate(r *http.Request) (string, bool) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		return false
+		return "", false
 	}
 
-	// Use constant-time comparison to prevent timing attacks
-	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(s.username)) == 1
-	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1
+	// Check every user so the response time doesn't reveal which usernames exist,
+	// using constant-time comparison to prevent timing attacks
+	match := 0
+	for u, p := range s.users {
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(u))
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(p))
+		match |= usernameMatch & passwordMatch
+	}
 
-	return usernameMatch && passwordMatch
+	return username, match == 1
 }
 
 // Handler returns the underlying http.Handler for use with custom servers
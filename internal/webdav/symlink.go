@@ -0,0 +1,98 @@
+package webdav
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy decides which symlinks in a share clients can follow
+type SymlinkPolicy string
+
+const (
+	// SymlinksDeny hides every symlink
+	SymlinksDeny SymlinkPolicy = "deny"
+	// SymlinksWithinRoot follows symlinks whose targets are inside the share
+	SymlinksWithinRoot SymlinkPolicy = "within-root"
+	// SymlinksFollowAll follows every symlink, even out of the share
+	SymlinksFollowAll SymlinkPolicy = "follow-all"
+)
+
+// symlinkPolicy checks paths against a SymlinkPolicy
+type symlinkPolicy struct {
+	policy SymlinkPolicy
+	root   string
+	// resolved is root with its own symlinks resolved
+	resolved string
+}
+
+// newSymlinkPolicy returns nil for SymlinksFollowAll, which needs no checks
+func newSymlinkPolicy(policy SymlinkPolicy, root string) (*symlinkPolicy, error) {
+	switch policy {
+	case SymlinksFollowAll:
+		return nil, nil
+	case "":
+		policy = SymlinksWithinRoot
+	case SymlinksDeny, SymlinksWithinRoot:
+	default:
+		return nil, fmt.Errorf("unknown symlink policy %q", policy)
+	}
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &symlinkPolicy{policy: policy, root: root, resolved: resolved}, nil
+}
+
+// resolve checks a cleaned slash path against the policy and returns the
+// path it really refers to in the share. Paths that don't exist yet resolve
+// through their parent, so files can be created.
+func (p *symlinkPolicy) resolve(name string) (string, bool) {
+	if p.policy == SymlinksDeny {
+		return name, !p.crossesLink(name)
+	}
+
+	local := filepath.Join(p.root, filepath.FromSlash(name))
+	resolved, err := filepath.EvalSymlinks(local)
+	if errors.Is(err, os.ErrNotExist) {
+		// A dangling link would create its target wherever it points
+		if fi, err := os.Lstat(local); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", false
+		}
+		if name == "/" {
+			return "", false
+		}
+		parent, ok := p.resolve(path.Dir(name))
+		return path.Join(parent, path.Base(name)), ok
+	}
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(p.resolved, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path.Clean("/" + filepath.ToSlash(rel)), true
+}
+
+// crossesLink reports whether any existing component of name is a symlink
+func (p *symlinkPolicy) crossesLink(name string) bool {
+	local := p.root
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		local = filepath.Join(local, part)
+		fi, err := os.Lstat(local)
+		if err != nil {
+			return false
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package webdav
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// symlinkShare makes a share with links to a file and a folder inside it, and
+// to a folder outside it
+func symlinkShare(t *testing.T) (root, outside string) {
+	t.Helper()
+	root, outside = t.TempDir(), t.TempDir()
+	writeFile(t, root, "/docs/a.txt", "inside")
+	writeFile(t, outside, "/secret.txt", "outside")
+	for link, target := range map[string]string{
+		"in.txt": filepath.Join(root, "docs", "a.txt"),
+		"indir":  filepath.Join(root, "docs"),
+		"out":    outside,
+		"escape": filepath.Join(outside, "secret.txt"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("can't create symlinks: %v", err)
+		}
+	}
+	return root, outside
+}
+
+func TestSymlinksWithinRoot(t *testing.T) {
+	root, outside := symlinkShare(t)
+	s := newTestServer(t, Config{Root: root})
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/in.txt", http.StatusOK},
+		{"/indir/a.txt", http.StatusOK},
+		{"/escape", http.StatusNotFound},
+		{"/out/secret.txt", http.StatusNotFound},
+	} {
+		if w := do(s, "GET", tc.path, "", nil); w.Code != tc.want {
+			t.Errorf("GET %s: %d, want %d", tc.path, w.Code, tc.want)
+		}
+	}
+
+	// Nothing can be written through a link that leaves the share
+	for _, name := range []string{"/out/new.txt", "/escape"} {
+		if w := do(s, "PUT", name, "pwned", nil); w.Code < 300 {
+			t.Errorf("PUT %s: %d", name, w.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("file created outside the share: %v", err)
+	}
+	if got := readFile(t, outside, "/secret.txt"); got != "outside" {
+		t.Errorf("file outside the share changed to %q", got)
+	}
+	if w := do(s, "MOVE", "/docs/a.txt", "", map[string]string{"Destination": "/out/moved.txt"}); w.Code < 300 {
+		t.Errorf("MOVE out of the share: %d", w.Code)
+	}
+
+	// Writing through a link inside the share changes its target
+	if w := do(s, "PUT", "/in.txt", "changed", nil); w.Code >= 300 {
+		t.Fatalf("PUT /in.txt: %d", w.Code)
+	}
+	if got := readFile(t, root, "/docs/a.txt"); got != "changed" {
+		t.Errorf("link target is %q", got)
+	}
+	if fi, err := os.Lstat(filepath.Join(root, "in.txt")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("PUT replaced the link: %v", err)
+	}
+}
+
+func TestSymlinksDeny(t *testing.T) {
+	root, _ := symlinkShare(t)
+	s := newTestServer(t, Config{Root: root, Symlinks: SymlinksDeny})
+
+	for _, name := range []string{"/in.txt", "/indir/a.txt", "/escape"} {
+		if w := do(s, "GET", name, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d, want 404", name, w.Code)
+		}
+	}
+	if w := do(s, "GET", "/docs/a.txt", "", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /docs/a.txt: %d", w.Code)
+	}
+}
+
+func TestSymlinksFollowAll(t *testing.T) {
+	root, _ := symlinkShare(t)
+	s := newTestServer(t, Config{Root: root, Symlinks: SymlinksFollowAll})
+
+	if w := do(s, "GET", "/out/secret.txt", "", nil); w.Code != http.StatusOK || w.Body.String() != "outside" {
+		t.Errorf("GET /out/secret.txt: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestSymlinkToHiddenPath(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "/.private/key", "secret")
+	if err := os.Symlink(filepath.Join(root, ".private"), filepath.Join(root, "public")); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	s := newTestServer(t, Config{Root: root})
+
+	if w := do(s, "GET", "/public/key", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET through a link to a hidden folder: %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,261 @@
+package webdav
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// TrashDir is the hidden folder in the share root holding deleted items
+	TrashDir = ".filegate-trash"
+
+	// purgeInterval throttles how often expired trash is looked for
+	purgeInterval = time.Hour
+)
+
+// ErrTrashItemNotFound is returned for unknown trash IDs
+var ErrTrashItemNotFound = errors.New("no such item in trash")
+
+// TrashItem describes a deleted file or folder
+type TrashItem struct {
+	ID string `json:"id"`
+	// Path is where the item was, relative to the share root ("/docs/a.txt")
+	Path      string    `json:"path"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+	IsDir     bool      `json:"is_dir,omitempty"`
+	Size      int64     `json:"size"`
+}
+
+// Trash manages the trash folder of a share. Items are kept freedesktop-style:
+// the content under files/<id> and its metadata in info/<id>.json.
+type Trash struct {
+	root string
+}
+
+// OpenTrash returns the trash of the share at root
+func OpenTrash(root string) *Trash {
+	return &Trash{root: root}
+}
+
+func (t *Trash) filesDir() string { return filepath.Join(t.root, TrashDir, "files") }
+func (t *Trash) infoDir() string  { return filepath.Join(t.root, TrashDir, "info") }
+
+// inTrash reports whether a cleaned slash path is the trash folder or inside it
+func inTrash(name string) bool {
+	return name == "/"+TrashDir || strings.HasPrefix(name, "/"+TrashDir+"/")
+}
+
+// Move moves the item at name (a slash path relative to the root) into the
+// trash, recording who deleted it
+func (t *Trash) Move(name, user string) (*TrashItem, error) {
+	name = path.Clean("/" + name)
+	if name == "/" || inTrash(name) {
+		return nil, os.ErrPermission
+	}
+	src := filepath.Join(t.root, filepath.FromSlash(name))
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newItemID()
+	if err != nil {
+		return nil, err
+	}
+	item := &TrashItem{
+		ID:        id,
+		Path:      name,
+		DeletedBy: user,
+		DeletedAt: time.Now(),
+		IsDir:     fi.IsDir(),
+		Size:      fi.Size(),
+	}
+	if item.IsDir {
+		item.Size = treeSize(src)
+	}
+
+	if err := os.MkdirAll(t.filesDir(), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(t.infoDir(), 0700); err != nil {
+		return nil, err
+	}
+	if err := t.writeInfo(item); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(src, filepath.Join(t.filesDir(), id)); err != nil {
+		os.Remove(t.infoPath(id))
+		return nil, fmt.Errorf("failed to move %s to trash: %w", name, err)
+	}
+	return item, nil
+}
+
+// List returns the trashed items, most recently deleted first
+func (t *Trash) List() ([]TrashItem, error) {
+	entries, err := os.ReadDir(t.infoDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var items []TrashItem
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		item, err := t.readInfo(id)
+		if err != nil {
+			continue
+		}
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+// Restore moves an item back to its original path, or to the slash path to
+// if given. It returns the path the item was restored to.
+func (t *Trash) Restore(id, to string) (string, error) {
+	item, err := t.readInfo(id)
+	if err != nil {
+		return "", err
+	}
+
+	dest := item.Path
+	if to != "" {
+		dest = path.Clean("/" + to)
+	}
+	if dest == "/" || inTrash(dest) {
+		return "", fmt.Errorf("can't restore to %s", dest)
+	}
+	target := filepath.Join(t.root, filepath.FromSlash(dest))
+	if _, err := os.Lstat(target); err == nil {
+		return "", fmt.Errorf("%s already exists; restore it somewhere else", dest)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(filepath.Join(t.filesDir(), id), target); err != nil {
+		return "", fmt.Errorf("failed to restore %s: %w", dest, err)
+	}
+	os.Remove(t.infoPath(id))
+	return dest, nil
+}
+
+// Purge permanently deletes items trashed more than maxAge ago and returns
+// how many were removed
+func (t *Trash) Purge(maxAge time.Duration) (int, error) {
+	items, err := t.List()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	cutoff := time.Now().Add(-maxAge)
+	for _, item := range items {
+		if item.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(t.filesDir(), item.ID)); err != nil {
+			return purged, err
+		}
+		os.Remove(t.infoPath(item.ID))
+		purged++
+	}
+	return purged, nil
+}
+
+func (t *Trash) infoPath(id string) string {
+	return filepath.Join(t.infoDir(), id+".json")
+}
+
+func (t *Trash) readInfo(id string) (*TrashItem, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, ErrTrashItemNotFound
+	}
+	data, err := os.ReadFile(t.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrTrashItemNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var item TrashItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, fmt.Errorf("corrupt trash entry %s: %w", id, err)
+	}
+	return &item, nil
+}
+
+func (t *Trash) writeInfo(item *TrashItem) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.infoPath(item.ID), data, 0600)
+}
+
+// newItemID returns a sortable, unique ID like 20240102-150405-1a2b3c
+func newItemID() (string, error) {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().Format(idTimeLayout) + "-" + hex.EncodeToString(b), nil
+}
+
+// trashFS turns deletes into moves to the trash. The webdav handler deletes
+// through RemoveAll for DELETE and for destinations overwritten by COPY and
+// MOVE, so all of those end up recoverable.
+type trashFS struct {
+	webdav.FileSystem
+	trash     *Trash
+	retention time.Duration
+
+	mu        sync.Mutex
+	lastPurge time.Time
+}
+
+func (t *trashFS) RemoveAll(ctx context.Context, name string) error {
+	// Let the wrapped file system report missing or hidden paths
+	if _, err := t.FileSystem.Stat(ctx, name); err != nil {
+		return err
+	}
+	user, _ := ctx.Value(userKey).(string)
+	if _, err := t.trash.Move(name, user); err != nil {
+		return err
+	}
+	t.purgeExpired()
+	return nil
+}
+
+// purgeExpired removes expired items at most once per purgeInterval
+func (t *trashFS) purgeExpired() {
+	if t.retention <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.lastPurge) < purgeInterval {
+		return
+	}
+	t.lastPurge = time.Now()
+	go t.trash.Purge(t.retention)
+}
@@ -0,0 +1,124 @@
+package webdav
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrashRestore(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "/docs/a.txt", "hello")
+	trash := OpenTrash(root)
+
+	item, err := trash.Move("/docs/a.txt", "admin")
+	if err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if item.Path != "/docs/a.txt" || item.DeletedBy != "admin" || item.Size != 5 {
+		t.Errorf("Move returned %+v", item)
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs", "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("file still in place after Move: %v", err)
+	}
+
+	items, err := trash.List()
+	if err != nil || len(items) != 1 || items[0].ID != item.ID {
+		t.Fatalf("List = %+v, %v", items, err)
+	}
+
+	// Restoring over a file that took the path is refused
+	writeFile(t, root, "/docs/a.txt", "newer")
+	if _, err := trash.Restore(item.ID, ""); err == nil {
+		t.Fatal("Restore overwrote an existing file")
+	}
+	if got := readFile(t, root, "/docs/a.txt"); got != "newer" {
+		t.Errorf("existing file changed to %q", got)
+	}
+
+	dest, err := trash.Restore(item.ID, "/old/a.txt")
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if dest != "/old/a.txt" {
+		t.Errorf("restored to %s", dest)
+	}
+	if got := readFile(t, root, "/old/a.txt"); got != "hello" {
+		t.Errorf("restored content is %q", got)
+	}
+	if _, err := trash.Restore(item.ID, ""); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Errorf("second Restore: %v, want ErrTrashItemNotFound", err)
+	}
+	if items, _ := trash.List(); len(items) != 0 {
+		t.Errorf("trash not empty after restore: %+v", items)
+	}
+}
+
+func TestTrashRestoreFolder(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "/docs/a.txt", "hello")
+	writeFile(t, root, "/docs/sub/b.txt", "world")
+	trash := OpenTrash(root)
+
+	item, err := trash.Move("/docs", "")
+	if err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if !item.IsDir || item.Size != 10 {
+		t.Errorf("Move returned %+v", item)
+	}
+	if _, err := trash.Restore(item.ID, ""); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got := readFile(t, root, "/docs/sub/b.txt"); got != "world" {
+		t.Errorf("restored content is %q", got)
+	}
+}
+
+func TestTrashRejectsBadIDs(t *testing.T) {
+	trash := OpenTrash(t.TempDir())
+	for _, id := range []string{"", "../info/x", ".hidden", `a\b`} {
+		if _, err := trash.Restore(id, ""); !errors.Is(err, ErrTrashItemNotFound) {
+			t.Errorf("Restore(%q): %v, want ErrTrashItemNotFound", id, err)
+		}
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "/a.txt", "a")
+	trash := OpenTrash(root)
+	if _, err := trash.Move("/a.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := trash.Purge(time.Hour); err != nil || n != 0 {
+		t.Errorf("Purge(1h) = %d, %v; want nothing purged", n, err)
+	}
+	if n, err := trash.Purge(0); err != nil || n != 1 {
+		t.Errorf("Purge(0) = %d, %v; want 1", n, err)
+	}
+	if items, _ := trash.List(); len(items) != 0 {
+		t.Errorf("items left after purge: %+v", items)
+	}
+}
+
+func TestDeleteMovesToTrash(t *testing.T) {
+	s := newTestServer(t, Config{Trash: true})
+	writeFile(t, s.root, "/a.txt", "hello")
+
+	if w := do(s, "DELETE", "/a.txt", "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d", w.Code)
+	}
+	items, err := OpenTrash(s.root).List()
+	if err != nil || len(items) != 1 || items[0].Path != "/a.txt" || items[0].DeletedBy != "admin" {
+		t.Fatalf("trash = %+v, %v", items, err)
+	}
+	// The trash itself stays out of reach of clients
+	if w := do(s, "GET", "/"+TrashDir+"/files/"+items[0].ID, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a trashed file: %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,604 @@
+package webdav
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// UploadsDir is the hidden folder in the share root holding unfinished
+	// resumable uploads
+	UploadsDir = ".filegate-uploads"
+
+	// uploadsPath is where clients create and resume uploads
+	uploadsPath = "/.uploads"
+
+	// uploadExpiry is how long an upload is kept after its last change
+	uploadExpiry = 24 * time.Hour
+
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	tusChunkType  = "application/offset+octet-stream"
+
+	// tusExposedHeaders are the response headers browser tus clients on
+	// other origins need to read, and tusAllowedHeaders the request headers
+	// they send
+	tusExposedHeaders = "Location, Upload-Offset, Upload-Length, Upload-Expires, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size"
+	tusAllowedHeaders = "Authorization, Content-Type, Content-Digest, If, Upload-Length, Upload-Offset, Upload-Metadata, Tus-Resumable"
+)
+
+// inUploads reports whether a cleaned slash path is the uploads folder or
+// inside it
+func inUploads(name string) bool {
+	return name == "/"+UploadsDir || strings.HasPrefix(name, "/"+UploadsDir+"/")
+}
+
+// upload is the state of a resumable upload, saved next to its data
+type upload struct {
+	ID string `json:"id"`
+	// Path is where the file goes once complete, relative to the share root
+	Path      string            `json:"path"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	User      string            `json:"user,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	// Done is set once the file was moved into place. The state is kept
+	// until it expires so a client that missed the last response can learn
+	// the upload finished.
+	Done bool `json:"done,omitempty"`
+}
+
+func (u *upload) expires() time.Time {
+	return u.UpdatedAt.Add(uploadExpiry)
+}
+
+// uploads implements the tus resumable upload protocol (https://tus.io) for
+// a share. Each upload is a data file and a JSON state file in UploadsDir;
+// the data file's size is the upload offset.
+type uploads struct {
+	dir string
+
+	mu        sync.Mutex
+	busy      map[string]bool
+	lastPurge time.Time
+}
+
+func newUploads(root string) *uploads {
+	return &uploads{dir: filepath.Join(root, UploadsDir), busy: make(map[string]bool)}
+}
+
+func (u *uploads) dataPath(id string) string { return filepath.Join(u.dir, id) }
+func (u *uploads) infoPath(id string) string { return filepath.Join(u.dir, id+".json") }
+
+func (u *uploads) load(id string) (*upload, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(u.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var up upload
+	if err := json.Unmarshal(data, &up); err != nil {
+		return nil, err
+	}
+	if time.Now().After(up.expires()) {
+		u.remove(id)
+		return nil, os.ErrNotExist
+	}
+	return &up, nil
+}
+
+func (u *uploads) save(up *upload) error {
+	data, err := json.MarshalIndent(up, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := u.infoPath(up.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.infoPath(up.ID))
+}
+
+func (u *uploads) remove(id string) {
+	os.Remove(u.dataPath(id))
+	os.Remove(u.infoPath(id))
+}
+
+// offset returns how many bytes of an upload were received
+func (u *uploads) offset(up *upload) int64 {
+	if up.Done {
+		return up.Length
+	}
+	fi, err := os.Stat(u.dataPath(up.ID))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// acquire marks an upload as being written, so two requests can't append
+// at once
+func (u *uploads) acquire(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy[id] {
+		return false
+	}
+	u.busy[id] = true
+	return true
+}
+
+func (u *uploads) release(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.busy, id)
+}
+
+// purgeExpired removes uploads not touched for uploadExpiry, at most once an
+// hour
+func (u *uploads) purgeExpired() {
+	u.mu.Lock()
+	if time.Since(u.lastPurge) < time.Hour {
+		u.mu.Unlock()
+		return
+	}
+	u.lastPurge = time.Now()
+	u.mu.Unlock()
+
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			// load removes expired uploads
+			u.load(id)
+		}
+	}
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// uploadID returns the upload a request path refers to ("" for the uploads
+// collection itself), and false for paths outside it
+func uploadID(name string) (string, bool) {
+	name = path.Clean("/" + name)
+	if name == uploadsPath {
+		return "", true
+	}
+	id, ok := strings.CutPrefix(name, uploadsPath+"/")
+	return id, ok
+}
+
+// setUploadCORS lets browser tus clients on other origins use the uploads
+// collection. Any origin is allowed but never with credentials, so pages
+// have to send the Authorization header themselves; the browser's saved
+// logins aren't used. It reports whether the request was a preflight, which
+// is answered here since it can't carry credentials.
+func setUploadCORS(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Origin") == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", tusExposedHeaders)
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", tusAllowedHeaders)
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// serveUpload handles tus requests under uploadsPath
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if s.limits.maxUpload > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.limits.maxUpload, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if v := r.Header.Get("Tus-Resumable"); v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == "POST":
+		s.createUpload(w, r)
+	case id != "" && r.Method == "HEAD":
+		s.headUpload(w, id)
+	case id != "" && r.Method == "PATCH":
+		s.patchUpload(w, r, id)
+	case id != "" && r.Method == "DELETE":
+		s.deleteUpload(w, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createUpload starts an upload. The destination comes from the "path"
+// metadata, or the "filename" metadata for a file in the share root.
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target := metadata["path"]
+	if target == "" {
+		target = metadata["filename"]
+	}
+	if target == "" {
+		http.Error(w, "Upload-Metadata needs a path or filename", http.StatusBadRequest)
+		return
+	}
+	target = path.Clean("/" + target)
+	if status, msg := s.checkUploadTarget(r.Context(), target); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+
+	var existing int64
+	if fi, err := s.fs.Stat(r.Context(), target); err == nil {
+		existing = fi.Size()
+	}
+	if allowed, status := s.limits.allowance(existing); allowed >= 0 && length > allowed {
+		http.Error(w, limitMessage(status, allowed), status)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	user, _ := r.Context().Value(userKey).(string)
+	now := time.Now()
+	up := &upload{
+		ID:        id,
+		Path:      target,
+		Length:    length,
+		Metadata:  metadata,
+		User:      user,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := os.MkdirAll(s.uploads.dir, 0700); err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(s.uploads.dataPath(id), nil, 0666); err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err := s.uploads.save(up); err != nil {
+		s.uploads.remove(id)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	s.uploads.purgeExpired()
+
+	w.Header().Set("Location", uploadsPath+"/"+id)
+	w.Header().Set("Upload-Expires", up.expires().UTC().Format(http.TimeFormat))
+
+	// creation-with-upload: the request may carry the first chunk
+	if r.Header.Get("Content-Type") == tusChunkType && r.ContentLength != 0 || length == 0 {
+		if !s.uploads.acquire(id) {
+			http.Error(w, "Upload is in use", http.StatusLocked)
+			return
+		}
+		defer s.uploads.release(id)
+		offset, status, msg := s.appendUpload(r, up, 0)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		if status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+	} else {
+		w.Header().Set("Upload-Offset", "0")
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) headUpload(w http.ResponseWriter, id string) {
+	up, err := s.uploads.load(id)
+	if err != nil {
+		http.Error(w, "No such upload", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.uploads.offset(up), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	w.Header().Set("Upload-Expires", up.expires().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) patchUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != tusChunkType {
+		http.Error(w, "Content-Type must be "+tusChunkType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if !s.uploads.acquire(id) {
+		http.Error(w, "Upload is in use", http.StatusLocked)
+		return
+	}
+	defer s.uploads.release(id)
+
+	up, err := s.uploads.load(id)
+	if err != nil {
+		http.Error(w, "No such upload", http.StatusNotFound)
+		return
+	}
+	if current := s.uploads.offset(up); offset != current {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+		http.Error(w, fmt.Sprintf("Upload-Offset is %d, not %d", current, offset), http.StatusConflict)
+		return
+	}
+
+	newOffset, status, msg := s.appendUpload(r, up, offset)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.Header().Set("Upload-Expires", up.expires().UTC().Format(http.TimeFormat))
+	if status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteUpload(w http.ResponseWriter, id string) {
+	if !s.uploads.acquire(id) {
+		http.Error(w, "Upload is in use", http.StatusLocked)
+		return
+	}
+	defer s.uploads.release(id)
+	if _, err := s.uploads.load(id); err != nil {
+		http.Error(w, "No such upload", http.StatusNotFound)
+		return
+	}
+	s.uploads.remove(id)
+	s.limits.invalidate()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendUpload writes a request body to an upload at offset and moves the
+// file into place once complete. Whatever arrives before a failure is kept,
+// so the client can resume from there, unless the chunk came with a
+// Content-Digest: then only a complete, matching chunk is kept. It returns
+// the new offset, and the status and message of an error response.
+func (s *Server) appendUpload(r *http.Request, up *upload, offset int64) (int64, int, string) {
+	if up.Done {
+		return up.Length, 0, ""
+	}
+	remaining := up.Length - offset
+	if r.ContentLength > remaining {
+		return offset, http.StatusRequestEntityTooLarge, "Chunk goes past Upload-Length"
+	}
+	check, err := parseContentDigest(r.Header)
+	if err != nil {
+		return offset, http.StatusBadRequest, err.Error()
+	}
+	space := s.limits.reserve(0)
+	defer space.release()
+	if !space.cover(min(r.ContentLength, remaining), 0) {
+		return offset, http.StatusInsufficientStorage, limitMessage(http.StatusInsufficientStorage, space.fits())
+	}
+
+	f, err := os.OpenFile(s.uploads.dataPath(up.ID), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return offset, http.StatusInternalServerError, "Failed to open upload"
+	}
+	// Chunks of unknown length are capped at the space there is as they
+	// arrive
+	body := &limitedBody{ReadCloser: r.Body, remaining: -1, space: space, hash: newMultiHash()}
+	n, copyErr := io.Copy(f, io.LimitReader(body, remaining))
+	status, msg := 0, ""
+	switch {
+	case body.status != 0:
+		status, msg = body.status, body.message
+	case copyErr != nil:
+		status, msg = http.StatusInternalServerError, "Upload interrupted; resume from Upload-Offset"
+	case check != nil:
+		if alg := check.verify(body.hash.sums()); alg != "" {
+			status, msg = http.StatusBadRequest, fmt.Sprintf("Content-Digest mismatch: %s of the received chunk differs", alg)
+		}
+	}
+	if status != 0 && check != nil {
+		// The digest is of the whole chunk, so none of it can be trusted
+		if f.Truncate(offset) == nil {
+			n = 0
+		}
+	}
+	if err := f.Close(); err != nil && status == 0 {
+		status, msg = http.StatusInternalServerError, "Upload interrupted; resume from Upload-Offset"
+	}
+	offset += n
+	s.limits.adjust(n)
+
+	up.UpdatedAt = time.Now()
+	s.uploads.save(up)
+	if status != 0 || offset < up.Length {
+		return offset, status, msg
+	}
+	if status, msg := s.finishUpload(r, up); status != 0 {
+		return offset, status, msg
+	}
+	return offset, 0, ""
+}
+
+// finishUpload moves a complete upload to its destination the way a PUT
+// replaces a file: under the destination's lock, saving the file it replaces
+// when versioning is on, and writing through a followed symlink
+func (s *Server) finishUpload(r *http.Request, up *upload) (int, string) {
+	ctx := r.Context()
+	if status, msg := s.checkUploadTarget(ctx, up.Path); status != 0 {
+		return status, msg
+	}
+
+	release, err := s.lockTarget(r, up.Path)
+	if err != nil {
+		return http.StatusLocked, "Destination is locked"
+	}
+	defer release()
+
+	version, err := s.snapshot(ctx, up.Path)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to save the previous version"
+	}
+	data := s.uploads.dataPath(up.ID)
+	local := replaceTarget(s.localPath(up.Path))
+	if fi, err := os.Stat(local); err == nil {
+		os.Chmod(data, fi.Mode().Perm())
+	}
+	sums, err := s.checksums.compute(data)
+	if err == nil {
+		err = os.Rename(data, local)
+	}
+	if err != nil {
+		s.settle(version, false)
+		return http.StatusInternalServerError, "Failed to move upload into place"
+	}
+	s.settle(version, true)
+
+	up.Done = true
+	up.UpdatedAt = time.Now()
+	s.uploads.save(up)
+	s.limits.invalidate()
+	if fi, err := os.Stat(local); err == nil {
+		s.checksums.put(local, fi, sums)
+	}
+	return 0, ""
+}
+
+// lockTarget locks name while a request changes it, like the handler does:
+// with the lock tokens in the request's If header if there are any, so a
+// client can write to a file it locked, and otherwise with a lock of its own
+// that fails if someone else holds one
+func (s *Server) lockTarget(r *http.Request, name string) (func(), error) {
+	ls := s.handler.LockSystem
+	if tokens := ifTokens(r.Header.Get("If")); len(tokens) > 0 {
+		conditions := make([]webdav.Condition, len(tokens))
+		for i, token := range tokens {
+			conditions[i].Token = token
+		}
+		return ls.Confirm(time.Now(), name, "", conditions...)
+	}
+	token, err := ls.Create(time.Now(), webdav.LockDetails{Root: name, Duration: -1, ZeroDepth: true})
+	if err != nil {
+		return nil, err
+	}
+	return func() { ls.Unlock(time.Now(), token) }, nil
+}
+
+// ifTokens returns the lock tokens an If header (RFC 4918 section 10.4)
+// submits, leaving out negated ones and the resource tags before lists
+func ifTokens(header string) []string {
+	var tokens []string
+	inList, negated := false, false
+	for i := 0; i < len(header); i++ {
+		switch c := header[i]; {
+		case c == '(':
+			inList = true
+		case c == ')':
+			inList, negated = false, false
+		case c == '<' || c == '[':
+			closing := byte('>')
+			if c == '[' {
+				closing = ']'
+			}
+			end := strings.IndexByte(header[i:], closing)
+			if end < 0 {
+				return tokens
+			}
+			if c == '<' && inList && !negated {
+				tokens = append(tokens, header[i+1:i+end])
+			}
+			negated = false
+			i += end
+		case inList && strings.HasPrefix(header[i:], "Not"):
+			negated = true
+			i += len("Not") - 1
+		}
+	}
+	return tokens
+}
+
+// checkUploadTarget checks that an upload may be written to target, returning
+// the status and message to reject it with
+func (s *Server) checkUploadTarget(ctx context.Context, target string) (int, string) {
+	if _, ok := versionsSubpath(target); ok || target == "/" {
+		return http.StatusForbidden, "Can't upload to " + target
+	}
+	if _, ok := uploadID(target); ok || s.hide.isHidden(ctx, target) {
+		return http.StatusForbidden, "Can't upload to " + target
+	}
+	parent, err := s.fs.Stat(ctx, path.Dir(target))
+	if err != nil || !parent.IsDir() {
+		return http.StatusConflict, "Folder " + path.Dir(target) + " doesn't exist"
+	}
+	if fi, err := s.fs.Stat(ctx, target); err == nil && fi.IsDir() {
+		return http.StatusConflict, target + " is a folder"
+	}
+	return 0, ""
+}
+
+// parseUploadMetadata decodes Upload-Metadata: comma-separated keys, each
+// followed by a base64 value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
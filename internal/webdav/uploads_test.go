@@ -0,0 +1,240 @@
+package webdav
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createUpload starts a tus upload of length bytes to target and returns its
+// URL
+func createUpload(t *testing.T, s *Server, target string, length int) string {
+	t.Helper()
+	w := do(s, "POST", uploadsPath, "", map[string]string{
+		"Tus-Resumable":   tusVersion,
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte(target)),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating an upload: %d %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+// patchUpload sends a chunk at offset, with the extra headers given
+func patchUpload(s *Server, url string, offset int, chunk string, header map[string]string) *httptest.ResponseRecorder {
+	h := map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Content-Type":  tusChunkType,
+		"Upload-Offset": strconv.Itoa(offset),
+	}
+	for k, v := range header {
+		h[k] = v
+	}
+	return do(s, "PATCH", url, chunk, h)
+}
+
+func uploadOffset(t *testing.T, s *Server, url string) string {
+	t.Helper()
+	w := do(s, "HEAD", url, "", map[string]string{"Tus-Resumable": tusVersion})
+	if w.Code != http.StatusOK {
+		t.Fatalf("HEAD %s: %d", url, w.Code)
+	}
+	return w.Header().Get("Upload-Offset")
+}
+
+func TestUploadResume(t *testing.T) {
+	s := newTestServer(t, Config{})
+	url := createUpload(t, s, "/a.txt", 10)
+	if got := uploadOffset(t, s, url); got != "0" {
+		t.Errorf("offset of a new upload = %s", got)
+	}
+
+	if w := patchUpload(s, url, 0, "hello", nil); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first chunk: %d, offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	// A client that lost track of the offset is told where to continue
+	w := patchUpload(s, url, 0, "hello", nil)
+	if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("chunk at a stale offset: %d, offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if got := uploadOffset(t, s, url); got != "5" {
+		t.Errorf("offset after resuming = %s, want 5", got)
+	}
+	if got := readFile(t, s.root, "/a.txt"); got != "" {
+		t.Errorf("unfinished upload is visible: %q", got)
+	}
+
+	if w := patchUpload(s, url, 5, "world", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: %d %s", w.Code, w.Body)
+	}
+	if got := readFile(t, s.root, "/a.txt"); got != "helloworld" {
+		t.Errorf("uploaded file = %q", got)
+	}
+	if got := uploadOffset(t, s, url); got != "10" {
+		t.Errorf("offset of a finished upload = %s", got)
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	s := newTestServer(t, Config{})
+	url := createUpload(t, s, "/a.txt", 10)
+	patchUpload(s, url, 0, "hello", nil)
+
+	id := strings.TrimPrefix(url, uploadsPath+"/")
+	up, err := s.uploads.load(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.UpdatedAt = time.Now().Add(-uploadExpiry - time.Minute)
+	if err := s.uploads.save(up); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := do(s, "HEAD", url, "", map[string]string{"Tus-Resumable": tusVersion}); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of an expired upload: %d, want 404", w.Code)
+	}
+	if w := patchUpload(s, url, 5, "world", nil); w.Code != http.StatusNotFound {
+		t.Errorf("PATCH of an expired upload: %d, want 404", w.Code)
+	}
+	for _, p := range []string{s.uploads.dataPath(id), s.uploads.infoPath(id)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", p, err)
+		}
+	}
+}
+
+func TestUploadChunkDigest(t *testing.T) {
+	s := newTestServer(t, Config{})
+	url := createUpload(t, s, "/a.txt", 10)
+
+	bad := map[string]string{"Content-Digest": sha256Digest("other")}
+	if w := patchUpload(s, url, 0, "hello", bad); w.Code != http.StatusBadRequest || w.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("chunk with a wrong digest: %d, offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	good := map[string]string{"Content-Digest": sha256Digest("hello")}
+	if w := patchUpload(s, url, 0, "hello", good); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("chunk with its digest: %d, offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestUploadReplacesLikePut(t *testing.T) {
+	s := newTestServer(t, Config{Versions: true})
+	writeFile(t, s.root, "/a.txt", "old")
+	os.Chmod(s.localPath("/a.txt"), 0600)
+
+	url := createUpload(t, s, "/a.txt", 3)
+	if w := patchUpload(s, url, 0, "new", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: %d %s", w.Code, w.Body)
+	}
+	if got := readFile(t, s.root, "/a.txt"); got != "new" {
+		t.Errorf("uploaded file = %q", got)
+	}
+	if fi, err := os.Stat(s.localPath("/a.txt")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("mode of the replaced file = %v, %v; want 0600", fi.Mode(), err)
+	}
+	if list, err := s.versions.List("/a.txt"); err != nil || len(list) != 1 {
+		t.Errorf("versions = %+v, %v; want the old content", list, err)
+	}
+}
+
+func TestUploadToLockedFile(t *testing.T) {
+	s := newTestServer(t, Config{})
+	writeFile(t, s.root, "/a.txt", "old")
+	w := do(s, "LOCK", "/a.txt", lockBody, map[string]string{"Timeout": "Infinite"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("LOCK: %d %s", w.Code, w.Body)
+	}
+	token := w.Header().Get("Lock-Token")
+
+	url := createUpload(t, s, "/a.txt", 3)
+	if w := patchUpload(s, url, 0, "new", nil); w.Code != http.StatusLocked {
+		t.Errorf("finishing without the lock token: %d, want 423", w.Code)
+	}
+	if got := readFile(t, s.root, "/a.txt"); got != "old" {
+		t.Errorf("locked file changed to %q", got)
+	}
+
+	// The lock holder finishes the upload with an empty last chunk
+	if w := patchUpload(s, url, 3, "", map[string]string{"If": "(" + token + ")"}); w.Code != http.StatusNoContent {
+		t.Errorf("finishing with the lock token: %d %s", w.Code, w.Body)
+	}
+	if got := readFile(t, s.root, "/a.txt"); got != "new" {
+		t.Errorf("uploaded file = %q", got)
+	}
+}
+
+func TestUploadChunkOfUnknownLength(t *testing.T) {
+	s := newTestServer(t, Config{Quota: 1000})
+	url := createUpload(t, s, "/a.bin", 900)
+	writeFile(t, s.root, "/other.bin", strings.Repeat("x", 500))
+	s.limits.invalidate()
+
+	req := httptest.NewRequest("PATCH", url, io.NopCloser(strings.NewReader(strings.Repeat("y", 900))))
+	req.ContentLength = -1
+	req.SetBasicAuth("admin", "pw")
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", tusChunkType)
+	req.Header.Set("Upload-Offset", "0")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("chunk past the quota: %d, want 507", w.Code)
+	}
+	if offset, _ := strconv.Atoi(w.Header().Get("Upload-Offset")); offset > 500 {
+		t.Errorf("offset after running out of space = %d", offset)
+	}
+}
+
+func TestUploadCORS(t *testing.T) {
+	s := newTestServer(t, Config{})
+
+	// Preflights carry no credentials
+	req := httptest.NewRequest("OPTIONS", uploadsPath, nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("preflight: %d %v", w.Code, w.Header())
+	}
+	if !strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Upload-Offset") {
+		t.Errorf("Access-Control-Allow-Headers = %q", w.Header().Get("Access-Control-Allow-Headers"))
+	}
+
+	w = do(s, "POST", uploadsPath, "", map[string]string{
+		"Origin":          "https://example.com",
+		"Tus-Resumable":   tusVersion,
+		"Upload-Length":   "3",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt")),
+	})
+	exposed := w.Header().Get("Access-Control-Expose-Headers")
+	for _, h := range []string{"Location", "Upload-Offset", "Tus-Resumable"} {
+		if !strings.Contains(exposed, h) {
+			t.Errorf("%s not exposed: %q", h, exposed)
+		}
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("credentials allowed across origins")
+	}
+}
+
+func TestIfTokens(t *testing.T) {
+	for header, want := range map[string][]string{
+		"":                                      nil,
+		"(<urn:a>)":                             {"urn:a"},
+		`</a.txt> (<urn:a> ["etag"]) (<urn:b>)`: {"urn:a", "urn:b"},
+		"(Not <urn:a> <urn:b>)":                 {"urn:b"},
+	} {
+		if got := ifTokens(header); !slices.Equal(got, want) {
+			t.Errorf("ifTokens(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
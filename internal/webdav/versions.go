@@ -0,0 +1,465 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// VersionsDir is the hidden folder in the share root holding old versions
+	VersionsDir = ".filegate-versions"
+
+	// versionsPath is the read-only collection clients browse versions in
+	versionsPath = "/.versions"
+
+	// idTimeLayout is the time prefix of item IDs
+	idTimeLayout = "20060102-150405"
+)
+
+// ErrVersionNotFound is returned for unknown version IDs
+var ErrVersionNotFound = errors.New("no such version")
+
+// Version is the earlier content of a file, saved when it was replaced
+type Version struct {
+	ID string `json:"id"`
+	// Path is the file's path relative to the share root ("/docs/a.txt")
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// ModTime is when the content was last modified, SavedAt when it was
+	// replaced
+	ModTime time.Time `json:"mod_time"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// Versions manages the old versions of a share's files. They are kept in a
+// tree mirroring the share: the versions of /docs/a.txt are the files in
+// VersionsDir/docs/a.txt/, named by ID. Subfolders there hold the versions
+// of what was below /docs/a.txt if it was a folder at some point.
+type Versions struct {
+	root string
+}
+
+// OpenVersions returns the version store of the share at root
+func OpenVersions(root string) *Versions {
+	return &Versions{root: root}
+}
+
+func (v *Versions) dir(name string) string {
+	return filepath.Join(v.root, VersionsDir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// inVersions reports whether a cleaned slash path is the version store or
+// inside it
+func inVersions(name string) bool {
+	return name == "/"+VersionsDir || strings.HasPrefix(name, "/"+VersionsDir+"/")
+}
+
+// versionsSubpath maps a path in the virtual versions collection to the path
+// in the store, and reports false for paths outside the collection
+func versionsSubpath(name string) (string, bool) {
+	name = path.Clean("/" + name)
+	if name == versionsPath {
+		return "/", true
+	}
+	rest, ok := strings.CutPrefix(name, versionsPath+"/")
+	return "/" + rest, ok
+}
+
+// Save copies the current content of the file at name (a slash path relative
+// to the root) into the store
+func (v *Versions) Save(name string) (*Version, error) {
+	name = path.Clean("/" + name)
+	src := filepath.Join(v.root, filepath.FromSlash(name))
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a file", name)
+	}
+
+	id, err := newItemID()
+	if err != nil {
+		return nil, err
+	}
+	id += path.Ext(name)
+	dir := v.dir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	dst := filepath.Join(dir, id)
+	if err := copyFile(src, dst, fi.ModTime()); err != nil {
+		return nil, fmt.Errorf("failed to save version of %s: %w", name, err)
+	}
+
+	saved, _ := versionTime(id)
+	return &Version{ID: id, Path: name, Size: fi.Size(), ModTime: fi.ModTime(), SavedAt: saved}, nil
+}
+
+// List returns the saved versions of the file at name, newest first
+func (v *Versions) List(name string) ([]Version, error) {
+	name = path.Clean("/" + name)
+	entries, err := os.ReadDir(v.dir(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		saved, ok := versionTime(e.Name())
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, Version{
+			ID:      e.Name(),
+			Path:    name,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			SavedAt: saved,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+	return versions, nil
+}
+
+// Restore replaces the file at name with one of its versions, which may be
+// given by an unambiguous prefix of its ID. The current content is saved as a
+// version first, so a restore can be undone.
+func (v *Versions) Restore(name, id string) (*Version, error) {
+	versions, err := v.List(name)
+	if err != nil {
+		return nil, err
+	}
+	var match *Version
+	for i := range versions {
+		if versions[i].ID == id {
+			match = &versions[i]
+			break
+		}
+		if id != "" && strings.HasPrefix(versions[i].ID, id) {
+			if match != nil {
+				return nil, fmt.Errorf("%q matches more than one version", id)
+			}
+			match = &versions[i]
+		}
+	}
+	if match == nil {
+		return nil, ErrVersionNotFound
+	}
+
+	target := filepath.Join(v.root, filepath.FromSlash(match.Path))
+	if fi, err := os.Stat(target); err == nil && fi.Mode().IsRegular() {
+		if _, err := v.Save(match.Path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	if err := copyFile(filepath.Join(v.dir(name), match.ID), target, match.ModTime); err != nil {
+		return nil, fmt.Errorf("failed to restore %s: %w", match.Path, err)
+	}
+	return match, nil
+}
+
+// Remove deletes one version
+func (v *Versions) Remove(version *Version) error {
+	err := os.Remove(filepath.Join(v.dir(version.Path), version.ID))
+	v.removeEmptyDirs(version.Path)
+	return err
+}
+
+// putBack moves a version back in place of its file
+func (v *Versions) putBack(version *Version) error {
+	target := filepath.Join(v.root, filepath.FromSlash(version.Path))
+	err := os.Rename(filepath.Join(v.dir(version.Path), version.ID), target)
+	v.removeEmptyDirs(version.Path)
+	return err
+}
+
+// Prune deletes the versions of name beyond the newest keep, and those saved
+// more than maxAge ago. Zero disables either rule.
+func (v *Versions) Prune(name string, keep int, maxAge time.Duration) error {
+	versions, err := v.List(name)
+	if err != nil {
+		return err
+	}
+	for i, version := range versions {
+		if (keep > 0 && i >= keep) || (maxAge > 0 && time.Since(version.SavedAt) > maxAge) {
+			if err := os.Remove(filepath.Join(v.dir(name), version.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	v.removeEmptyDirs(name)
+	return nil
+}
+
+// PurgeExpired deletes every version saved more than maxAge ago and returns
+// how many were removed
+func (v *Versions) PurgeExpired(maxAge time.Duration) (int, error) {
+	purged := 0
+	cutoff := time.Now().Add(-maxAge)
+	err := filepath.WalkDir(filepath.Join(v.root, VersionsDir), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		if saved, ok := versionTime(d.Name()); ok && saved.Before(cutoff) {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// removeEmptyDirs removes the store folder of name and its parents while
+// they are empty
+func (v *Versions) removeEmptyDirs(name string) {
+	for name = path.Clean("/" + name); name != "/"; name = path.Dir(name) {
+		if os.Remove(v.dir(name)) != nil {
+			return
+		}
+	}
+}
+
+// versionTime parses the time a version was saved from its ID
+func versionTime(id string) (time.Time, bool) {
+	if len(id) < len(idTimeLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(idTimeLayout, id[:len(idTimeLayout)], time.Local)
+	return t, err == nil
+}
+
+// copyFile copies src over dst through a temporary file, so dst is never
+// left half written
+func copyFile(src, dst string, modTime time.Time) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// snapshot saves the file at name before a request replaces it. It does
+// nothing when versioning is off or name isn't a visible file.
+func (s *Server) snapshot(ctx context.Context, name string) (*Version, error) {
+	if s.versions == nil {
+		return nil, nil
+	}
+	if _, ok := versionsSubpath(name); ok {
+		return nil, nil
+	}
+	fi, err := s.fs.Stat(ctx, name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	version, err := s.versions.Save(name)
+	if err != nil {
+		return nil, err
+	}
+	s.limits.invalidate()
+	return version, nil
+}
+
+// settle applies the retention rules after a file was replaced. If the
+// request failed instead, the snapshot is dropped, or moved back if the file
+// was already truncated or removed.
+func (s *Server) settle(version *Version, ok bool) {
+	if version == nil {
+		return
+	}
+	if ok {
+		s.versions.Prune(version.Path, s.versionsKeep, s.versionsMaxAge)
+	} else if fi, err := os.Stat(s.localPath(version.Path)); err == nil && fi.Size() == version.Size && fi.ModTime().Equal(version.ModTime) {
+		s.versions.Remove(version)
+	} else {
+		s.versions.putBack(version)
+	}
+	s.limits.invalidate()
+}
+
+// destination returns the path a COPY or MOVE would overwrite, or "" if it
+// won't overwrite anything. Like the handler, COPY overwrites unless told not
+// to and MOVE only when told to.
+func destination(r *http.Request) string {
+	overwrite := r.Header.Get("Overwrite")
+	if overwrite == "F" || (r.Method == "MOVE" && overwrite != "T") {
+		return ""
+	}
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return ""
+	}
+	return path.Clean(u.Path)
+}
+
+// statusRecorder remembers the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// versionFS serves the version store as the read-only collection
+// versionsPath, hiding the versions of hidden files
+type versionFS struct {
+	webdav.FileSystem
+	store  webdav.FileSystem
+	hidden func(name string, isDir bool) bool
+}
+
+// visible reports whether the store path name may be shown. Versions are
+// files named by ID; every folder above them stands for a path in the share.
+func (v *versionFS) visible(ctx context.Context, name string) bool {
+	if name == "/" {
+		return true
+	}
+	subject := name
+	if fi, err := v.store.Stat(ctx, name); err == nil && fi.Mode().IsRegular() {
+		subject = path.Dir(name)
+	}
+	return !v.hidden(subject, false) && !v.hidden(subject, true)
+}
+
+func (v *versionFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, ok := versionsSubpath(name); ok {
+		return os.ErrPermission
+	}
+	return v.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (v *versionFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	sub, ok := versionsSubpath(name)
+	if !ok {
+		return v.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	if !v.visible(ctx, sub) {
+		return nil, os.ErrNotExist
+	}
+	f, err := v.store.OpenFile(ctx, sub, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		return &versionDir{File: f, ctx: ctx, name: sub, fs: v}, nil
+	}
+	return f, nil
+}
+
+func (v *versionFS) RemoveAll(ctx context.Context, name string) error {
+	if _, ok := versionsSubpath(name); ok {
+		return os.ErrPermission
+	}
+	return v.FileSystem.RemoveAll(ctx, name)
+}
+
+func (v *versionFS) Rename(ctx context.Context, oldName, newName string) error {
+	_, oldOK := versionsSubpath(oldName)
+	_, newOK := versionsSubpath(newName)
+	if oldOK || newOK {
+		return os.ErrPermission
+	}
+	return v.FileSystem.Rename(ctx, oldName, newName)
+}
+
+func (v *versionFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	sub, ok := versionsSubpath(name)
+	if !ok {
+		return v.FileSystem.Stat(ctx, name)
+	}
+	if !v.visible(ctx, sub) {
+		return nil, os.ErrNotExist
+	}
+	return v.store.Stat(ctx, sub)
+}
+
+// versionDir leaves the versions of hidden files out of listings
+type versionDir struct {
+	webdav.File
+	ctx  context.Context
+	name string
+	fs   *versionFS
+}
+
+func (d *versionDir) Readdir(count int) ([]os.FileInfo, error) {
+	var visible []os.FileInfo
+	for {
+		entries, err := d.File.Readdir(count)
+		for _, fi := range entries {
+			if strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			if fi.Mode().IsRegular() || d.fs.visible(d.ctx, path.Join(d.name, fi.Name())) {
+				visible = append(visible, fi)
+			}
+		}
+		if err != nil || count <= 0 || len(visible) >= count || len(entries) == 0 {
+			return visible, err
+		}
+	}
+}
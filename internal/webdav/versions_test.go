@@ -0,0 +1,132 @@
+package webdav
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// saveVersionAt adds a version of name saved at the given time to the store
+func saveVersionAt(t *testing.T, root, name, content string, saved time.Time) string {
+	t.Helper()
+	id := saved.Format(idTimeLayout) + "-abcdef.txt"
+	writeFile(t, filepath.Join(root, VersionsDir), name+"/"+id, content)
+	return id
+}
+
+func TestVersionsSaveAndRestore(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "/docs/a.txt", "one")
+	versions := OpenVersions(root)
+
+	saved, err := versions.Save("/docs/a.txt")
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if saved.Path != "/docs/a.txt" || saved.Size != 3 {
+		t.Errorf("Save returned %+v", saved)
+	}
+	writeFile(t, root, "/docs/a.txt", "two")
+
+	restored, err := versions.Restore("/docs/a.txt", saved.ID[:len(idTimeLayout)+3])
+	if err != nil {
+		t.Fatalf("Restore by ID prefix: %v", err)
+	}
+	if restored.ID != saved.ID {
+		t.Errorf("restored %s, want %s", restored.ID, saved.ID)
+	}
+	if got := readFile(t, root, "/docs/a.txt"); got != "one" {
+		t.Errorf("content after restore is %q", got)
+	}
+	// The replaced content was saved, so the restore can be undone
+	list, err := versions.List("/docs/a.txt")
+	if err != nil || len(list) != 2 {
+		t.Fatalf("List = %+v, %v", list, err)
+	}
+
+	if _, err := versions.Restore("/docs/a.txt", "19990101"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("Restore of an unknown version: %v, want ErrVersionNotFound", err)
+	}
+}
+
+func TestVersionsPrune(t *testing.T) {
+	root := t.TempDir()
+	versions := OpenVersions(root)
+	now := time.Now()
+	var ids []string
+	for i := range 5 {
+		ids = append(ids, saveVersionAt(t, root, "/a.txt", "v", now.Add(-time.Duration(i)*time.Hour)))
+	}
+
+	// Keep the newest three
+	if err := versions.Prune("/a.txt", 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := versions.List("/a.txt")
+	if len(list) != 3 || list[0].ID != ids[0] || list[2].ID != ids[2] {
+		t.Fatalf("after keeping 3: %+v", list)
+	}
+
+	// Drop those saved over 90 minutes ago
+	if err := versions.Prune("/a.txt", 0, 90*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = versions.List("/a.txt")
+	if len(list) != 2 || list[0].ID != ids[0] || list[1].ID != ids[1] {
+		t.Fatalf("after pruning by age: %+v", list)
+	}
+
+	// Pruning the last version removes the file's folder in the store
+	saveVersionAt(t, root, "/docs/b.txt", "v", now.Add(-time.Hour))
+	if err := versions.Prune("/docs/b.txt", 0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, VersionsDir, "docs")); !os.IsNotExist(err) {
+		t.Errorf("empty version folder left behind: %v", err)
+	}
+}
+
+func TestVersionsPurgeExpired(t *testing.T) {
+	root := t.TempDir()
+	versions := OpenVersions(root)
+	saveVersionAt(t, root, "/a.txt", "old", time.Now().Add(-48*time.Hour))
+	keep := saveVersionAt(t, root, "/docs/b.txt", "new", time.Now())
+
+	n, err := versions.PurgeExpired(24 * time.Hour)
+	if err != nil || n != 1 {
+		t.Fatalf("PurgeExpired = %d, %v; want 1", n, err)
+	}
+	if list, _ := versions.List("/docs/b.txt"); len(list) != 1 || list[0].ID != keep {
+		t.Errorf("recent version purged: %+v", list)
+	}
+}
+
+func TestPutSavesVersions(t *testing.T) {
+	s := newTestServer(t, Config{Versions: true, VersionsKeep: 2})
+	writeFile(t, s.root, "/a.txt", "v1")
+
+	for _, content := range []string{"v2", "v3", "v4"} {
+		if w := do(s, "PUT", "/a.txt", content, nil); w.Code >= 300 {
+			t.Fatalf("PUT %s: %d", content, w.Code)
+		}
+	}
+	list, err := s.versions.List("/a.txt")
+	if err != nil || len(list) != 2 {
+		t.Fatalf("versions = %+v, %v; want the 2 kept", list, err)
+	}
+
+	// Versions are served read-only under /.versions
+	w := do(s, "PROPFIND", versionsPath+"/a.txt", "", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus {
+		t.Errorf("PROPFIND %s: %d", versionsPath, w.Code)
+	}
+	if w := do(s, "PUT", versionsPath+"/a.txt/"+list[0].ID, "x", nil); w.Code < 300 {
+		t.Errorf("PUT into %s: %d", versionsPath, w.Code)
+	}
+	if w := do(s, "GET", versionsPath+"/a.txt/"+list[0].ID, "", nil); w.Code != http.StatusOK || w.Body.String() == "v4" {
+		t.Errorf("GET of a version: %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,124 @@
+package webproxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// PreserveHost as Config.HostHeader passes the public host to the app
+const PreserveHost = "preserve"
+
+// Config holds configuration for the proxy
+type Config struct {
+	// Target is the local web app: a port, host:port or URL (e.g. "3000"
+	// or "http://localhost:3000")
+	Target string
+	// HostHeader is the Host sent to the app: empty for the target's,
+	// PreserveHost for the public one, or any other host name
+	HostHeader string
+	// Username and Password, if Password is set, are required with Basic
+	// Auth before anything reaches the app
+	Username string
+	Password string
+}
+
+// Proxy forwards requests to a local web app
+type Proxy struct {
+	target   *url.URL
+	proxy    *httputil.ReverseProxy
+	username string
+	password string
+}
+
+// New creates a new proxy
+func New(cfg Config) (*Proxy, error) {
+	target, err := ParseTarget(cfg.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{target: target, username: cfg.Username, password: cfg.Password}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			switch cfg.HostHeader {
+			case "":
+				// SetURL sends the target's host
+			case PreserveHost:
+				r.Out.Host = r.In.Host
+			default:
+				r.Out.Host = cfg.HostHeader
+			}
+			// The app shouldn't see the proxy's credentials
+			if p.password != "" {
+				r.Out.Header.Del("Authorization")
+			}
+		},
+		ModifyResponse: p.rewriteLocation,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, fmt.Sprintf("%s is not responding: %v", target.Host, err), http.StatusBadGateway)
+		},
+	}
+	return p, nil
+}
+
+// ParseTarget turns a port, host:port or URL into the URL of a web app
+func ParseTarget(s string) (*url.URL, error) {
+	if _, err := strconv.Atoi(s); err == nil {
+		s = net.JoinHostPort("localhost", s)
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid target %q: expected a port, host:port or http(s) URL", s)
+	}
+	return u, nil
+}
+
+// Target returns the URL requests are forwarded to
+func (p *Proxy) Target() *url.URL {
+	return p.target
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.password != "" && !p.authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="filegate"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	p.proxy.ServeHTTP(w, r)
+}
+
+// authenticate checks the request's Basic Auth credentials in constant time
+func (p *Proxy) authenticate(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(p.username))
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(p.password))
+	return usernameMatch&passwordMatch == 1
+}
+
+// rewriteLocation makes redirects to the app's own address relative, so they
+// stay on the public URL
+func (p *Proxy) rewriteLocation(resp *http.Response) error {
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Host != p.target.Host {
+		return nil
+	}
+	location.Scheme = ""
+	location.Host = ""
+	location.User = nil
+	resp.Header.Set("Location", location.String())
+	return nil
+}